@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/avalkov/SCS/internal/configuration"
+	scsamqp "github.com/avalkov/SCS/internal/queueservice/amqp"
+	"github.com/streadway/amqp"
+)
+
+// runDeadLetterCommand lists or re-injects requests from the dead-letter queue.
+func runDeadLetterCommand(ch *amqp.Channel, config configuration.AMQPConfig, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("Usage: %s dlq list | dlq replay [max_messages]", os.Args[0])
+	}
+
+	switch args[0] {
+	case "list":
+		listDeadLetters(ch, config.DeadLetterQueue)
+	case "replay":
+		max := -1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			failOnError(err, "Invalid max_messages")
+			max = n
+		}
+		replayDeadLetters(ch, config, max)
+	default:
+		log.Fatalf("Usage: %s dlq list | dlq replay [max_messages]", os.Args[0])
+	}
+}
+
+// listDeadLetters prints every dead-lettered request and leaves them in the queue.
+func listDeadLetters(ch *amqp.Channel, queue string) {
+	var last *amqp.Delivery
+	for {
+		d, ok, err := ch.Get(queue, false)
+		failOnError(err, "Failed to get a dead-lettered message")
+		if !ok {
+			break
+		}
+		last = &d
+
+		fmt.Printf("correlation_id=%s reply_to=%v worker=%v error_code=%v reason=%q body=%q\n",
+			d.CorrelationId,
+			d.Headers[scsamqp.OriginalReplyToHeader],
+			d.Headers[scsamqp.WorkerHeader],
+			d.Headers[scsamqp.ErrorCodeHeader],
+			d.Headers[scsamqp.FailureReasonHeader],
+			d.Body)
+	}
+
+	if last == nil {
+		fmt.Println("Dead-letter queue is empty")
+		return
+	}
+	failOnError(last.Nack(true, true), "Failed to return messages to the dead-letter queue")
+}
+
+// replayDeadLetters publishes up to max dead-lettered requests (all when max < 0)
+// back to the queue they came from, with their original reply-to and a fresh delivery count.
+func replayDeadLetters(ch *amqp.Channel, config configuration.AMQPConfig, max int) {
+	// Only replay what is in the queue now, so requests failing again are not picked up in a loop.
+	q, err := ch.QueueInspect(config.DeadLetterQueue)
+	failOnError(err, "Failed to inspect the dead-letter queue")
+	if max < 0 || max > q.Messages {
+		max = q.Messages
+	}
+
+	replayed := 0
+	for ; replayed < max; replayed++ {
+		d, ok, err := ch.Get(config.DeadLetterQueue, false)
+		failOnError(err, "Failed to get a dead-lettered message")
+		if !ok {
+			break
+		}
+
+		queue, _ := d.Headers[scsamqp.OriginalQueueHeader].(string)
+		if queue == "" {
+			queue = config.QueueName
+		}
+		replyTo, _ := d.Headers[scsamqp.OriginalReplyToHeader].(string)
+
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			switch k {
+			case scsamqp.DeliveryCountHeader, scsamqp.FailureReasonHeader, scsamqp.ErrorCodeHeader,
+				scsamqp.WorkerHeader, scsamqp.OriginalReplyToHeader, scsamqp.OriginalQueueHeader:
+			default:
+				headers[k] = v
+			}
+		}
+
+		err = ch.Publish(
+			"",    // exchange
+			queue, // routing key
+			false, // mandatory
+			false, // immediate
+			amqp.Publishing{
+				Headers:       headers,
+				ContentType:   d.ContentType,
+				CorrelationId: d.CorrelationId,
+				ReplyTo:       replyTo,
+				Body:          d.Body,
+			})
+		if err != nil {
+			d.Nack(false, true)
+			failOnError(err, "Failed to replay a dead-lettered message")
+		}
+		failOnError(d.Ack(false), "Failed to acknowledge a dead-lettered message")
+	}
+
+	fmt.Printf("Replayed %d messages\n", replayed)
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"regexp"
 	"time"
 
 	"github.com/avalkov/SCS/internal/configuration"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
 	"github.com/joho/godotenv"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/streadway/amqp"
@@ -25,8 +27,6 @@ const (
 	replyQueue = "reply_queue"
 )
 
-var jsonArrayRegex = regexp.MustCompile(`^\s*\[\s*.*\s*\]\s*$`)
-
 func failOnError(err error, msg string) {
 	if err != nil {
 		log.Fatalf("%s: %s", msg, err)
@@ -93,7 +93,7 @@ func sendCommand(ch *amqp.Channel, command string, requestQueue, replyQueue stri
 	failOnError(err, "Failed to publish a message")
 }
 
-func receiveReplies(ch *amqp.Channel, replyQueue string, clientID int) {
+func receiveReplies(ch *amqp.Channel, replyQueue string, clientID int, assembler *protocol.Assembler) {
 	msgs, err := ch.Consume(
 		replyQueue, // queue
 		"",         // consumer
@@ -107,8 +107,18 @@ func receiveReplies(ch *amqp.Channel, replyQueue string, clientID int) {
 
 	for d := range msgs {
 		fmt.Printf("Client %d received reply: %s\n", clientID, d.Body)
-		if jsonArrayRegex.Match(d.Body) {
-			saveToFile(fmt.Sprintf("getAllItemsResponse_client_%d.json", clientID), d.Body)
+		reply, complete, err := assembler.Add(queueservice.Message{Body: string(d.Body), CorrelationId: d.CorrelationId})
+		if err != nil {
+			log.Printf("Client %d received malformed reply: %v", clientID, err)
+			continue
+		}
+		if !complete {
+			continue
+		}
+		if reply.Status == protocol.StatusOK && reply.Command == "getAllItems" {
+			items, err := json.Marshal(reply.Value)
+			failOnError(err, "Failed to encode items")
+			saveToFile(fmt.Sprintf("getAllItemsResponse_client_%d.json", clientID), items)
 		}
 	}
 }
@@ -124,7 +134,7 @@ func saveToFile(filename string, data []byte) {
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s <commands_file_1> <commands_file_2> ... <commands_file_n>", os.Args[0])
+		log.Fatalf("Usage: %s <commands_file_1> <commands_file_2> ... <commands_file_n>\n       %s dlq list | dlq replay [max_messages]", os.Args[0], os.Args[0])
 	}
 
 	godotenv.Load(".env")
@@ -137,15 +147,24 @@ func main() {
 	conn, ch := connectToRabbitMQ(config.AMQP.User, config.AMQP.Pass, config.AMQP.Host, config.AMQP.Port)
 	defer conn.Close()
 
+	if os.Args[1] == "dlq" {
+		runDeadLetterCommand(ch, config.AMQP, os.Args[2:])
+		return
+	}
+
 	replyQueue := declareQueue(ch, replyQueue)
 
+	// Large replies arrive in chunks, possibly at different consumers of the reply
+	// queue, and are collected until the reply is complete.
+	assembler := protocol.NewAssembler()
+
 	for i, filename := range os.Args[1:] {
 		log.Printf("Processing commands from file: %s", filename)
 		commands, err := loadCommandsFromFile(filename)
 		failOnError(err, fmt.Sprintf("Failed to load commands from file %s", filename))
 
 		go func(clientID int, commands []string) {
-			go receiveReplies(ch, replyQueue.Name, clientID)
+			go receiveReplies(ch, replyQueue.Name, clientID, assembler)
 			for _, command := range commands {
 				sendCommand(ch, command, config.AMQP.QueueName, replyQueue.Name)
 			}
@@ -10,7 +10,12 @@ import (
 	ds "github.com/avalkov/SCS/internal/datastructures"
 	commandsParser "github.com/avalkov/SCS/internal/domain/commands_parser"
 	commandsProcessor "github.com/avalkov/SCS/internal/domain/commands_processor"
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/domain/pubsub"
 	"github.com/avalkov/SCS/internal/multiworker"
+	"github.com/avalkov/SCS/internal/persistence"
 	"github.com/avalkov/SCS/internal/queueservice"
 	"github.com/avalkov/SCS/internal/queueservice/amqp"
 	"github.com/joho/godotenv"
@@ -34,6 +39,42 @@ func run() error {
 	if err := envconfig.Process(ctx, &config); err != nil {
 		return err
 	}
+	if config.MAX_REPLY_SIZE != 0 && config.MAX_REPLY_SIZE < protocol.MinReplySize {
+		return fmt.Errorf("MAX_REPLY_SIZE must be 0 or at least %d bytes, got %d", protocol.MinReplySize, config.MAX_REPLY_SIZE)
+	}
+
+	// The store must be fully restored before any request is consumed,
+	// so persistence is set up ahead of the AMQP worker. Each worker owns
+	// the shard of the store holding the keys the partitioner assigns to it.
+	partitioner := ds.NewPartitioner(config.PROCESSING_WORKERS_COUNT)
+	store := ds.NewShardedMap(partitioner)
+	if config.PREFIX_INDEX {
+		store.IndexKeys()
+	}
+
+	var mutationLog commandsProcessor.MutationLog
+	var wal *persistence.WAL
+	var snapshots *persistence.SnapshotStore
+	if config.Persistence.Dir != "" {
+		var err error
+		wal, snapshots, err = openPersistence(config.Persistence, store)
+		if err != nil {
+			return err
+		}
+		defer wal.Close()
+		mutationLog = wal
+	}
+
+	// Key notifications and pub/sub messages share one delivery queue, so they
+	// reach subscribers in the order they were sent. Subscriptions of reply queues
+	// that disappear are dropped once a message to them is returned.
+	subscriptions := delivery.NewQueue()
+	notifier := keyspace.NewNotifier(subscriptions)
+	broker := pubsub.NewBroker(subscriptions)
+	dropSubscriptions := func(replyTo string) {
+		notifier.Drop(replyTo)
+		broker.Drop(replyTo)
+	}
 
 	amqpWorker := amqp.NewAmqpWorker(amqp.AmqpConfig{
 		Host:      config.AMQP.Host,
@@ -41,6 +82,14 @@ func run() error {
 		User:      config.AMQP.User,
 		Pass:      config.AMQP.Pass,
 		QueueName: config.AMQP.QueueName,
+
+		ReconnectMinBackoff: config.AMQP.ReconnectMinBackoff,
+		ReconnectMaxBackoff: config.AMQP.ReconnectMaxBackoff,
+		PrefetchCount:       config.AMQP.PrefetchCount,
+		MaxDeliveries:       config.AMQP.MaxDeliveries,
+		DeadLetterExchange:  config.AMQP.DeadLetterExchange,
+		DeadLetterQueue:     config.AMQP.DeadLetterQueue,
+		OnUnroutable:        dropSubscriptions,
 	})
 	if err := amqpWorker.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize AMQP worker: %v", err)
@@ -59,14 +108,23 @@ func run() error {
 	}
 
 	parser := commandsParser.NewCommandsParser()
-	processor := commandsProcessor.NewCommandsProcessor(parser, ds.NewOrderedMap())
+	processor := commandsProcessor.NewCommandsProcessor(store, mutationLog, notifier, partitioner)
+
+	if wal != nil && config.Persistence.SnapshotInterval > 0 {
+		snapshotter := persistence.NewSnapshotter(processor, snapshots, wal, config.Persistence.SnapshotInterval)
+		go snapshotter.Run(ctx)
+	}
 
 	multiWorker := multiworker.NewMultiWorker(
-		config.PROCESSING_WORKERS_COUNT,
+		partitioner,
 		parser,
 		processor,
+		notifier,
+		broker,
+		config.MAX_REPLY_SIZE,
 	)
 
+	go subscriptions.Run(ctx, repliesChans)
 	go multiWorker.Run(ctx, requestsChans, repliesChans)
 
 	log.Printf("Server started")
@@ -75,3 +133,32 @@ func run() error {
 
 	return nil
 }
+
+func openPersistence(config configuration.PersistenceConfig, store *ds.ShardedMap) (*persistence.WAL, *persistence.SnapshotStore, error) {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create persistence directory: %v", err)
+	}
+
+	snapshots, err := persistence.NewSnapshotStore(config.Dir, config.SnapshotRetention)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wal, err := persistence.OpenWAL(persistence.WALConfig{
+		Dir:           config.Dir,
+		FsyncPolicy:   persistence.FsyncPolicy(config.FsyncPolicy),
+		FsyncInterval: config.FsyncInterval,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open WAL: %v", err)
+	}
+
+	if err := persistence.Restore(snapshots, wal, store); err != nil {
+		wal.Close()
+		return nil, nil, fmt.Errorf("failed to restore persisted state: %v", err)
+	}
+
+	log.Printf("Restored %d items", len(store.GetAll()))
+
+	return wal, snapshots, nil
+}
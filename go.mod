@@ -3,7 +3,7 @@ module github.com/avalkov/SCS
 go 1.22.3
 
 require (
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/sethvargo/go-envconfig v1.1.0 // indirect
-	github.com/streadway/amqp v1.1.0 // indirect
+	github.com/joho/godotenv v1.5.1
+	github.com/sethvargo/go-envconfig v1.1.0
+	github.com/streadway/amqp v1.1.0
 )
@@ -1,8 +1,13 @@
 package configuration
 
+import "time"
+
 type Config struct {
-	PROCESSING_WORKERS_COUNT int        `env:"PROCESSING_WORKERS_COUNT,required"`
-	AMQP                     AMQPConfig `env:",prefix=AMQP_"`
+	PROCESSING_WORKERS_COUNT int               `env:"PROCESSING_WORKERS_COUNT,required"`
+	MAX_REPLY_SIZE           int               `env:"MAX_REPLY_SIZE,default=1048576"`
+	PREFIX_INDEX             bool              `env:"PREFIX_INDEX,default=false"`
+	AMQP                     AMQPConfig        `env:",prefix=AMQP_"`
+	Persistence              PersistenceConfig `env:",prefix=PERSISTENCE_"`
 }
 
 type AMQPConfig struct {
@@ -11,4 +16,21 @@ type AMQPConfig struct {
 	User      string `env:"USER,required"`
 	Pass      string `env:"PASS,required"`
 	QueueName string `env:"QUEUE_NAME,required"`
+
+	ReconnectMinBackoff time.Duration `env:"RECONNECT_MIN_BACKOFF,default=500ms"`
+	ReconnectMaxBackoff time.Duration `env:"RECONNECT_MAX_BACKOFF,default=30s"`
+	PrefetchCount       int           `env:"PREFETCH_COUNT,default=10"`
+	MaxDeliveries       int           `env:"MAX_DELIVERIES,default=3"`
+	DeadLetterExchange  string        `env:"DEAD_LETTER_EXCHANGE,default=scs.dead-letter"`
+	DeadLetterQueue     string        `env:"DEAD_LETTER_QUEUE,default=scs.dead-letter"`
+}
+
+// PersistenceConfig controls the write-ahead log and snapshots. Leaving Dir empty
+// keeps all data in memory. A zero SnapshotInterval disables snapshots.
+type PersistenceConfig struct {
+	Dir               string        `env:"DIR"`
+	FsyncPolicy       string        `env:"FSYNC_POLICY,default=interval"`
+	FsyncInterval     time.Duration `env:"FSYNC_INTERVAL,default=100ms"`
+	SnapshotInterval  time.Duration `env:"SNAPSHOT_INTERVAL,default=5m"`
+	SnapshotRetention int           `env:"SNAPSHOT_RETENTION,default=2"`
 }
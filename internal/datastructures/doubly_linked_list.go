@@ -1,10 +1,20 @@
 package datastructures
 
+import "time"
+
 type Node struct {
 	key   string
 	value interface{}
-	prev  *Node
-	next  *Node
+	// expiresAt is the zero time for items that never expire.
+	expiresAt time.Time
+	// version is the sequence number of the last write to the item.
+	version uint64
+	// inserted is the sequence number of the write that appended the item.
+	inserted uint64
+	// removed is set once the node is no longer part of the list.
+	removed bool
+	prev    *Node
+	next    *Node
 }
 
 type DoublyLinkedList struct {
@@ -0,0 +1,132 @@
+package datastructures
+
+// listMinCapacity is the capacity of the first buffer a list allocates.
+const listMinCapacity = 8
+
+// List is a double-ended queue of strings kept in a ring buffer, with constant
+// time pushes and pops at both ends and indexed access.
+type List struct {
+	items []string
+	head  int
+	size  int
+}
+
+func NewList() *List {
+	return &List{}
+}
+
+func (l *List) Len() int {
+	return l.size
+}
+
+// at returns the buffer position of the i-th item.
+func (l *List) at(i int) int {
+	return (l.head + i) % len(l.items)
+}
+
+// grow makes room for n more items, keeping their order.
+func (l *List) grow(n int) {
+	if l.size+n <= len(l.items) {
+		return
+	}
+	capacity := len(l.items) * 2
+	if capacity < listMinCapacity {
+		capacity = listMinCapacity
+	}
+	for capacity < l.size+n {
+		capacity *= 2
+	}
+	items := make([]string, capacity)
+	for i := 0; i < l.size; i++ {
+		items[i] = l.items[l.at(i)]
+	}
+	l.items, l.head = items, 0
+}
+
+// PushFront inserts the values at the front one after another, so the last one
+// ends up first.
+func (l *List) PushFront(values ...string) {
+	l.grow(len(values))
+	for _, value := range values {
+		l.head = (l.head - 1 + len(l.items)) % len(l.items)
+		l.items[l.head] = value
+		l.size++
+	}
+}
+
+// PushBack appends the values at the back in order.
+func (l *List) PushBack(values ...string) {
+	l.grow(len(values))
+	for _, value := range values {
+		l.items[l.at(l.size)] = value
+		l.size++
+	}
+}
+
+// PopFront removes and returns up to count values from the front, first one first.
+func (l *List) PopFront(count int) []string {
+	if count > l.size {
+		count = l.size
+	}
+	popped := make([]string, count)
+	for i := range popped {
+		popped[i] = l.items[l.head]
+		l.items[l.head] = ""
+		l.head = (l.head + 1) % len(l.items)
+		l.size--
+	}
+	return popped
+}
+
+// PopBack removes and returns up to count values from the back, last one first.
+func (l *List) PopBack(count int) []string {
+	if count > l.size {
+		count = l.size
+	}
+	popped := make([]string, count)
+	for i := range popped {
+		last := l.at(l.size - 1)
+		popped[i] = l.items[last]
+		l.items[last] = ""
+		l.size--
+	}
+	return popped
+}
+
+// Range returns the values from index start to stop, both inclusive. Negative
+// indexes count from the back, -1 being the last value. Indexes beyond either
+// end are clamped, so an empty slice is returned when the range holds no values.
+func (l *List) Range(start int, stop int) []string {
+	start, stop = clampRange(start, stop, l.size)
+	if start > stop {
+		return []string{}
+	}
+	values := make([]string, stop-start+1)
+	for i := range values {
+		values[i] = l.items[l.at(start+i)]
+	}
+	return values
+}
+
+// Values returns all values from front to back.
+func (l *List) Values() []string {
+	return l.Range(0, -1)
+}
+
+// clampRange resolves the negative indexes of a range over size items and clamps
+// them to the items, returning a start past stop when the range holds none.
+func clampRange(start int, stop int, size int) (int, int) {
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	return start, stop
+}
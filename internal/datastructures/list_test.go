@@ -0,0 +1,92 @@
+package datastructures
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	l := NewList()
+
+	if values := l.Values(); !reflect.DeepEqual(values, []string{}) {
+		t.Errorf("expected an empty list, got: %v", values)
+	}
+
+	l.PushBack("c", "d")
+	l.PushFront("b", "a")
+	l.PushBack("e")
+	if values := l.Values(); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("expected values [a b c d e], got: %v", values)
+	}
+	if l.Len() != 5 {
+		t.Errorf("expected length 5, got: %d", l.Len())
+	}
+
+	if popped := l.PopFront(2); !reflect.DeepEqual(popped, []string{"a", "b"}) {
+		t.Errorf("expected to pop [a b] from the front, got: %v", popped)
+	}
+	if popped := l.PopBack(1); !reflect.DeepEqual(popped, []string{"e"}) {
+		t.Errorf("expected to pop [e] from the back, got: %v", popped)
+	}
+	if popped := l.PopBack(5); !reflect.DeepEqual(popped, []string{"d", "c"}) {
+		t.Errorf("expected to pop the remaining [d c], got: %v", popped)
+	}
+	if popped := l.PopFront(1); !reflect.DeepEqual(popped, []string{}) || l.Len() != 0 {
+		t.Errorf("expected nothing to pop from an empty list, got: %v", popped)
+	}
+}
+
+func TestList_Range(t *testing.T) {
+	l := NewList()
+	l.PushBack("a", "b", "c", "d", "e")
+
+	tests := []struct {
+		start, stop int
+		expected    []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e"}},
+		{1, 2, []string{"b", "c"}},
+		{-2, -1, []string{"d", "e"}},
+		{-100, 1, []string{"a", "b"}},
+		{3, 100, []string{"d", "e"}},
+		{3, 1, []string{}},
+		{5, 10, []string{}},
+		{-100, -6, []string{}},
+	}
+
+	for _, tt := range tests {
+		if values := l.Range(tt.start, tt.stop); !reflect.DeepEqual(values, tt.expected) {
+			t.Errorf("expected range %d..%d: %v, got: %v", tt.start, tt.stop, tt.expected, values)
+		}
+	}
+}
+
+func TestList_WrapsAndGrows(t *testing.T) {
+	l := NewList()
+	var expected []string
+
+	// Alternate pushes and pops at both ends so the items wrap around the buffer
+	// while it grows.
+	for i := 0; i < 100; i++ {
+		value := strconv.Itoa(i)
+		if i%2 == 0 {
+			l.PushFront(value)
+			expected = append([]string{value}, expected...)
+		} else {
+			l.PushBack(value)
+			expected = append(expected, value)
+		}
+		if i%3 == 0 {
+			l.PopFront(1)
+			expected = expected[1:]
+		}
+	}
+
+	if values := l.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected values %v, got: %v", expected, values)
+	}
+	if values := l.Range(-3, -1); !reflect.DeepEqual(values, expected[len(expected)-3:]) {
+		t.Errorf("expected last values %v, got: %v", expected[len(expected)-3:], values)
+	}
+}
@@ -1,9 +1,20 @@
 package datastructures
 
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
 type OrderedMap struct {
 	data map[string]*Node
 	list *DoublyLinkedList
 	size int
+	// index holds the nodes in list order, so scans can find where to resume by
+	// insertion sequence number. Removed nodes are dropped from it lazily.
+	index []*Node
+	// keys, once enabled by IndexKeys, holds the keys sorted for prefix lookups.
+	keys *SkipList
 }
 
 func NewOrderedMap() *OrderedMap {
@@ -14,12 +25,21 @@ func NewOrderedMap() *OrderedMap {
 	}
 }
 
-func (om *OrderedMap) Add(key string, value interface{}) {
+// Add sets the value of the key, keeping its position if it already exists.
+// Any expiry set on the key is cleared. A new key is appended and records seq,
+// the sequence number of the insertion, which orders it among other maps' keys.
+func (om *OrderedMap) Add(key string, value interface{}, seq uint64) {
 	if node, exists := om.data[key]; exists {
 		node.value = value
+		node.expiresAt = time.Time{}
 	} else {
 		node := om.list.Append(key, value)
+		node.inserted = seq
 		om.data[key] = node
+		om.index = append(om.index, node)
+		if om.keys != nil {
+			om.keys.Insert(key)
+		}
 		om.size++
 	}
 }
@@ -27,9 +47,33 @@ func (om *OrderedMap) Add(key string, value interface{}) {
 func (om *OrderedMap) Remove(key string) {
 	if node, exists := om.data[key]; exists {
 		om.list.Remove(node)
+		node.removed = true
 		delete(om.data, key)
+		if om.keys != nil {
+			om.keys.Delete(key)
+		}
 		om.size--
+		if len(om.index) > 2*om.size+16 {
+			om.compactIndex()
+		}
+	}
+}
+
+func (om *OrderedMap) Len() int {
+	return om.size
+}
+
+func (om *OrderedMap) compactIndex() {
+	index := om.index[:0]
+	for _, node := range om.index {
+		if !node.removed {
+			index = append(index, node)
+		}
+	}
+	for i := len(index); i < len(om.index); i++ {
+		om.index[i] = nil
 	}
+	om.index = index
 }
 
 func (om *OrderedMap) Get(key string) (interface{}, bool) {
@@ -39,15 +83,119 @@ func (om *OrderedMap) Get(key string) (interface{}, bool) {
 	return nil, false
 }
 
+// SetExpiry sets when the key expires; the zero time removes the expiry.
+// It reports whether the key exists.
+func (om *OrderedMap) SetExpiry(key string, expiresAt time.Time) bool {
+	if node, exists := om.data[key]; exists {
+		node.expiresAt = expiresAt
+		return true
+	}
+	return false
+}
+
+// Expiry returns when the key expires, or the zero time if it never does.
+func (om *OrderedMap) Expiry(key string) (time.Time, bool) {
+	if node, exists := om.data[key]; exists {
+		return node.expiresAt, true
+	}
+	return time.Time{}, false
+}
+
+// SetVersion records the version of the key's current value. It reports whether the key exists.
+func (om *OrderedMap) SetVersion(key string, version uint64) bool {
+	if node, exists := om.data[key]; exists {
+		node.version = version
+		return true
+	}
+	return false
+}
+
+// Version returns the version of the key's current value.
+func (om *OrderedMap) Version(key string) (uint64, bool) {
+	if node, exists := om.data[key]; exists {
+		return node.version, true
+	}
+	return 0, false
+}
+
 func (om *OrderedMap) GetAll() []KeyValue {
 	items := make([]KeyValue, 0, om.size)
 	for node := om.list.head; node != nil; node = node.next {
-		items = append(items, KeyValue{node.key, node.value})
+		items = append(items, KeyValue{node.key, node.value, node.expiresAt, node.version, node.inserted})
+	}
+	return items
+}
+
+// ScanAfter returns up to count items inserted after seq, in order; count must be
+// positive. Items are appended in sequence order, so the scan starts where the
+// previous one ended even if keys were added or removed since. Items sharing the
+// sequence number of the last one are all included, so the next scan can resume
+// after it.
+func (om *OrderedMap) ScanAfter(seq uint64, count int) []KeyValue {
+	start := sort.Search(len(om.index), func(i int) bool {
+		return om.index[i].inserted > seq
+	})
+
+	var items []KeyValue
+	for _, node := range om.index[start:] {
+		if node.removed {
+			continue
+		}
+		if len(items) >= count && node.inserted != items[len(items)-1].Inserted {
+			break
+		}
+		items = append(items, KeyValue{node.key, node.value, node.expiresAt, node.version, node.inserted})
+	}
+	return items
+}
+
+// IndexKeys keeps a sorted index of the keys from now on, so that WithPrefix
+// looks up only the matching keys instead of walking all items.
+func (om *OrderedMap) IndexKeys() {
+	if om.keys != nil {
+		return
+	}
+	om.keys = NewSkipList(func(a, b interface{}) bool {
+		return a.(string) < b.(string)
+	})
+	for key := range om.data {
+		om.keys.Insert(key)
+	}
+}
+
+// WithPrefix returns the items whose key starts with prefix, in insertion order.
+func (om *OrderedMap) WithPrefix(prefix string) []KeyValue {
+	var nodes []*Node
+	if om.keys == nil || prefix == "" {
+		for node := om.list.head; node != nil; node = node.next {
+			if strings.HasPrefix(node.key, prefix) {
+				nodes = append(nodes, node)
+			}
+		}
+	} else {
+		om.keys.Ascend(prefix, func(key interface{}) bool {
+			if !strings.HasPrefix(key.(string), prefix) {
+				return false
+			}
+			nodes = append(nodes, om.data[key.(string)])
+			return true
+		})
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].inserted < nodes[j].inserted
+		})
+	}
+
+	items := make([]KeyValue, len(nodes))
+	for i, node := range nodes {
+		items[i] = KeyValue{node.key, node.value, node.expiresAt, node.version, node.inserted}
 	}
 	return items
 }
 
 type KeyValue struct {
-	Key   string
-	Value interface{}
+	Key       string
+	Value     interface{}
+	ExpiresAt time.Time `json:"-"`
+	Version   uint64    `json:"-"`
+	Inserted  uint64    `json:"-"`
 }
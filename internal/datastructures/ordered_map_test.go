@@ -0,0 +1,43 @@
+package datastructures
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderedMap_WithPrefix(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		om := NewOrderedMap()
+		if indexed {
+			om.IndexKeys()
+		}
+		keys := []string{"user:2", "tmp:1", "user:10", "user", "users:1", "user:1"}
+		for i, key := range keys {
+			om.Add(key, "v", uint64(i+1))
+		}
+		om.Remove("user:10")
+		om.Add("user:10", "again", 7)
+
+		tests := []struct {
+			prefix       string
+			expectedKeys []string
+		}{
+			{"user:", []string{"user:2", "user:1", "user:10"}},
+			{"user", []string{"user:2", "user", "users:1", "user:1", "user:10"}},
+			{"tmp:", []string{"tmp:1"}},
+			{"none", []string{}},
+			{"", []string{"user:2", "tmp:1", "user", "users:1", "user:1", "user:10"}},
+		}
+
+		for _, tt := range tests {
+			items := om.WithPrefix(tt.prefix)
+			keys := []string{}
+			for _, item := range items {
+				keys = append(keys, item.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.expectedKeys) {
+				t.Errorf("indexed=%v: expected keys with prefix %q: %v, got: %v", indexed, tt.prefix, tt.expectedKeys, keys)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package datastructures
+
+import "strconv"
+
+// Partitioner assigns keys to a fixed set of workers, numbered from 0, using consistent hashing.
+type Partitioner struct {
+	workers int
+	hash    *ConsistentHash
+}
+
+func NewPartitioner(workers int) *Partitioner {
+	hash := NewConsistentHash(workers, nil)
+	for i := 0; i < workers; i++ {
+		hash.Add(strconv.Itoa(i))
+	}
+	return &Partitioner{
+		workers: workers,
+		hash:    hash,
+	}
+}
+
+func (p *Partitioner) Workers() int {
+	return p.workers
+}
+
+// WorkerFor returns the index of the worker owning the key.
+func (p *Partitioner) WorkerFor(key string) int {
+	worker, _ := strconv.Atoi(p.hash.Get(key))
+	return worker
+}
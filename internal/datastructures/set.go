@@ -0,0 +1,55 @@
+package datastructures
+
+import "sort"
+
+// Set is an unordered set of strings.
+type Set struct {
+	members map[string]struct{}
+}
+
+func NewSet() *Set {
+	return &Set{members: make(map[string]struct{})}
+}
+
+func (s *Set) Len() int {
+	return len(s.members)
+}
+
+// Add adds the members and returns how many of them were not present yet.
+func (s *Set) Add(members ...string) int {
+	added := 0
+	for _, member := range members {
+		if _, exists := s.members[member]; !exists {
+			s.members[member] = struct{}{}
+			added++
+		}
+	}
+	return added
+}
+
+// Remove removes the members and returns how many of them were present.
+func (s *Set) Remove(members ...string) int {
+	removed := 0
+	for _, member := range members {
+		if _, exists := s.members[member]; exists {
+			delete(s.members, member)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *Set) Contains(member string) bool {
+	_, exists := s.members[member]
+	return exists
+}
+
+// Members returns the members in sorted order.
+func (s *Set) Members() []string {
+	members := make([]string, 0, len(s.members))
+	for member := range s.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,34 @@
+package datastructures
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	s := NewSet()
+
+	if added := s.Add("b", "a", "b", "c"); added != 3 {
+		t.Errorf("expected 3 members added, got: %d", added)
+	}
+	if added := s.Add("a", "d"); added != 1 {
+		t.Errorf("expected 1 member added, got: %d", added)
+	}
+	if s.Len() != 4 {
+		t.Errorf("expected length 4, got: %d", s.Len())
+	}
+	if members := s.Members(); !reflect.DeepEqual(members, []string{"a", "b", "c", "d"}) {
+		t.Errorf("expected sorted members, got: %v", members)
+	}
+
+	if removed := s.Remove("a", "x", "a"); removed != 1 {
+		t.Errorf("expected 1 member removed, got: %d", removed)
+	}
+	if s.Contains("a") || !s.Contains("b") {
+		t.Errorf("expected b but not a to be a member")
+	}
+	s.Remove("b", "c", "d")
+	if members := s.Members(); !reflect.DeepEqual(members, []string{}) || s.Len() != 0 {
+		t.Errorf("expected an empty set, got: %v", members)
+	}
+}
@@ -0,0 +1,124 @@
+package datastructures
+
+import "time"
+
+// ShardedMap splits the keys over one OrderedMap per worker, as assigned by the
+// partitioner, so that workers do not share any state. Operations on a key only
+// touch the shard owning it, so each shard may be used by its own goroutine.
+// GetAll reads every shard and must not run concurrently with writes.
+type ShardedMap struct {
+	partitioner *Partitioner
+	shards      []*OrderedMap
+}
+
+func NewShardedMap(partitioner *Partitioner) *ShardedMap {
+	shards := make([]*OrderedMap, partitioner.Workers())
+	for i := range shards {
+		shards[i] = NewOrderedMap()
+	}
+	return &ShardedMap{
+		partitioner: partitioner,
+		shards:      shards,
+	}
+}
+
+func (sm *ShardedMap) shard(key string) *OrderedMap {
+	return sm.shards[sm.partitioner.WorkerFor(key)]
+}
+
+func (sm *ShardedMap) Add(key string, value interface{}, seq uint64) {
+	sm.shard(key).Add(key, value, seq)
+}
+
+func (sm *ShardedMap) Remove(key string) {
+	sm.shard(key).Remove(key)
+}
+
+func (sm *ShardedMap) Get(key string) (interface{}, bool) {
+	return sm.shard(key).Get(key)
+}
+
+func (sm *ShardedMap) SetExpiry(key string, expiresAt time.Time) bool {
+	return sm.shard(key).SetExpiry(key, expiresAt)
+}
+
+func (sm *ShardedMap) Expiry(key string) (time.Time, bool) {
+	return sm.shard(key).Expiry(key)
+}
+
+func (sm *ShardedMap) SetVersion(key string, version uint64) bool {
+	return sm.shard(key).SetVersion(key, version)
+}
+
+func (sm *ShardedMap) Version(key string) (uint64, bool) {
+	return sm.shard(key).Version(key)
+}
+
+// GetAll merges the shards back into insertion order.
+func (sm *ShardedMap) GetAll() []KeyValue {
+	parts := make([][]KeyValue, len(sm.shards))
+	for i, shard := range sm.shards {
+		parts[i] = shard.GetAll()
+	}
+	return merge(parts)
+}
+
+// ScanAfter returns up to count items inserted after seq in insertion order, like
+// OrderedMap.ScanAfter does for one shard.
+func (sm *ShardedMap) ScanAfter(seq uint64, count int) []KeyValue {
+	parts := make([][]KeyValue, len(sm.shards))
+	for i, shard := range sm.shards {
+		parts[i] = shard.ScanAfter(seq, count)
+	}
+	items := merge(parts)
+
+	// A shard returns a whole group of items sharing a sequence number, so the
+	// merged items contain every item of the group the page ends with.
+	end := len(items)
+	if end > count {
+		end = count
+		for end < len(items) && items[end].Inserted == items[end-1].Inserted {
+			end++
+		}
+	}
+	return items[:end]
+}
+
+// IndexKeys keeps a sorted index of the keys of every shard, as OrderedMap.IndexKeys does.
+func (sm *ShardedMap) IndexKeys() {
+	for _, shard := range sm.shards {
+		shard.IndexKeys()
+	}
+}
+
+// WithPrefix returns the items whose key starts with prefix, in insertion order.
+func (sm *ShardedMap) WithPrefix(prefix string) []KeyValue {
+	parts := make([][]KeyValue, len(sm.shards))
+	for i, shard := range sm.shards {
+		parts[i] = shard.WithPrefix(prefix)
+	}
+	return merge(parts)
+}
+
+// merge merges items of shards, each ordered by insertion sequence number, by
+// repeatedly taking the smallest head. Keys inserted at the same sequence number,
+// by one transaction, are taken in shard order.
+func merge(heads [][]KeyValue) []KeyValue {
+	size := 0
+	for _, head := range heads {
+		size += len(head)
+	}
+
+	items := make([]KeyValue, 0, size)
+	for len(items) < size {
+		next := -1
+		for i, head := range heads {
+			if len(head) > 0 && (next < 0 || head[0].Inserted < heads[next][0].Inserted) {
+				next = i
+			}
+		}
+		items = append(items, heads[next][0])
+		heads[next] = heads[next][1:]
+	}
+	return items
+}
@@ -0,0 +1,167 @@
+package datastructures
+
+import "math/rand"
+
+const (
+	skipListMaxLevel = 32
+	// skipListP is the chance of a node reaching each next level.
+	skipListP = 0.25
+)
+
+type skipNode struct {
+	value interface{}
+	next  []*skipNode
+	// span holds, for every level, how many values the link to the next node
+	// skips over, counting the next node itself.
+	span []int
+}
+
+// SkipList is a sorted set of values ordered by less, with logarithmic lookups,
+// inserts, deletes and lookups by rank on average. Values for which neither is
+// less than the other are considered equal.
+type SkipList struct {
+	less  func(a, b interface{}) bool
+	head  *skipNode
+	level int
+	size  int
+	rand  *rand.Rand
+}
+
+func NewSkipList(less func(a, b interface{}) bool) *SkipList {
+	return &SkipList{
+		less:  less,
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel), span: make([]int, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+func (sl *SkipList) Len() int {
+	return sl.size
+}
+
+// predecessors returns, for every level, the last node before value and its
+// rank, the head having rank 0 and the first value rank 1.
+func (sl *SkipList) predecessors(value interface{}) ([skipListMaxLevel]*skipNode, [skipListMaxLevel]int) {
+	var update [skipListMaxLevel]*skipNode
+	var rank [skipListMaxLevel]int
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		if level < sl.level-1 {
+			rank[level] = rank[level+1]
+		}
+		for node.next[level] != nil && sl.less(node.next[level].value, value) {
+			rank[level] += node.span[level]
+			node = node.next[level]
+		}
+		update[level] = node
+	}
+	return update, rank
+}
+
+func (sl *SkipList) equal(node *skipNode, value interface{}) bool {
+	return node != nil && !sl.less(value, node.value)
+}
+
+// Insert adds the value, reporting false if an equal value is already present.
+func (sl *SkipList) Insert(value interface{}) bool {
+	update, rank := sl.predecessors(value)
+	if sl.equal(update[0].next[0], value) {
+		return false
+	}
+
+	level := 1
+	for level < skipListMaxLevel && sl.rand.Float64() < skipListP {
+		level++
+	}
+	for ; sl.level < level; sl.level++ {
+		update[sl.level], rank[sl.level] = sl.head, 0
+		sl.head.span[sl.level] = sl.size
+	}
+
+	node := &skipNode{value: value, next: make([]*skipNode, level), span: make([]int, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+		// The new node sits rank[0]-rank[i]+1 values after its predecessor.
+		node.span[i] = update[i].span[i] - (rank[0] - rank[i])
+		update[i].span[i] = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].span[i]++
+	}
+	sl.size++
+	return true
+}
+
+// Delete removes the value, reporting whether it was present.
+func (sl *SkipList) Delete(value interface{}) bool {
+	update, _ := sl.predecessors(value)
+	node := update[0].next[0]
+	if !sl.equal(node, value) {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].next[i] == node {
+			update[i].span[i] += node.span[i] - 1
+			update[i].next[i] = node.next[i]
+		} else {
+			update[i].span[i]--
+		}
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.size--
+	return true
+}
+
+func (sl *SkipList) Contains(value interface{}) bool {
+	update, _ := sl.predecessors(value)
+	return sl.equal(update[0].next[0], value)
+}
+
+// Rank returns the index of the value in order, 0 being the first, or -1 if the
+// value is not present.
+func (sl *SkipList) Rank(value interface{}) int {
+	update, rank := sl.predecessors(value)
+	if !sl.equal(update[0].next[0], value) {
+		return -1
+	}
+	return rank[0]
+}
+
+// Range returns the values from index start to stop, both inclusive, with
+// negative indexes and clamping as in List.Range.
+func (sl *SkipList) Range(start int, stop int) []interface{} {
+	start, stop = clampRange(start, stop, sl.size)
+	if start > stop {
+		return []interface{}{}
+	}
+
+	// Find the node at rank start+1, skipping whole spans where possible.
+	node, traversed := sl.head, 0
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && traversed+node.span[level] <= start+1 {
+			traversed += node.span[level]
+			node = node.next[level]
+		}
+	}
+
+	values := make([]interface{}, 0, stop-start+1)
+	for ; node != nil && len(values) < cap(values); node = node.next[0] {
+		values = append(values, node.value)
+	}
+	return values
+}
+
+// Ascend calls fn for the values not less than from, in order, until fn returns false.
+func (sl *SkipList) Ascend(from interface{}, fn func(value interface{}) bool) {
+	update, _ := sl.predecessors(from)
+	for node := update[0].next[0]; node != nil; node = node.next[0] {
+		if !fn(node.value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package datastructures
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func lessString(a, b interface{}) bool {
+	return a.(string) < b.(string)
+}
+
+func collect(sl *SkipList, from string) []string {
+	values := []string{}
+	sl.Ascend(from, func(value interface{}) bool {
+		values = append(values, value.(string))
+		return true
+	})
+	return values
+}
+
+func TestSkipList(t *testing.T) {
+	sl := NewSkipList(lessString)
+
+	for _, value := range []string{"c", "a", "d", "b"} {
+		if !sl.Insert(value) {
+			t.Errorf("expected %s to be inserted", value)
+		}
+	}
+	if sl.Insert("b") {
+		t.Errorf("expected duplicate b not to be inserted")
+	}
+	if sl.Len() != 4 {
+		t.Errorf("expected length 4, got: %d", sl.Len())
+	}
+	if values := collect(sl, ""); !reflect.DeepEqual(values, []string{"a", "b", "c", "d"}) {
+		t.Errorf("expected sorted values, got: %v", values)
+	}
+	if values := collect(sl, "bb"); !reflect.DeepEqual(values, []string{"c", "d"}) {
+		t.Errorf("expected values from bb, got: %v", values)
+	}
+
+	if !sl.Delete("b") || sl.Delete("b") {
+		t.Errorf("expected b to be deleted once")
+	}
+	if sl.Contains("b") || !sl.Contains("c") {
+		t.Errorf("expected c but not b to be present")
+	}
+	if values := collect(sl, ""); !reflect.DeepEqual(values, []string{"a", "c", "d"}) {
+		t.Errorf("expected remaining values, got: %v", values)
+	}
+}
+
+func TestSkipList_MatchesSortedSet(t *testing.T) {
+	sl := NewSkipList(lessString)
+	present := make(map[string]bool)
+	random := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 5000; i++ {
+		value := string(rune('a' + random.Intn(26)))
+		value += string(rune('a' + random.Intn(26)))
+		if random.Intn(3) == 0 {
+			if sl.Delete(value) != present[value] {
+				t.Fatalf("expected Delete(%s) to report %v", value, present[value])
+			}
+			delete(present, value)
+		} else {
+			if sl.Insert(value) == present[value] {
+				t.Fatalf("expected Insert(%s) to report %v", value, !present[value])
+			}
+			present[value] = true
+		}
+	}
+
+	expected := make([]string, 0, len(present))
+	for value := range present {
+		expected = append(expected, value)
+	}
+	sort.Strings(expected)
+	if values := collect(sl, ""); !reflect.DeepEqual(values, expected) || sl.Len() != len(expected) {
+		t.Errorf("expected %d sorted values, got %d: %v", len(expected), sl.Len(), values)
+	}
+	for i, value := range expected {
+		if rank := sl.Rank(value); rank != i {
+			t.Fatalf("expected rank %d of %s, got: %d", i, value, rank)
+		}
+		if values := sl.Range(i, i); len(values) != 1 || values[0] != value {
+			t.Fatalf("expected %s at index %d, got: %v", value, i, values)
+		}
+	}
+}
+
+func TestSkipList_RankAndRange(t *testing.T) {
+	sl := NewSkipList(lessString)
+	for _, value := range []string{"d", "b", "e", "a", "c"} {
+		sl.Insert(value)
+	}
+	sl.Delete("c")
+
+	ranks := map[string]int{"a": 0, "b": 1, "d": 2, "e": 3, "c": -1, "z": -1}
+	for value, expected := range ranks {
+		if rank := sl.Rank(value); rank != expected {
+			t.Errorf("expected rank %d of %s, got: %d", expected, value, rank)
+		}
+	}
+
+	tests := []struct {
+		start, stop int
+		expected    []interface{}
+	}{
+		{0, -1, []interface{}{"a", "b", "d", "e"}},
+		{1, 2, []interface{}{"b", "d"}},
+		{-2, 100, []interface{}{"d", "e"}},
+		{3, 1, []interface{}{}},
+		{4, 10, []interface{}{}},
+	}
+	for _, tt := range tests {
+		if values := sl.Range(tt.start, tt.stop); !reflect.DeepEqual(values, tt.expected) {
+			t.Errorf("expected range %d..%d: %v, got: %v", tt.start, tt.stop, tt.expected, values)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package datastructures
+
+// ScoredMember is a member of a sorted set and its score.
+type ScoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SortedSet is a set of strings ordered by score, and members with equal scores
+// by member. It finds the score of a member in constant time, and ranks and
+// ranges in logarithmic time on average.
+type SortedSet struct {
+	scores map[string]float64
+	order  *SkipList
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		scores: make(map[string]float64),
+		order: NewSkipList(func(a, b interface{}) bool {
+			x, y := a.(ScoredMember), b.(ScoredMember)
+			if x.Score != y.Score {
+				return x.Score < y.Score
+			}
+			return x.Member < y.Member
+		}),
+	}
+}
+
+func (s *SortedSet) Len() int {
+	return len(s.scores)
+}
+
+// Add sets the score of the member, reporting whether it was not present yet.
+func (s *SortedSet) Add(member string, score float64) bool {
+	current, exists := s.scores[member]
+	if exists {
+		if current == score {
+			return false
+		}
+		s.order.Delete(ScoredMember{member, current})
+	}
+	s.scores[member] = score
+	s.order.Insert(ScoredMember{member, score})
+	return !exists
+}
+
+// Remove removes the member, reporting whether it was present.
+func (s *SortedSet) Remove(member string) bool {
+	score, exists := s.scores[member]
+	if !exists {
+		return false
+	}
+	delete(s.scores, member)
+	s.order.Delete(ScoredMember{member, score})
+	return true
+}
+
+func (s *SortedSet) Score(member string) (float64, bool) {
+	score, exists := s.scores[member]
+	return score, exists
+}
+
+// Rank returns the index of the member in order, 0 being the lowest score.
+func (s *SortedSet) Rank(member string) (int, bool) {
+	score, exists := s.scores[member]
+	if !exists {
+		return 0, false
+	}
+	return s.order.Rank(ScoredMember{member, score}), true
+}
+
+// Range returns the members from index start to stop in order, both inclusive,
+// with negative indexes and clamping as in List.Range.
+func (s *SortedSet) Range(start int, stop int) []ScoredMember {
+	values := s.order.Range(start, stop)
+	members := make([]ScoredMember, len(values))
+	for i, value := range values {
+		members[i] = value.(ScoredMember)
+	}
+	return members
+}
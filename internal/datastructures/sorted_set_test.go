@@ -0,0 +1,52 @@
+package datastructures
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortedSet(t *testing.T) {
+	s := NewSortedSet()
+
+	for _, m := range []ScoredMember{{"carol", 30}, {"alice", 10}, {"bob", 20}, {"dave", 20}} {
+		if !s.Add(m.Member, m.Score) {
+			t.Errorf("expected %s to be added", m.Member)
+		}
+	}
+	// Updating a score moves the member.
+	if s.Add("alice", 25) {
+		t.Errorf("expected alice to be updated, not added")
+	}
+	if s.Len() != 4 {
+		t.Errorf("expected length 4, got: %d", s.Len())
+	}
+
+	expected := []ScoredMember{{"bob", 20}, {"dave", 20}, {"alice", 25}, {"carol", 30}}
+	if members := s.Range(0, -1); !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected members by score: %v, got: %v", expected, members)
+	}
+	if members := s.Range(-2, -1); !reflect.DeepEqual(members, expected[2:]) {
+		t.Errorf("expected the top members: %v, got: %v", expected[2:], members)
+	}
+	for i, m := range expected {
+		if rank, ok := s.Rank(m.Member); !ok || rank != i {
+			t.Errorf("expected rank %d of %s, got: %d, %v", i, m.Member, rank, ok)
+		}
+	}
+	if score, ok := s.Score("alice"); !ok || score != 25 {
+		t.Errorf("expected score 25 of alice, got: %v, %v", score, ok)
+	}
+
+	if !s.Remove("dave") || s.Remove("dave") {
+		t.Errorf("expected dave to be removed once")
+	}
+	if _, ok := s.Rank("dave"); ok {
+		t.Errorf("expected dave to have no rank")
+	}
+	if rank, _ := s.Rank("carol"); rank != 2 {
+		t.Errorf("expected rank 2 of carol, got: %d", rank)
+	}
+	if members := s.Range(5, 10); !reflect.DeepEqual(members, []ScoredMember{}) {
+		t.Errorf("expected no members past the end, got: %v", members)
+	}
+}
@@ -2,7 +2,13 @@ package commandsparser
 
 import (
 	"errors"
-	"regexp"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avalkov/SCS/internal/domain/jsonpath"
+	"github.com/avalkov/SCS/internal/domain/values"
 )
 
 type CommandType int
@@ -12,47 +18,766 @@ const (
 	DeleteItem
 	GetItem
 	GetAllItems
+	Expire
+	TTL
+	IncrItem
+	DecrItem
+	CasItem
+	Transaction
+	GetItems
+	AddItems
+	Scan
+	GetItemsByPrefix
+	CountItems
+	DeleteItems
+	Subscribe
+	Unsubscribe
+	Publish
+	LPush
+	RPush
+	LPop
+	RPop
+	LRange
+	LLen
+	HSet
+	HGet
+	HDel
+	HGetAll
+	HIncr
+	SAdd
+	SRem
+	SIsMember
+	SMembers
+	SCard
+	ZAdd
+	ZRange
+	ZRank
+	ZRem
+	JSONSet
+	JSONGet
+	JSONDel
 )
 
 type Command struct {
 	Type  CommandType
 	Key   string
 	Value string
+	// Values are the values pushed by lpush and rpush, in the order given.
+	Values []string
+	// Field is the hash field of hset, hget and hincr, Fields those removed by hdel.
+	Field  string
+	Fields []string
+	// Member is the member of sismember, zadd and zrank, Members those added by
+	// sadd or removed by srem and zrem. Score is the score zadd sets.
+	Member  string
+	Members []string
+	Score   float64
+	// Path is the JSONPath of jsonSet, jsonGet and jsonDel, empty for the root.
+	Path string
+	// TTL is how long the item lives; zero means it does not expire.
+	TTL time.Duration
+	// Delta is the amount added by incrItem and hincr or subtracted by decrItem.
+	Delta int64
+	// Version is the version the item must have for the command to apply,
+	// checked only when CheckVersion is set.
+	Version      uint64
+	CheckVersion bool
+	// Commands are the commands of a transaction, or the per-key commands of a
+	// multi-key command, in the order they are applied.
+	Commands []Command
+	// Cursor is where a scan resumes, 0 for the first page.
+	Cursor uint64
+	// Count is how many items a scan examines, or how many values lpop and rpop
+	// pop; 0 pops a single value.
+	Count int
+	// Start and Stop are the inclusive indexes of lrange and zrange, negative ones
+	// counting from the end of the list or sorted set.
+	Start int
+	Stop  int
+	// Match is a glob pattern keys must match, empty to match all keys.
+	// getItemsByPrefix is parsed to the pattern matching its prefix. For subscribe
+	// and unsubscribe it is the pattern of a key subscription.
+	Match string
+	// Channel is the pub/sub channel of publish, subscribe and unsubscribe, or the
+	// glob pattern of channels when ChannelPattern is set. unsubscribe without
+	// Match and Channel removes all subscriptions.
+	Channel        string
+	ChannelPattern bool
+	// Offset and Limit select a page of getAllItems; a zero Limit means no limit.
+	Offset int
+	Limit  int
+}
+
+// param describes one argument of a command. Arguments can be passed positionally,
+// in the order params are declared, or by name.
+type param struct {
+	name     string
+	optional bool
+	// alternative params of a command exclude each other: at most one of them can
+	// be given, and one must be unless they are optional.
+	alternative bool
+	// A variadic param is the last one and takes all remaining positional arguments.
+	variadic bool
+	set      func(cmd *Command, v value) error
+}
+
+// maxParams bounds the number of parameters a command can declare.
+const maxParams = 8
+
+type commandSpec struct {
+	name    string
+	cmdType CommandType
+	params  []param
+}
+
+var commandSpecs = []commandSpec{
+	{"addItem", AddItem, []param{
+		{name: "key", set: setKey},
+		{name: "value", set: setValue},
+		{name: "ttl", optional: true, set: setTTL},
+	}},
+	{"deleteItem", DeleteItem, []param{
+		{name: "key", set: setKey},
+		{name: "ifVersion", optional: true, set: setVersion},
+	}},
+	{"getItem", GetItem, []param{
+		{name: "key", set: setKey},
+	}},
+	{"getAllItems", GetAllItems, []param{
+		{name: "offset", optional: true, set: setOffset},
+		{name: "limit", optional: true, set: setLimit},
+	}},
+	{"expire", Expire, []param{
+		{name: "key", set: setKey},
+		{name: "ttl", set: setTTL},
+	}},
+	{"ttl", TTL, []param{
+		{name: "key", set: setKey},
+	}},
+	{"incrItem", IncrItem, []param{
+		{name: "key", set: setKey},
+		{name: "delta", set: setDelta},
+	}},
+	{"decrItem", DecrItem, []param{
+		{name: "key", set: setKey},
+		{name: "delta", set: setDelta},
+	}},
+	{"casItem", CasItem, []param{
+		{name: "key", set: setKey},
+		{name: "expectedVersion", set: setVersion},
+		{name: "value", set: setValue},
+	}},
+	// The arguments of a transaction are commands, bound by bindTransaction.
+	{"transaction", Transaction, nil},
+	// Multi-key commands take any number of keys or key-value pairs, bound by bindMultiKey.
+	{"getItems", GetItems, nil},
+	{"addItems", AddItems, nil},
+	{"scan", Scan, []param{
+		{name: "cursor", set: setCursor},
+		{name: "count", set: setCount},
+		{name: "match", optional: true, set: setMatch},
+	}},
+	{"getItemsByPrefix", GetItemsByPrefix, []param{
+		{name: "prefix", set: setPrefix},
+	}},
+	{"countItems", CountItems, []param{
+		{name: "match", set: setMatch},
+	}},
+	{"deleteItems", DeleteItems, []param{
+		{name: "match", set: setMatch},
+	}},
+	{"subscribe", Subscribe, []param{
+		{name: "keys", alternative: true, set: setMatch},
+		{name: "channel", alternative: true, set: setChannel},
+		{name: "pattern", alternative: true, set: setChannelPattern},
+	}},
+	{"unsubscribe", Unsubscribe, []param{
+		{name: "keys", optional: true, alternative: true, set: setMatch},
+		{name: "channel", optional: true, alternative: true, set: setChannel},
+		{name: "pattern", optional: true, alternative: true, set: setChannelPattern},
+	}},
+	{"publish", Publish, []param{
+		{name: "channel", set: setChannel},
+		{name: "message", set: setValue},
+	}},
+	{"lpush", LPush, []param{
+		{name: "key", set: setKey},
+		{name: "values", variadic: true, set: addValue},
+	}},
+	{"rpush", RPush, []param{
+		{name: "key", set: setKey},
+		{name: "values", variadic: true, set: addValue},
+	}},
+	{"lpop", LPop, []param{
+		{name: "key", set: setKey},
+		{name: "count", optional: true, set: setCount},
+	}},
+	{"rpop", RPop, []param{
+		{name: "key", set: setKey},
+		{name: "count", optional: true, set: setCount},
+	}},
+	{"lrange", LRange, []param{
+		{name: "key", set: setKey},
+		{name: "start", set: setStart},
+		{name: "stop", set: setStop},
+	}},
+	{"llen", LLen, []param{
+		{name: "key", set: setKey},
+	}},
+	{"hset", HSet, []param{
+		{name: "key", set: setKey},
+		{name: "field", set: setField},
+		{name: "value", set: setValue},
+	}},
+	{"hget", HGet, []param{
+		{name: "key", set: setKey},
+		{name: "field", set: setField},
+	}},
+	{"hdel", HDel, []param{
+		{name: "key", set: setKey},
+		{name: "fields", variadic: true, set: addField},
+	}},
+	{"hgetall", HGetAll, []param{
+		{name: "key", set: setKey},
+	}},
+	{"hincr", HIncr, []param{
+		{name: "key", set: setKey},
+		{name: "field", set: setField},
+		{name: "delta", set: setDelta},
+	}},
+	{"sadd", SAdd, []param{
+		{name: "key", set: setKey},
+		{name: "members", variadic: true, set: addMember},
+	}},
+	{"srem", SRem, []param{
+		{name: "key", set: setKey},
+		{name: "members", variadic: true, set: addMember},
+	}},
+	{"sismember", SIsMember, []param{
+		{name: "key", set: setKey},
+		{name: "member", set: setMember},
+	}},
+	{"smembers", SMembers, []param{
+		{name: "key", set: setKey},
+	}},
+	{"scard", SCard, []param{
+		{name: "key", set: setKey},
+	}},
+	{"zadd", ZAdd, []param{
+		{name: "key", set: setKey},
+		{name: "score", set: setScore},
+		{name: "member", set: setMember},
+	}},
+	{"zrange", ZRange, []param{
+		{name: "key", set: setKey},
+		{name: "start", set: setStart},
+		{name: "stop", set: setStop},
+	}},
+	{"zrank", ZRank, []param{
+		{name: "key", set: setKey},
+		{name: "member", set: setMember},
+	}},
+	{"zrem", ZRem, []param{
+		{name: "key", set: setKey},
+		{name: "members", variadic: true, set: addMember},
+	}},
+	{"jsonSet", JSONSet, []param{
+		{name: "key", set: setKey},
+		{name: "path", set: setPath},
+		{name: "value", set: setJSON},
+	}},
+	{"jsonGet", JSONGet, []param{
+		{name: "key", set: setKey},
+		{name: "path", optional: true, set: setPath},
+	}},
+	{"jsonDel", JSONDel, []param{
+		{name: "key", set: setKey},
+		{name: "path", optional: true, set: setPath},
+	}},
+}
+
+// transactional lists the commands that can be part of a transaction.
+var transactional = map[CommandType]bool{
+	AddItem:    true,
+	DeleteItem: true,
+	GetItem:    true,
+	Expire:     true,
+	TTL:        true,
+	IncrItem:   true,
+	DecrItem:   true,
+	CasItem:    true,
+}
+
+var (
+	specsByName = map[string]*commandSpec{}
+	specsByType = map[CommandType]*commandSpec{}
+)
+
+func init() {
+	for i := range commandSpecs {
+		spec := &commandSpecs[i]
+		if len(spec.params) > maxParams {
+			panic("too many parameters for " + spec.name)
+		}
+		specsByName[spec.name] = spec
+		specsByType[spec.cmdType] = spec
+	}
+}
+
+// String returns the command name as it is written in the command language.
+func (ct CommandType) String() string {
+	if spec, ok := specsByType[ct]; ok {
+		return spec.name
+	}
+	return "unknown"
+}
+
+func setKey(cmd *Command, v value) error {
+	key, err := scalarText(v)
+	cmd.Key = key
+	return err
+}
+
+func setValue(cmd *Command, v value) error {
+	val, err := scalarText(v)
+	cmd.Value = val
+	return err
+}
+
+func addValue(cmd *Command, v value) error {
+	val, err := scalarText(v)
+	cmd.Values = append(cmd.Values, val)
+	return err
+}
+
+func setField(cmd *Command, v value) error {
+	field, err := scalarText(v)
+	cmd.Field = field
+	return err
+}
+
+func addField(cmd *Command, v value) error {
+	field, err := scalarText(v)
+	cmd.Fields = append(cmd.Fields, field)
+	return err
+}
+
+func setMember(cmd *Command, v value) error {
+	member, err := scalarText(v)
+	cmd.Member = member
+	return err
+}
+
+func addMember(cmd *Command, v value) error {
+	member, err := scalarText(v)
+	cmd.Members = append(cmd.Members, member)
+	return err
+}
+
+func setScore(cmd *Command, v value) error {
+	if v.kind != numberValue {
+		return fmt.Errorf("score")
+	}
+	score, err := values.ParseScore(v.text)
+	if err != nil {
+		return fmt.Errorf("score")
+	}
+	cmd.Score = score
+	return nil
+}
+
+func setPath(cmd *Command, v value) error {
+	if v.kind != stringValue {
+		return fmt.Errorf("JSON path")
+	}
+	if _, err := jsonpath.Parse(v.text); err != nil {
+		return fmt.Errorf("JSON path")
+	}
+	cmd.Path = v.text
+	return nil
+}
+
+// setJSON accepts a string holding a single well-formed JSON value.
+func setJSON(cmd *Command, v value) error {
+	if v.kind != stringValue {
+		return fmt.Errorf("JSON value in a string")
+	}
+	if _, err := values.ParseJSON(v.text); err != nil {
+		return fmt.Errorf("well-formed JSON value")
+	}
+	cmd.Value = v.text
+	return nil
+}
+
+// setTTL accepts a duration string such as '30s' or '10m', or a number of seconds.
+func setTTL(cmd *Command, v value) error {
+	var ttl time.Duration
+	switch v.kind {
+	case stringValue:
+		d, err := time.ParseDuration(v.text)
+		if err != nil {
+			return fmt.Errorf("duration")
+		}
+		ttl = d
+	case numberValue:
+		seconds, err := strconv.ParseFloat(v.text, 64)
+		if err != nil {
+			return fmt.Errorf("duration")
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	default:
+		return fmt.Errorf("duration")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("positive duration")
+	}
+	cmd.TTL = ttl
+	return nil
+}
+
+func setDelta(cmd *Command, v value) error {
+	if v.kind != numberValue {
+		return fmt.Errorf("integer")
+	}
+	delta, err := strconv.ParseInt(v.text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("integer")
+	}
+	cmd.Delta = delta
+	return nil
+}
+
+func setVersion(cmd *Command, v value) error {
+	if v.kind != numberValue {
+		return fmt.Errorf("version number")
+	}
+	version, err := strconv.ParseUint(v.text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("version number")
+	}
+	cmd.Version, cmd.CheckVersion = version, true
+	return nil
+}
+
+func setCursor(cmd *Command, v value) error {
+	if v.kind != numberValue {
+		return fmt.Errorf("cursor number")
+	}
+	cursor, err := strconv.ParseUint(v.text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("cursor number")
+	}
+	cmd.Cursor = cursor
+	return nil
+}
+
+func setCount(cmd *Command, v value) error {
+	count, err := parseCount(v, 1)
+	cmd.Count = count
+	return err
+}
+
+func setMatch(cmd *Command, v value) error {
+	if v.kind != stringValue {
+		return fmt.Errorf("pattern")
+	}
+	cmd.Match = v.text
+	return nil
+}
+
+// setPrefix sets the pattern matching keys that start with the prefix, escaping
+// the characters that are special in patterns.
+func setPrefix(cmd *Command, v value) error {
+	if v.kind != stringValue {
+		return fmt.Errorf("prefix")
+	}
+	var pattern strings.Builder
+	for _, r := range v.text {
+		if r == '*' || r == '?' || r == '\\' {
+			pattern.WriteByte('\\')
+		}
+		pattern.WriteRune(r)
+	}
+	pattern.WriteByte('*')
+	cmd.Match = pattern.String()
+	return nil
+}
+
+func setChannel(cmd *Command, v value) error {
+	if v.kind != stringValue || v.text == "" {
+		return fmt.Errorf("channel name")
+	}
+	cmd.Channel = v.text
+	return nil
+}
+
+func setChannelPattern(cmd *Command, v value) error {
+	if v.kind != stringValue || v.text == "" {
+		return fmt.Errorf("channel pattern")
+	}
+	cmd.Channel, cmd.ChannelPattern = v.text, true
+	return nil
+}
+
+func setStart(cmd *Command, v value) error {
+	index, err := parseIndex(v)
+	cmd.Start = index
+	return err
+}
+
+func setStop(cmd *Command, v value) error {
+	index, err := parseIndex(v)
+	cmd.Stop = index
+	return err
+}
+
+func setOffset(cmd *Command, v value) error {
+	offset, err := parseCount(v, 0)
+	cmd.Offset = offset
+	return err
+}
+
+func setLimit(cmd *Command, v value) error {
+	limit, err := parseCount(v, 1)
+	cmd.Limit = limit
+	return err
+}
+
+// parseCount parses an integer number literal of at least min.
+func parseCount(v value, min int) (int, error) {
+	expected := "non-negative integer"
+	if min > 0 {
+		expected = "positive integer"
+	}
+	if v.kind != numberValue {
+		return 0, errors.New(expected)
+	}
+	n, err := strconv.Atoi(v.text)
+	if err != nil || n < min {
+		return 0, errors.New(expected)
+	}
+	return n, nil
 }
 
-type commandsParser struct {
-	addItemPattern     *regexp.Regexp
-	deleteItemPattern  *regexp.Regexp
-	getItemPattern     *regexp.Regexp
-	getAllItemsPattern *regexp.Regexp
+// parseIndex parses an integer number literal, which may be negative.
+func parseIndex(v value) (int, error) {
+	if v.kind != numberValue {
+		return 0, errors.New("index")
+	}
+	n, err := strconv.Atoi(v.text)
+	if err != nil {
+		return 0, errors.New("index")
+	}
+	return n, nil
+}
+
+// scalarText returns the text of a string or number literal. Numbers are kept
+// exactly as written.
+func scalarText(v value) (string, error) {
+	if v.kind == callValue {
+		return "", fmt.Errorf("string or number")
+	}
+	return v.text, nil
 }
 
+type commandsParser struct{}
+
 // NewCommandsParser creates a new commandsParser
 func NewCommandsParser() *commandsParser {
-	return &commandsParser{
-		addItemPattern:     regexp.MustCompile(`^addItem\(\s*'([^']*)'\s*,\s*'([^']*)'\s*\)$`),
-		deleteItemPattern:  regexp.MustCompile(`^deleteItem\(\s*'([^']*)'\s*\)$`),
-		getItemPattern:     regexp.MustCompile(`^getItem\(\s*'([^']*)'\s*\)$`),
-		getAllItemsPattern: regexp.MustCompile(`^getAllItems\(\)$`),
-	}
+	return &commandsParser{}
 }
 
-// ParseCommand parses the command string and returns the key used for consistent hashing,
+// parseCommand parses the command string and returns the key used for consistent hashing,
 // the parsed Command, and an error if any.
 func (cp *commandsParser) parseCommand(command string) (string, Command, error) {
-	if cp.addItemPattern.MatchString(command) {
-		matches := cp.addItemPattern.FindStringSubmatch(command)
-		return matches[1], Command{Type: AddItem, Key: matches[1], Value: matches[2]}, nil
-	} else if cp.deleteItemPattern.MatchString(command) {
-		matches := cp.deleteItemPattern.FindStringSubmatch(command)
-		return matches[1], Command{Type: DeleteItem, Key: matches[1]}, nil
-	} else if cp.getItemPattern.MatchString(command) {
-		matches := cp.getItemPattern.FindStringSubmatch(command)
-		return matches[1], Command{Type: GetItem, Key: matches[1]}, nil
-	} else if cp.getAllItemsPattern.MatchString(command) {
-		return "", Command{Type: GetAllItems}, nil
+	c, err := parse(command)
+	if err != nil {
+		return "", Command{}, err
+	}
+
+	cmd, err := bind(command, c)
+	if err != nil {
+		return "", Command{}, err
+	}
+	return cmd.Key, cmd, nil
+}
+
+// bind checks the call against its command spec and fills in a Command from its arguments.
+func bind(input string, c *call) (Command, error) {
+	errorAt := func(pos int, expected string, found string) error {
+		return (&lexer{input: input}).errorAt(pos, expected, found)
+	}
+
+	spec, ok := specsByName[c.name]
+	if !ok {
+		return Command{}, errorAt(c.pos, "command name", "unknown command "+c.name)
+	}
+	switch spec.cmdType {
+	case Transaction:
+		return bindTransaction(input, c)
+	case GetItems, AddItems:
+		return bindMultiKey(input, c, spec.cmdType)
+	}
+
+	cmd := Command{Type: spec.cmdType}
+	var assigned [maxParams]bool
+	named := false
+	chosen := -1
+
+	for i, arg := range c.args {
+		idx := i
+		if arg.name != "" {
+			named = true
+			idx = -1
+			for j, p := range spec.params {
+				if p.name == arg.name {
+					idx = j
+					break
+				}
+			}
+			if idx < 0 {
+				return Command{}, errorAt(arg.pos, "argument of "+spec.usage(), "unknown argument "+arg.name)
+			}
+		} else if named {
+			return Command{}, errorAt(arg.pos, "named argument", "positional argument after named ones")
+		} else if last := len(spec.params) - 1; idx > last && last >= 0 && spec.params[last].variadic {
+			idx = last
+		} else if idx >= len(spec.params) {
+			return Command{}, errorAt(arg.pos, "')' after the arguments of "+spec.usage(), "extra argument")
+		}
+
+		if assigned[idx] && !(spec.params[idx].variadic && arg.name == "") {
+			return Command{}, errorAt(arg.pos, "argument of "+spec.usage(), "duplicate argument "+spec.params[idx].name)
+		}
+		assigned[idx] = true
+		if spec.params[idx].alternative {
+			if chosen >= 0 {
+				return Command{}, errorAt(arg.pos, "')' after the argument of "+spec.usage(), "second argument "+spec.params[idx].name)
+			}
+			chosen = idx
+		}
+
+		if err := spec.params[idx].set(&cmd, arg.value); err != nil {
+			return Command{}, errorAt(arg.value.pos, err.Error()+" for "+spec.params[idx].name, describeValue(arg.value))
+		}
+	}
+
+	for i, p := range spec.params {
+		if p.alternative && chosen >= 0 {
+			continue
+		}
+		if !assigned[i] && !p.optional {
+			return Command{}, errorAt(len(input), "argument "+p.name+" of "+spec.usage(), "missing argument")
+		}
+	}
+
+	return cmd, nil
+}
+
+// bindTransaction binds transaction(command, ...). Every argument must be a
+// positional call of a transactional command.
+func bindTransaction(input string, c *call) (Command, error) {
+	errorAt := func(pos int, expected string, found string) error {
+		return (&lexer{input: input}).errorAt(pos, expected, found)
+	}
+
+	cmd := Command{Type: Transaction, Commands: make([]Command, 0, len(c.args))}
+	for _, arg := range c.args {
+		if arg.name != "" {
+			return Command{}, errorAt(arg.pos, "command", "named argument "+arg.name)
+		}
+		if arg.value.kind != callValue {
+			return Command{}, errorAt(arg.value.pos, "command", describeValue(arg.value))
+		}
+		sub, err := bind(input, arg.value.call)
+		if err != nil {
+			return Command{}, err
+		}
+		if !transactional[sub.Type] {
+			return Command{}, errorAt(arg.value.pos, "command allowed in a transaction", "command "+arg.value.call.name)
+		}
+		cmd.Commands = append(cmd.Commands, sub)
+	}
+	if len(cmd.Commands) == 0 {
+		return Command{}, errorAt(len(input), "command in transaction", "empty transaction")
+	}
+	return cmd, nil
+}
+
+// bindMultiKey binds getItems(key, ...) to a getItem per key and
+// addItems(key, value, ...) to an addItem per pair. Arguments are positional.
+func bindMultiKey(input string, c *call, cmdType CommandType) (Command, error) {
+	errorAt := func(pos int, expected string, found string) error {
+		return (&lexer{input: input}).errorAt(pos, expected, found)
+	}
+
+	sub := Command{Type: GetItem}
+	names := []string{"key"}
+	if cmdType == AddItems {
+		sub.Type = AddItem
+		names = append(names, "value")
+	}
+
+	cmd := Command{Type: cmdType, Commands: make([]Command, 0, len(c.args)/len(names))}
+	for i, arg := range c.args {
+		name := names[i%len(names)]
+		if arg.name != "" {
+			return Command{}, errorAt(arg.pos, name, "named argument "+arg.name)
+		}
+		text, err := scalarText(arg.value)
+		if err != nil {
+			return Command{}, errorAt(arg.value.pos, err.Error()+" for "+name, describeValue(arg.value))
+		}
+		if name == "key" {
+			sub.Key = text
+		} else {
+			sub.Value = text
+		}
+		if i%len(names) == len(names)-1 {
+			cmd.Commands = append(cmd.Commands, sub)
+		}
+	}
+	if len(c.args)%len(names) != 0 {
+		return Command{}, errorAt(len(input), "value for key "+sub.Key, "missing argument")
+	}
+	if len(cmd.Commands) == 0 {
+		return Command{}, errorAt(len(input), "key", "no keys")
+	}
+	return cmd, nil
+}
+
+// usage returns the command signature, e.g. addItem(key, value), with alternative
+// params separated by '|'.
+func (spec *commandSpec) usage() string {
+	var usage strings.Builder
+	for i, p := range spec.params {
+		if i > 0 {
+			if p.alternative && spec.params[i-1].alternative {
+				usage.WriteString(" | ")
+			} else {
+				usage.WriteString(", ")
+			}
+		}
+		usage.WriteString(p.name)
+		if p.optional {
+			usage.WriteString("?")
+		}
+		if p.variadic {
+			usage.WriteString("...")
+		}
+	}
+	return spec.name + "(" + usage.String() + ")"
+}
+
+func describeValue(v value) string {
+	switch v.kind {
+	case stringValue:
+		return fmt.Sprintf("string %q", v.text)
+	case numberValue:
+		return "number " + v.text
+	default:
+		return "command " + v.call.name
 	}
-	return "", Command{}, errors.New("invalid command format")
 }
 
 // ParseCommand parses the command string and returns the parsed Command and an error if any.
@@ -60,9 +785,3 @@ func (cp *commandsParser) ParseCommand(command string) (Command, error) {
 	_, cmd, err := cp.parseCommand(command)
 	return cmd, err
 }
-
-// GetCommandID returns the key used for consistent hashing from the command string.
-func (cp *commandsParser) GetCommandID(command string) (string, error) {
-	key, _, err := cp.parseCommand(command)
-	return key, err
-}
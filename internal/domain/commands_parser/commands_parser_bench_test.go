@@ -0,0 +1,142 @@
+package commandsparser
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// regexParser is the previous regular expression based parser, kept as a
+// reference for equivalence tests and benchmarks.
+type regexParser struct {
+	addItemPattern     *regexp.Regexp
+	deleteItemPattern  *regexp.Regexp
+	getItemPattern     *regexp.Regexp
+	getAllItemsPattern *regexp.Regexp
+}
+
+func newRegexParser() *regexParser {
+	return &regexParser{
+		addItemPattern:     regexp.MustCompile(`^addItem\(\s*'([^']*)'\s*,\s*'([^']*)'\s*\)$`),
+		deleteItemPattern:  regexp.MustCompile(`^deleteItem\(\s*'([^']*)'\s*\)$`),
+		getItemPattern:     regexp.MustCompile(`^getItem\(\s*'([^']*)'\s*\)$`),
+		getAllItemsPattern: regexp.MustCompile(`^getAllItems\(\)$`),
+	}
+}
+
+func (rp *regexParser) parseCommand(command string) (string, Command, error) {
+	if rp.addItemPattern.MatchString(command) {
+		matches := rp.addItemPattern.FindStringSubmatch(command)
+		return matches[1], Command{Type: AddItem, Key: matches[1], Value: matches[2]}, nil
+	} else if rp.deleteItemPattern.MatchString(command) {
+		matches := rp.deleteItemPattern.FindStringSubmatch(command)
+		return matches[1], Command{Type: DeleteItem, Key: matches[1]}, nil
+	} else if rp.getItemPattern.MatchString(command) {
+		matches := rp.getItemPattern.FindStringSubmatch(command)
+		return matches[1], Command{Type: GetItem, Key: matches[1]}, nil
+	} else if rp.getAllItemsPattern.MatchString(command) {
+		return "", Command{Type: GetAllItems}, nil
+	}
+	return "", Command{}, errors.New("invalid command format")
+}
+
+// loadCommandMix returns the commands from the files in the commands directory.
+func loadCommandMix(tb testing.TB) []string {
+	tb.Helper()
+
+	files, err := filepath.Glob(filepath.Join("..", "..", "..", "commands", "*.txt"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("failed to find command files: %v", err)
+	}
+
+	var commands []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatalf("failed to read %s: %v", file, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				commands = append(commands, line)
+			}
+		}
+	}
+	return commands
+}
+
+// TestParseCommandMatchesRegexParser checks that the command files and other input the
+// previous parser accepted still parse to the same command. Backslashes are the exception,
+// as they now start escape sequences.
+func TestParseCommandMatchesRegexParser(t *testing.T) {
+	cp := NewCommandsParser()
+	rp := newRegexParser()
+
+	inputs := append(loadCommandMix(t),
+		"addItem(  'a b' ,\t'c,d'  )",
+		"addItem('', '')",
+		"addItem('k', '\"v\"')",
+		"getItem('k=v')",
+		"deleteItem(' ')",
+	)
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			expectedKey, expectedCmd, expectedErr := rp.parseCommand(input)
+			if expectedErr != nil {
+				t.Fatalf("regex parser rejected %q: %v", input, expectedErr)
+			}
+			key, cmd, err := cp.parseCommand(input)
+			if err != nil || key != expectedKey || !reflect.DeepEqual(cmd, expectedCmd) {
+				t.Errorf("expected (%q, %+v), got (%q, %+v, %v)", expectedKey, expectedCmd, key, cmd, err)
+			}
+		})
+	}
+}
+
+// BenchmarkRouting compares the previous flow, where the router parsed the message for
+// its key and the worker parsed it again with the regex parser, with a single parser pass.
+func BenchmarkRouting(b *testing.B) {
+	commands := loadCommandMix(b)
+
+	b.Run("ParseTwiceRegex", func(b *testing.B) {
+		rp := newRegexParser()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			command := commands[i%len(commands)]
+			rp.parseCommand(command)
+			rp.parseCommand(command)
+		}
+	})
+
+	b.Run("ParseOnce", func(b *testing.B) {
+		cp := NewCommandsParser()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cp.ParseCommand(commands[i%len(commands)])
+		}
+	})
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	commands := loadCommandMix(b)
+
+	b.Run("Regex", func(b *testing.B) {
+		rp := newRegexParser()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rp.parseCommand(commands[i%len(commands)])
+		}
+	})
+
+	b.Run("Parser", func(b *testing.B) {
+		cp := NewCommandsParser()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cp.parseCommand(commands[i%len(commands)])
+		}
+	})
+}
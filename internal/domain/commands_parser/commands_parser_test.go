@@ -1,7 +1,9 @@
 package commandsparser
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseCommand(t *testing.T) {
@@ -38,83 +40,228 @@ func TestParseCommand(t *testing.T) {
 			if key != tt.expectedKey {
 				t.Errorf("expected key: %s, got: %s", tt.expectedKey, key)
 			}
-			if cmd != tt.expectedCmd {
+			if !reflect.DeepEqual(cmd, tt.expectedCmd) {
 				t.Errorf("expected cmd: %+v, got: %+v", tt.expectedCmd, cmd)
 			}
 		})
 	}
 }
 
-func TestGetCommandID(t *testing.T) {
+func TestParseCommandOnly(t *testing.T) {
 	cp := NewCommandsParser()
 
 	tests := []struct {
 		input       string
-		expectedKey string
+		expectedCmd Command
 		expectedErr bool
 	}{
 		// Positive test cases
-		{"addItem('key1', 'value1')", "key1", false},
-		{"deleteItem('key1')", "key1", false},
-		{"getItem('key1')", "key1", false},
-		{"getAllItems()", "", false},
+		{"addItem('key1', 'value1')", Command{Type: AddItem, Key: "key1", Value: "value1"}, false},
+		{"deleteItem('key1')", Command{Type: DeleteItem, Key: "key1"}, false},
+		{"getItem('key1')", Command{Type: GetItem, Key: "key1"}, false},
+		{"getAllItems()", Command{Type: GetAllItems}, false},
 
 		// Negative test cases
-		{"addItem('key1', )", "", true},
-		{"addItem('key1', 'value1'", "", true},
-		{"deleteItem(key1)", "", true},
-		{"getItem('key1'", "", true},
-		{"getAllItems(", "", true},
-		{"unknownCommand('key1')", "", true},
-		{"", "", true},
+		{"addItem('key1', )", Command{}, true},
+		{"addItem('key1', 'value1'", Command{}, true},
+		{"deleteItem(key1)", Command{}, true},
+		{"getItem('key1'", Command{}, true},
+		{"getAllItems(", Command{}, true},
+		{"unknownCommand('key1')", Command{}, true},
+		{"", Command{}, true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			key, err := cp.GetCommandID(tt.input)
+			cmd, err := cp.ParseCommand(tt.input)
 			if (err != nil) != tt.expectedErr {
 				t.Errorf("expected error: %v, got: %v", tt.expectedErr, err)
 			}
-			if key != tt.expectedKey {
-				t.Errorf("expected key: %s, got: %s", tt.expectedKey, key)
+			if !reflect.DeepEqual(cmd, tt.expectedCmd) {
+				t.Errorf("expected cmd: %+v, got: %+v", tt.expectedCmd, cmd)
 			}
 		})
 	}
 }
 
-func TestParseCommandOnly(t *testing.T) {
+func TestParseCommandGrammar(t *testing.T) {
 	cp := NewCommandsParser()
 
 	tests := []struct {
 		input       string
 		expectedCmd Command
-		expectedErr bool
 	}{
-		// Positive test cases
-		{"addItem('key1', 'value1')", Command{Type: AddItem, Key: "key1", Value: "value1"}, false},
-		{"deleteItem('key1')", Command{Type: DeleteItem, Key: "key1"}, false},
-		{"getItem('key1')", Command{Type: GetItem, Key: "key1"}, false},
-		{"getAllItems()", Command{Type: GetAllItems}, false},
-
-		// Negative test cases
-		{"addItem('key1', )", Command{}, true},
-		{"addItem('key1', 'value1'", Command{}, true},
-		{"deleteItem(key1)", Command{}, true},
-		{"getItem('key1'", Command{}, true},
-		{"getAllItems(", Command{}, true},
-		{"unknownCommand('key1')", Command{}, true},
-		{"", Command{}, true},
+		{`addItem('it\'s', 'v')`, Command{Type: AddItem, Key: "it's", Value: "v"}},
+		{`addItem("say \"hi\"", 'a\\b')`, Command{Type: AddItem, Key: `say "hi"`, Value: `a\b`}},
+		{`addItem('k', 'line1\nline2\ttab')`, Command{Type: AddItem, Key: "k", Value: "line1\nline2\ttab"}},
+		{`addItem('café', '😀')`, Command{Type: AddItem, Key: "café", Value: "😀"}},
+		{`addItem('k', 42)`, Command{Type: AddItem, Key: "k", Value: "42"}},
+		{`addItem('k', -1.5e3)`, Command{Type: AddItem, Key: "k", Value: "-1.5e3"}},
+		{`addItem(value='v', key='k')`, Command{Type: AddItem, Key: "k", Value: "v"}},
+		{`addItem('k', value='v')`, Command{Type: AddItem, Key: "k", Value: "v"}},
+		{"getItem('k');", Command{Type: GetItem, Key: "k"}},
+		{"  getItem ( 'k' ) ;  \n", Command{Type: GetItem, Key: "k"}},
+		{"getAllItems( )", Command{Type: GetAllItems}},
+		{"deleteItem('ключ')", Command{Type: DeleteItem, Key: "ключ"}},
+		{"addItem('k', 'v', ttl='30s')", Command{Type: AddItem, Key: "k", Value: "v", TTL: 30 * time.Second}},
+		{"addItem('k', 'v', 1.5)", Command{Type: AddItem, Key: "k", Value: "v", TTL: 1500 * time.Millisecond}},
+		{"expire('k', '10m')", Command{Type: Expire, Key: "k", TTL: 10 * time.Minute}},
+		{"ttl('k')", Command{Type: TTL, Key: "k"}},
+		{"incrItem('k', 5)", Command{Type: IncrItem, Key: "k", Delta: 5}},
+		{"decrItem('k', delta=-2)", Command{Type: DecrItem, Key: "k", Delta: -2}},
+		{"casItem('k', 3, 'v')", Command{Type: CasItem, Key: "k", Value: "v", Version: 3, CheckVersion: true}},
+		{"deleteItem('k', ifVersion=0)", Command{Type: DeleteItem, Key: "k", CheckVersion: true}},
+		{"transaction(addItem('a', '1'), deleteItem('b'), incrItem('c', 2))", Command{Type: Transaction, Commands: []Command{
+			{Type: AddItem, Key: "a", Value: "1"},
+			{Type: DeleteItem, Key: "b"},
+			{Type: IncrItem, Key: "c", Delta: 2},
+		}}},
+		{"getItems('a', 'b', 'a')", Command{Type: GetItems, Commands: []Command{
+			{Type: GetItem, Key: "a"},
+			{Type: GetItem, Key: "b"},
+			{Type: GetItem, Key: "a"},
+		}}},
+		{"addItems('a', '1', 'b', 2)", Command{Type: AddItems, Commands: []Command{
+			{Type: AddItem, Key: "a", Value: "1"},
+			{Type: AddItem, Key: "b", Value: "2"},
+		}}},
+		{"getAllItems(10, 5)", Command{Type: GetAllItems, Offset: 10, Limit: 5}},
+		{"getAllItems(limit=5)", Command{Type: GetAllItems, Limit: 5}},
+		{"scan(0, 100)", Command{Type: Scan, Count: 100}},
+		{"scan(42, 10, match='user:*')", Command{Type: Scan, Cursor: 42, Count: 10, Match: "user:*"}},
+		{"getItemsByPrefix('user:42:')", Command{Type: GetItemsByPrefix, Match: "user:42:*"}},
+		{`getItemsByPrefix('a*b?\\')`, Command{Type: GetItemsByPrefix, Match: `a\*b\?\\*`}},
+		{"countItems('user:*')", Command{Type: CountItems, Match: "user:*"}},
+		{"deleteItems(match='tmp:*')", Command{Type: DeleteItems, Match: "tmp:*"}},
+		{"subscribe('orders:*')", Command{Type: Subscribe, Match: "orders:*"}},
+		{"unsubscribe(keys='orders:*')", Command{Type: Unsubscribe, Match: "orders:*"}},
+		{"unsubscribe()", Command{Type: Unsubscribe}},
+		{"subscribe(channel='news')", Command{Type: Subscribe, Channel: "news"}},
+		{"subscribe(pattern='news.*')", Command{Type: Subscribe, Channel: "news.*", ChannelPattern: true}},
+		{"unsubscribe(channel='news')", Command{Type: Unsubscribe, Channel: "news"}},
+		{"publish('news', 'hello')", Command{Type: Publish, Channel: "news", Value: "hello"}},
+		{"lpush('l', 'a', 2, 'c')", Command{Type: LPush, Key: "l", Values: []string{"a", "2", "c"}}},
+		{"rpush(key='l', values='a')", Command{Type: RPush, Key: "l", Values: []string{"a"}}},
+		{"lpop('l')", Command{Type: LPop, Key: "l"}},
+		{"rpop('l', 3)", Command{Type: RPop, Key: "l", Count: 3}},
+		{"lrange('l', 0, -1)", Command{Type: LRange, Key: "l", Stop: -1}},
+		{"llen('l')", Command{Type: LLen, Key: "l"}},
+		{"hset('u', 'name', 'Ann')", Command{Type: HSet, Key: "u", Field: "name", Value: "Ann"}},
+		{"hget('u', 'name')", Command{Type: HGet, Key: "u", Field: "name"}},
+		{"hdel('u', 'name', 'age')", Command{Type: HDel, Key: "u", Fields: []string{"name", "age"}}},
+		{"hgetall('u')", Command{Type: HGetAll, Key: "u"}},
+		{"hincr('u', 'visits', -2)", Command{Type: HIncr, Key: "u", Field: "visits", Delta: -2}},
+		{"sadd('s', 'a', 'b')", Command{Type: SAdd, Key: "s", Members: []string{"a", "b"}}},
+		{"srem('s', 'a')", Command{Type: SRem, Key: "s", Members: []string{"a"}}},
+		{"sismember('s', 'a')", Command{Type: SIsMember, Key: "s", Member: "a"}},
+		{"smembers('s')", Command{Type: SMembers, Key: "s"}},
+		{"scard('s')", Command{Type: SCard, Key: "s"}},
+		{"zadd('z', 1.5, 'ann')", Command{Type: ZAdd, Key: "z", Score: 1.5, Member: "ann"}},
+		{"zadd('z', -2, 'bob')", Command{Type: ZAdd, Key: "z", Score: -2, Member: "bob"}},
+		{"zrange('z', 0, -1)", Command{Type: ZRange, Key: "z", Stop: -1}},
+		{"zrank('z', 'ann')", Command{Type: ZRank, Key: "z", Member: "ann"}},
+		{"zrem('z', 'ann', 'bob')", Command{Type: ZRem, Key: "z", Members: []string{"ann", "bob"}}},
+		{`jsonSet('k', '$.address.city', '"Sofia"')`, Command{Type: JSONSet, Key: "k", Path: "$.address.city", Value: `"Sofia"`}},
+		{"jsonGet('k', '$.items[0]')", Command{Type: JSONGet, Key: "k", Path: "$.items[0]"}},
+		{"jsonGet('k')", Command{Type: JSONGet, Key: "k"}},
+		{"jsonDel('k', path='$.a')", Command{Type: JSONDel, Key: "k", Path: "$.a"}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			cmd, err := cp.ParseCommand(tt.input)
-			if (err != nil) != tt.expectedErr {
-				t.Errorf("expected error: %v, got: %v", tt.expectedErr, err)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
-			if cmd != tt.expectedCmd {
+			if !reflect.DeepEqual(cmd, tt.expectedCmd) {
 				t.Errorf("expected cmd: %+v, got: %+v", tt.expectedCmd, cmd)
 			}
 		})
 	}
 }
+
+func TestParseCommandErrors(t *testing.T) {
+	cp := NewCommandsParser()
+
+	tests := []struct {
+		input          string
+		expectedColumn int
+		expectedError  string
+	}{
+		{"addItem('key1', )", 17, "column 17: expected string, number or command, found ')'"},
+		{"addItem('key1', 'value1'", 25, "column 25: expected ',' or ')', found end of command"},
+		{"deleteItem(key1)", 16, "column 16: expected '=' or '(', found ')'"},
+		{"getAllItems(", 13, "column 13: expected string, number or command, found end of command"},
+		{"unknownCommand('key1')", 1, "column 1: expected command name, found unknown command unknownCommand"},
+		{"", 1, "column 1: expected command name, found end of command"},
+		{"getItem('k') x", 14, "column 14: expected ';' or end of command, found identifier x"},
+		{"getItem('k", 11, "column 11: expected closing ', found end of command"},
+		{`getItem('\q')`, 10, `column 10: expected escape sequence, found "\\q"`},
+		{`getItem('\u12')`, 10, `column 10: expected four hex digits after \u, found "\\u12')"`},
+		{"getItem('ключ' 'x')", 16, `column 16: expected ',' or ')', found string "x"`},
+		{"getItem('k', 'v')", 14, "column 14: expected ')' after the arguments of getItem(key), found extra argument"},
+		{"getItem(name='k')", 9, "column 9: expected argument of getItem(key), found unknown argument name"},
+		{"addItem(key='k', 'v')", 18, "column 18: expected named argument, found positional argument after named ones"},
+		{"addItem('k', key='k')", 14, "column 14: expected argument of addItem(key, value, ttl?), found duplicate argument key"},
+		{"addItem('k')", 13, "column 13: expected argument value of addItem(key, value, ttl?), found missing argument"},
+		{"getItem(getItem('k'))", 9, "column 9: expected string or number for key, found command getItem"},
+		{"getItem('k') # comment", 14, `column 14: expected token, found '#'`},
+		{"addItem('k', 'v', ttl='soon')", 23, `column 23: expected duration for ttl, found string "soon"`},
+		{"expire('k', -5)", 13, "column 13: expected positive duration for ttl, found number -5"},
+		{"incrItem('k', '5')", 15, `column 15: expected integer for delta, found string "5"`},
+		{"incrItem('k', 1.5)", 15, "column 15: expected integer for delta, found number 1.5"},
+		{"casItem('k', -1, 'v')", 14, "column 14: expected version number for expectedVersion, found number -1"},
+		{"transaction()", 14, "column 14: expected command in transaction, found empty transaction"},
+		{"transaction('a')", 13, `column 13: expected command, found string "a"`},
+		{"transaction(addItem('a', '1'), getAllItems())", 32, "column 32: expected command allowed in a transaction, found command getAllItems"},
+		{"transaction(transaction(getItem('a')))", 13, "column 13: expected command allowed in a transaction, found command transaction"},
+		{"transaction(addItem('a'))", 26, "column 26: expected argument value of addItem(key, value, ttl?), found missing argument"},
+		{"getItems()", 11, "column 11: expected key, found no keys"},
+		{"getItems('a', key='b')", 15, "column 15: expected key, found named argument key"},
+		{"addItems('a', '1', 'b')", 24, "column 24: expected value for key b, found missing argument"},
+		{"addItems('a', getItem('b'))", 15, "column 15: expected string or number for value, found command getItem"},
+		{"expire('k')", 12, "column 12: expected argument ttl of expire(key, ttl), found missing argument"},
+		{"getAllItems(-1)", 13, "column 13: expected non-negative integer for offset, found number -1"},
+		{"getAllItems(0, 0)", 16, "column 16: expected positive integer for limit, found number 0"},
+		{"scan('a', 10)", 6, `column 6: expected cursor number for cursor, found string "a"`},
+		{"scan(0, 0)", 9, "column 9: expected positive integer for count, found number 0"},
+		{"scan(0, 10, match=5)", 19, "column 19: expected pattern for match, found number 5"},
+		{"getItemsByPrefix(42)", 18, "column 18: expected prefix for prefix, found number 42"},
+		{"deleteItems()", 14, "column 14: expected argument match of deleteItems(match), found missing argument"},
+		{"subscribe()", 12, "column 12: expected argument keys of subscribe(keys | channel | pattern), found missing argument"},
+		{"subscribe('a', 'b')", 16, "column 16: expected ')' after the argument of subscribe(keys | channel | pattern), found second argument channel"},
+		{"unsubscribe(channel='a', keys='b')", 26, "column 26: expected ')' after the argument of unsubscribe(keys? | channel? | pattern?), found second argument keys"},
+		{"subscribe(channel='')", 19, `column 19: expected channel name for channel, found string ""`},
+		{"lpush('l')", 11, "column 11: expected argument values of lpush(key, values...), found missing argument"},
+		{"rpush('l', values='a', values='b')", 24, "column 24: expected argument of rpush(key, values...), found duplicate argument values"},
+		{"lpop('l', 0)", 11, "column 11: expected positive integer for count, found number 0"},
+		{"lrange('l', 'a', 1)", 13, `column 13: expected index for start, found string "a"`},
+		{"hdel('u')", 10, "column 10: expected argument fields of hdel(key, fields...), found missing argument"},
+		{"sadd('s')", 10, "column 10: expected argument members of sadd(key, members...), found missing argument"},
+		{"jsonSet('k', '$', '{\"a\":')", 19, `column 19: expected well-formed JSON value for value, found string "{\"a\":"`},
+		{"jsonSet('k', '$', 1)", 19, "column 19: expected JSON value in a string for value, found number 1"},
+		{"jsonGet('k', 'a.b')", 14, `column 14: expected JSON path for path, found string "a.b"`},
+		{"zadd('z', 'x', 'ann')", 11, `column 11: expected score for score, found string "x"`},
+		{"zadd('z', 1e999, 'ann')", 11, "column 11: expected score for score, found number 1e999"},
+		{"hincr('u', 'visits', 'x')", 22, `column 22: expected integer for delta, found string "x"`},
+		{"publish('news')", 16, "column 16: expected argument message of publish(channel, message), found missing argument"},
+		{"unsubscribe(1)", 13, "column 13: expected pattern for keys, found number 1"},
+		{"scan(0)", 8, "column 8: expected argument count of scan(cursor, count, match?), found missing argument"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := cp.ParseCommand(tt.input)
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected *ParseError, got: %v", err)
+			}
+			if parseErr.Column != tt.expectedColumn {
+				t.Errorf("expected column: %d, got: %d", tt.expectedColumn, parseErr.Column)
+			}
+			if parseErr.Error() != tt.expectedError {
+				t.Errorf("expected error: %s, got: %s", tt.expectedError, parseErr.Error())
+			}
+		})
+	}
+}
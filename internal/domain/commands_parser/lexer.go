@@ -0,0 +1,272 @@
+package commandsparser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenEquals
+	tokenSemicolon
+)
+
+var tokenNames = map[tokenKind]string{
+	tokenEOF:       "end of command",
+	tokenIdent:     "identifier",
+	tokenString:    "string",
+	tokenNumber:    "number",
+	tokenLParen:    "'('",
+	tokenRParen:    "')'",
+	tokenComma:     "','",
+	tokenEquals:    "'='",
+	tokenSemicolon: "';'",
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+type token struct {
+	kind tokenKind
+	// text is the identifier name, the number literal or the unescaped string value.
+	text string
+	// pos is the byte offset of the token in the input.
+	pos int
+}
+
+// ParseError reports where a command failed to parse and what was expected there.
+type ParseError struct {
+	// Column is the 1-based position, in characters, of the offending token.
+	Column   int
+	Expected string
+	Found    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("column %d: expected %s, found %s", e.Column, e.Expected, e.Found)
+}
+
+// lexer splits a command into tokens, skipping whitespace between them.
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) errorAt(pos int, expected string, found string) *ParseError {
+	return &ParseError{
+		Column:   utf8.RuneCountInString(l.input[:pos]) + 1,
+		Expected: expected,
+		Found:    found,
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+
+	start := l.pos
+	if start == len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	c := l.input[start]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, pos: start}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokenComma, pos: start}, nil
+	case c == '=':
+		l.pos++
+		return token{kind: tokenEquals, pos: start}, nil
+	case c == ';':
+		l.pos++
+		return token{kind: tokenSemicolon, pos: start}, nil
+	case c == '\'' || c == '"':
+		return l.lexString(c)
+	case c == '-' || c == '+' || isDigit(c):
+		return l.lexNumber()
+	case isLetter(c) || c == '_':
+		for l.pos < len(l.input) && (isLetter(l.input[l.pos]) || isDigit(l.input[l.pos]) || l.input[l.pos] == '_') {
+			l.pos++
+		}
+		return token{kind: tokenIdent, text: l.input[start:l.pos], pos: start}, nil
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.input[start:])
+	return token{}, l.errorAt(start, "token", strconv.QuoteRune(r))
+}
+
+// lexString reads a string delimited by quote, resolving escape sequences.
+func (l *lexer) lexString(quote byte) (token, error) {
+	start := l.pos
+	l.pos++
+
+	// Strings without escapes are returned as a slice of the input.
+	end := l.pos
+	for end < len(l.input) && l.input[end] != quote && l.input[end] != '\\' {
+		end++
+	}
+	if end < len(l.input) && l.input[end] == quote {
+		text := l.input[l.pos:end]
+		l.pos = end + 1
+		return token{kind: tokenString, text: text, pos: start}, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(l.input[l.pos:end])
+	l.pos = end
+	for {
+		if l.pos >= len(l.input) {
+			return token{}, l.errorAt(l.pos, "closing "+string(quote), tokenEOF.String())
+		}
+
+		c := l.input[l.pos]
+		if c == quote {
+			l.pos++
+			return token{kind: tokenString, text: sb.String(), pos: start}, nil
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			l.pos++
+			continue
+		}
+
+		escape := l.pos
+		l.pos++
+		if l.pos >= len(l.input) {
+			return token{}, l.errorAt(l.pos, "escape sequence", tokenEOF.String())
+		}
+
+		switch l.input[l.pos] {
+		case '\'', '"', '\\', '/':
+			sb.WriteByte(l.input[l.pos])
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case '0':
+			sb.WriteByte(0)
+		case 'u':
+			r, err := l.lexUnicodeEscape(escape)
+			if err != nil {
+				return token{}, err
+			}
+			sb.WriteRune(r)
+			continue
+		default:
+			r, _ := utf8.DecodeRuneInString(l.input[l.pos:])
+			return token{}, l.errorAt(escape, "escape sequence", strconv.Quote("\\"+string(r)))
+		}
+		l.pos++
+	}
+}
+
+// lexUnicodeEscape reads the hex digits of a \uXXXX escape, with l.pos at the 'u',
+// combining UTF-16 surrogate pairs written as two consecutive escapes.
+func (l *lexer) lexUnicodeEscape(escape int) (rune, error) {
+	readHex := func() (rune, bool) {
+		if l.pos+5 > len(l.input) {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(l.input[l.pos+1:l.pos+5], 16, 32)
+		if err != nil {
+			return 0, false
+		}
+		l.pos += 5
+		return rune(v), true
+	}
+
+	r, ok := readHex()
+	if !ok {
+		return 0, l.errorAt(escape, "four hex digits after \\u", strconv.Quote(l.input[escape:min(escape+6, len(l.input))]))
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, nil
+	}
+
+	if strings.HasPrefix(l.input[l.pos:], "\\u") {
+		save := l.pos
+		l.pos++
+		if low, ok := readHex(); ok {
+			if combined := utf16.DecodeRune(r, low); combined != utf8.RuneError {
+				return combined, nil
+			}
+		}
+		l.pos = save
+	}
+	return utf8.RuneError, nil
+}
+
+// lexNumber reads an integer or decimal literal with an optional sign and exponent.
+func (l *lexer) lexNumber() (token, error) {
+	start := l.pos
+	if l.input[l.pos] == '-' || l.input[l.pos] == '+' {
+		l.pos++
+	}
+
+	digits := l.skipDigits()
+	if l.pos < len(l.input) && l.input[l.pos] == '.' {
+		l.pos++
+		digits += l.skipDigits()
+	}
+	if digits == 0 {
+		return token{}, l.errorAt(start, "number", strconv.Quote(l.input[start:l.pos]))
+	}
+
+	if l.pos < len(l.input) && (l.input[l.pos] == 'e' || l.input[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.input) && (l.input[l.pos] == '-' || l.input[l.pos] == '+') {
+			l.pos++
+		}
+		if l.skipDigits() == 0 {
+			return token{}, l.errorAt(start, "number", strconv.Quote(l.input[start:l.pos]))
+		}
+	}
+
+	return token{kind: tokenNumber, text: l.input[start:l.pos], pos: start}, nil
+}
+
+func (l *lexer) skipDigits() int {
+	start := l.pos
+	for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,181 @@
+package commandsparser
+
+import "strconv"
+
+// The command language grammar:
+//
+//	command  = call [ ";" ] EOF
+//	call     = identifier "(" [ argument { "," argument } ] ")"
+//	argument = [ identifier "=" ] value
+//	value    = string | number | call
+
+type valueKind int
+
+const (
+	stringValue valueKind = iota
+	numberValue
+	callValue
+)
+
+type value struct {
+	kind valueKind
+	// text is the unescaped string or the number literal.
+	text string
+	call *call
+	pos  int
+}
+
+type argument struct {
+	// name is empty for positional arguments.
+	name  string
+	value value
+	pos   int
+}
+
+type call struct {
+	name string
+	args []argument
+	pos  int
+}
+
+// parser is a recursive-descent parser over the tokens produced by lexer.
+type parser struct {
+	lex lexer
+	tok token
+}
+
+// parse turns the input into the syntax tree of a single call.
+func parse(input string) (*call, error) {
+	p := &parser{lex: lexer{input: input}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	c, err := p.parseCall()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokenSemicolon {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.unexpected("';' or " + tokenEOF.String())
+	}
+	return c, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) unexpected(expected string) *ParseError {
+	found := p.tok.kind.String()
+	switch p.tok.kind {
+	case tokenIdent, tokenNumber:
+		found += " " + p.tok.text
+	case tokenString:
+		found += " " + strconv.Quote(p.tok.text)
+	}
+	return p.lex.errorAt(p.tok.pos, expected, found)
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	if p.tok.kind != kind {
+		return token{}, p.unexpected(kind.String())
+	}
+	tok := p.tok
+	return tok, p.advance()
+}
+
+func (p *parser) parseCall() (*call, error) {
+	if p.tok.kind != tokenIdent {
+		return nil, p.unexpected("command name")
+	}
+	name := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return p.parseCallArgs(name)
+}
+
+// parseCallArgs parses the parenthesized argument list following the call name.
+func (p *parser) parseCallArgs(name token) (*call, error) {
+	if _, err := p.expect(tokenLParen); err != nil {
+		return nil, err
+	}
+
+	c := &call{name: name.text, pos: name.pos}
+	if p.tok.kind == tokenRParen {
+		return c, p.advance()
+	}
+
+	for {
+		arg, err := p.parseArgument()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+
+		switch p.tok.kind {
+		case tokenComma:
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		case tokenRParen:
+			return c, p.advance()
+		default:
+			return nil, p.unexpected("',' or ')'")
+		}
+	}
+}
+
+func (p *parser) parseArgument() (argument, error) {
+	pos := p.tok.pos
+	if p.tok.kind != tokenIdent {
+		v, err := p.parseValue()
+		return argument{value: v, pos: pos}, err
+	}
+
+	// An identifier starts either a named argument or a nested call.
+	name := p.tok
+	if err := p.advance(); err != nil {
+		return argument{}, err
+	}
+
+	switch p.tok.kind {
+	case tokenEquals:
+		if err := p.advance(); err != nil {
+			return argument{}, err
+		}
+		v, err := p.parseValue()
+		return argument{name: name.text, value: v, pos: pos}, err
+	case tokenLParen:
+		c, err := p.parseCallArgs(name)
+		return argument{value: value{kind: callValue, call: c, pos: pos}, pos: pos}, err
+	default:
+		return argument{}, p.unexpected("'=' or '('")
+	}
+}
+
+func (p *parser) parseValue() (value, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokenString:
+		return value{kind: stringValue, text: tok.text, pos: tok.pos}, p.advance()
+	case tokenNumber:
+		return value{kind: numberValue, text: tok.text, pos: tok.pos}, p.advance()
+	case tokenIdent:
+		c, err := p.parseCall()
+		return value{kind: callValue, call: c, pos: tok.pos}, err
+	default:
+		return value{}, p.unexpected("string, number or command")
+	}
+}
@@ -1,109 +1,608 @@
 package commandsprocessor
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	ds "github.com/avalkov/SCS/internal/datastructures"
 	cmd_parser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/glob"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/domain/values"
+	"github.com/avalkov/SCS/internal/persistence"
 	"github.com/avalkov/SCS/internal/queueservice"
 )
 
+// heldID stands in for the worker ID when a command is executed on behalf of
+// held workers rather than by one of them.
+const heldID = -1
+
+const (
+	// sweepInterval is how often each worker removes expired keys it owns.
+	sweepInterval = 100 * time.Millisecond
+	// sweepBatch bounds the keys removed per sweep so requests are not starved.
+	sweepBatch = 100
+)
+
 type commandsProcessor struct {
-	dataStore KeyValueStorage
-	cmdParser CommandsParser
-	mu        sync.RWMutex
+	dataStore   KeyValueStorage
+	mutationLog MutationLog
+	notifier    Notifier
+	partitioner *ds.Partitioner
+	// shards guards the part of the store owned by each worker. A worker only
+	// contends for its own shard with commands spanning workers and snapshots.
+	shards []sync.RWMutex
+	// expiries holds one queue per worker and is only touched by that worker.
+	expiries []expiryQueue
+	now      func() time.Time
+	// seq numbers mutations when there is no mutation log.
+	seq uint64
 }
 
-func NewCommandsProcessor(cmdParser CommandsParser, keyValueStorage KeyValueStorage) *commandsProcessor {
-	return &commandsProcessor{
-		dataStore: keyValueStorage,
-		cmdParser: cmdParser,
+// NewCommandsProcessor creates a new commandsProcessor. mutationLog may be nil,
+// in which case mutations are kept in memory only, and notifier may be nil, in
+// which case changes are not notified. The store must keep the keys of each worker
+// apart, as ds.ShardedMap with the same partitioner does, since workers write to it
+// concurrently.
+func NewCommandsProcessor(keyValueStorage KeyValueStorage, mutationLog MutationLog, notifier Notifier, partitioner *ds.Partitioner) *commandsProcessor {
+	cp := &commandsProcessor{
+		dataStore:   keyValueStorage,
+		mutationLog: mutationLog,
+		notifier:    notifier,
+		partitioner: partitioner,
+		shards:      make([]sync.RWMutex, partitioner.Workers()),
+		expiries:    make([]expiryQueue, partitioner.Workers()),
+		now:         time.Now,
+	}
+	for _, item := range keyValueStorage.GetAll() {
+		if item.Version > cp.seq {
+			cp.seq = item.Version
+		}
+		if !item.ExpiresAt.IsZero() {
+			cp.expiries[partitioner.WorkerFor(item.Key)].schedule(item.Key, item.ExpiresAt)
+		}
 	}
+	return cp
 }
 
-func (cp *commandsProcessor) Process(processorID int, requests <-chan queueservice.Message, replies chan<- queueservice.Message, wg *sync.WaitGroup) {
+// Process executes the requests routed to the worker. Between requests the worker
+// also sweeps its expired keys, so expiry is serialized with every other
+// operation on those keys.
+func (cp *commandsProcessor) Process(processorID int, requests <-chan protocol.Request, replies chan<- queueservice.Message, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for req := range requests {
-		cmd, err := cp.cmdParser.ParseCommand(req.Body)
-		if err != nil {
-			log.Printf("Worker %d failed to parse command: %v", processorID, err)
-			replies <- queueservice.Message{
-				Body:          fmt.Sprintf("Failed to parse command: %v", err),
-				ReplyTo:       req.ReplyTo,
-				CorrelationId: req.CorrelationId,
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return
 			}
-			continue
+			if req.Hold != nil {
+				// The worker takes part in a transaction and must not touch its keys
+				// until the transaction is applied.
+				<-req.Hold
+				continue
+			}
+			log.Printf("Worker %d processing command: %+v", processorID, req.Command)
+
+			reply := cp.execute(processorID, req.Command)
+			if req.Results != nil {
+				req.Results <- reply
+				continue
+			}
+			replies <- protocol.NewMessage(strconv.Itoa(processorID), req.Message, reply)
+		case <-ticker.C:
+			cp.sweep(processorID)
 		}
+	}
+}
 
-		log.Printf("Worker %d processing command: %+v", processorID, cmd)
-
-		switch cmd.Type {
-		case cmd_parser.AddItem:
-			cp.mu.Lock()
-			cp.dataStore.Add(cmd.Key, cmd.Value)
-			cp.mu.Unlock()
-		case cmd_parser.DeleteItem:
-			cp.mu.Lock()
-			cp.dataStore.Remove(cmd.Key)
-			cp.mu.Unlock()
-		case cmd_parser.GetItem:
-			cp.mu.RLock()
-			value, exists := cp.dataStore.Get(cmd.Key)
-			cp.mu.RUnlock()
-			if exists {
-				replies <- queueservice.Message{
-					Body:          value.(string),
-					ReplyTo:       req.ReplyTo,
-					CorrelationId: req.CorrelationId,
-				}
-			} else {
-				replies <- queueservice.Message{
-					Body:          fmt.Sprintf("Key not found: %s", cmd.Key),
-					ReplyTo:       req.ReplyTo,
-					CorrelationId: req.CorrelationId,
-				}
+// ExecuteHeld executes a command spanning several workers: a transaction, or a
+// command on all keys such as getAllItems. The caller must hold every worker owning a key the command touches,
+// so that no other command on those keys runs in between.
+func (cp *commandsProcessor) ExecuteHeld(cmd cmd_parser.Command) protocol.Reply {
+	if cmd.Type == cmd_parser.Transaction {
+		return cp.executeTransaction(cmd)
+	}
+	return cp.execute(heldID, cmd)
+}
+
+// execute runs a command routed to the worker against the processor's own store
+// and mutation log. Commands executed for held workers may read every shard.
+func (cp *commandsProcessor) execute(processorID int, cmd cmd_parser.Command) protocol.Reply {
+	shards := cp.allShards()
+	if processorID != heldID {
+		shards = []int{processorID}
+	}
+	switch cmd.Type {
+	case cmd_parser.GetItem, cmd_parser.GetItems, cmd_parser.GetAllItems, cmd_parser.Scan, cmd_parser.TTL,
+		cmd_parser.GetItemsByPrefix, cmd_parser.CountItems, cmd_parser.LRange, cmd_parser.LLen,
+		cmd_parser.HGet, cmd_parser.HGetAll, cmd_parser.SIsMember, cmd_parser.SMembers, cmd_parser.SCard,
+		cmd_parser.ZRange, cmd_parser.ZRank, cmd_parser.JSONGet:
+		defer cp.lockShards(shards, false)()
+	default:
+		defer cp.lockShards(shards, true)()
+	}
+
+	ex := &execution{
+		cp:          cp,
+		processorID: processorID,
+		store:       cp.dataStore,
+		logMutation: cp.logMutation,
+		notify:      cp.notify,
+	}
+	return export(ex.apply(cmd))
+}
+
+// execution applies commands on behalf of one worker. Commands read and write
+// through store and logMutation and report changes through notify, which are
+// either the processor's own or the staging area of a transaction. Its methods
+// must be called with the shards of the keys they touch locked.
+type execution struct {
+	cp          *commandsProcessor
+	processorID int
+	store       KeyValueStorage
+	logMutation func(record persistence.Record) (uint64, error)
+	notify      func(event keyspace.Event)
+}
+
+func (ex *execution) apply(cmd cmd_parser.Command) protocol.Reply {
+	reply := protocol.OK(cmd.Type.String(), cmd.Key)
+
+	switch cmd.Type {
+	case cmd_parser.AddItem:
+		var expiresAt time.Time
+		if cmd.TTL > 0 {
+			expiresAt = ex.cp.expiryAfter(cmd.TTL)
+		}
+		if err := ex.purgeExpired(cmd.Key); err != nil {
+			return ex.persistenceFailed(reply, err)
+		}
+		reply.Previous, reply.Existed = ex.store.Get(cmd.Key)
+		if !ex.write(cmd.Key, cmd.Value, expiresAt, &reply) {
+			return reply
+		}
+		ex.cp.scheduleExpiry(ex.processorID, cmd.Key, expiresAt)
+	case cmd_parser.DeleteItem:
+		reply.Previous, reply.Existed = ex.live(cmd.Key)
+		if cmd.CheckVersion {
+			if failed, ok := ex.checkVersion(cmd, reply); !ok {
+				return failed
 			}
-		case cmd_parser.GetAllItems:
-			cp.mu.RLock()
-			items := cp.dataStore.GetAll()
-			cp.mu.RUnlock()
-			itemsJSON, err := json.Marshal(items)
-			if err != nil {
-				log.Printf("Worker %d failed to encode items to JSON: %v", processorID, err)
-				replies <- queueservice.Message{
-					Body:          fmt.Sprintf("Failed to encode items to JSON: %v", err),
-					ReplyTo:       req.ReplyTo,
-					CorrelationId: req.CorrelationId,
-				}
-				continue
+		}
+		if _, exists := ex.store.Get(cmd.Key); !exists {
+			break
+		}
+		// Expired keys are removed as well, they just do not count as existing.
+		if err := ex.remove(cmd.Key, !reply.Existed); err != nil {
+			return ex.persistenceFailed(reply, err)
+		}
+	case cmd_parser.GetItem:
+		value, exists := ex.live(cmd.Key)
+		if !exists {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key)
+		}
+		reply.Value, reply.Existed = value, true
+		reply.Version, _ = ex.store.Version(cmd.Key)
+	case cmd_parser.GetAllItems:
+		items := ex.liveItems()
+		if cmd.Offset < len(items) {
+			items = items[cmd.Offset:]
+		} else {
+			items = items[:0]
+		}
+		if cmd.Limit > 0 && cmd.Limit < len(items) {
+			items = items[:cmd.Limit]
+		}
+		reply.Value = items
+	case cmd_parser.Scan:
+		reply.Value = ex.scan(cmd)
+	case cmd_parser.GetItemsByPrefix, cmd_parser.CountItems, cmd_parser.DeleteItems:
+		return ex.matching(cmd, reply)
+	case cmd_parser.Expire:
+		if _, exists := ex.live(cmd.Key); !exists {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key)
+		}
+		expiresAt := ex.cp.expiryAfter(cmd.TTL)
+		if _, err := ex.logMutation(persistence.Record{Op: persistence.OpExpire, Key: cmd.Key, ExpiresAt: persistence.UnixMilli(expiresAt)}); err != nil {
+			return ex.persistenceFailed(reply, err)
+		}
+		ex.store.SetExpiry(cmd.Key, expiresAt)
+		ex.cp.scheduleExpiry(ex.processorID, cmd.Key, expiresAt)
+		reply.Existed = true
+	case cmd_parser.TTL:
+		if _, exists := ex.live(cmd.Key); !exists {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key)
+		}
+		expiresAt, _ := ex.store.Expiry(cmd.Key)
+		reply.Value, reply.Existed = int64(-1), true
+		if !expiresAt.IsZero() {
+			reply.Value = expiresAt.Sub(ex.cp.now()).Milliseconds()
+		}
+	case cmd_parser.IncrItem, cmd_parser.DecrItem:
+		return ex.increment(cmd, reply)
+	case cmd_parser.CasItem:
+		return ex.compareAndSwap(cmd, reply)
+	case cmd_parser.LPush, cmd_parser.RPush, cmd_parser.LPop, cmd_parser.RPop, cmd_parser.LRange, cmd_parser.LLen:
+		return ex.list(cmd, reply)
+	case cmd_parser.HSet, cmd_parser.HGet, cmd_parser.HDel, cmd_parser.HGetAll, cmd_parser.HIncr:
+		return ex.hash(cmd, reply)
+	case cmd_parser.SAdd, cmd_parser.SRem, cmd_parser.SIsMember, cmd_parser.SMembers, cmd_parser.SCard:
+		return ex.set(cmd, reply)
+	case cmd_parser.ZAdd, cmd_parser.ZRange, cmd_parser.ZRank, cmd_parser.ZRem:
+		return ex.sortedSet(cmd, reply)
+	case cmd_parser.JSONSet, cmd_parser.JSONGet, cmd_parser.JSONDel:
+		return ex.json(cmd, reply)
+	case cmd_parser.GetItems, cmd_parser.AddItems:
+		results := make([]protocol.Reply, len(cmd.Commands))
+		for i, sub := range cmd.Commands {
+			results[i] = ex.apply(sub)
+		}
+		return protocol.Batch(reply.Command, results)
+	default:
+		log.Printf("Worker %d received an unknown command type", ex.processorID)
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrUnknownCommand, "unknown command type: %d", cmd.Type)
+	}
+
+	return reply
+}
+
+func (ex *execution) persistenceFailed(reply protocol.Reply, err error) protocol.Reply {
+	log.Printf("Worker %d failed to log mutation: %v", ex.processorID, err)
+	return protocol.Error(reply.Command, reply.Key, protocol.ErrPersistenceFailed, "%v", err)
+}
+
+// increment applies the delta of an incrItem or decrItem command. Missing keys
+// count as 0, and the item keeps its expiry.
+func (ex *execution) increment(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	delta := cmd.Delta
+	if cmd.Type == cmd_parser.DecrItem {
+		if delta == math.MinInt64 {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrIntegerOverflow, "delta out of range: %d", delta)
+		}
+		delta = -delta
+	}
+
+	if err := ex.purgeExpired(cmd.Key); err != nil {
+		return ex.persistenceFailed(reply, err)
+	}
+
+	var current int64
+	reply.Previous, reply.Existed = ex.store.Get(cmd.Key)
+	if reply.Existed {
+		if err := values.Check(reply.Previous, values.TypeString); err != nil {
+			return ex.updateFailed(reply, err)
+		}
+		n, err := strconv.ParseInt(reply.Previous.(string), 10, 64)
+		if err != nil {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrNotInteger, "value is not an integer: %v", reply.Previous)
+		}
+		current = n
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrIntegerOverflow, "%s would overflow: %d %+d", cmd.Key, current, delta)
+	}
+	next := current + delta
+
+	var expiresAt time.Time
+	if reply.Existed {
+		expiresAt, _ = ex.store.Expiry(cmd.Key)
+	}
+	value := strconv.FormatInt(next, 10)
+	if !ex.write(cmd.Key, value, expiresAt, &reply) {
+		return reply
+	}
+	reply.Value = next
+	return reply
+}
+
+// compareAndSwap replaces the value of the item only if its version matches the
+// expected one. Version 0 expects the key not to exist. The item keeps its expiry.
+func (ex *execution) compareAndSwap(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	if err := ex.purgeExpired(cmd.Key); err != nil {
+		return ex.persistenceFailed(reply, err)
+	}
+
+	reply.Previous, reply.Existed = ex.store.Get(cmd.Key)
+	if failed, ok := ex.checkVersion(cmd, reply); !ok {
+		return failed
+	}
+
+	expiresAt, _ := ex.store.Expiry(cmd.Key)
+	ex.write(cmd.Key, cmd.Value, expiresAt, &reply)
+	return reply
+}
+
+// checkVersion reports whether the live item matches the version expected by the
+// command, returning the error reply when it does not.
+func (ex *execution) checkVersion(cmd cmd_parser.Command, reply protocol.Reply) (protocol.Reply, bool) {
+	if !reply.Existed {
+		if cmd.Version == 0 {
+			return reply, true
+		}
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key), false
+	}
+	current, _ := ex.store.Version(cmd.Key)
+	if current != cmd.Version {
+		failed := protocol.Error(reply.Command, cmd.Key, protocol.ErrVersionMismatch, "expected version %d, found %d", cmd.Version, current)
+		failed.Version = current
+		return failed, false
+	}
+	return reply, true
+}
+
+// write logs and stores a new value for the key, setting reply.Version on success
+// or replacing the reply with an error.
+func (ex *execution) write(key string, value string, expiresAt time.Time, reply *protocol.Reply) bool {
+	version, err := ex.logMutation(persistence.Record{Op: persistence.OpAdd, Key: key, Value: value, ExpiresAt: persistence.UnixMilli(expiresAt)})
+	if err != nil {
+		*reply = ex.persistenceFailed(*reply, err)
+		return false
+	}
+	ex.store.Add(key, value, version)
+	ex.store.SetExpiry(key, expiresAt)
+	ex.store.SetVersion(key, version)
+	reply.Version = version
+
+	event := keyspace.Event{Type: keyspace.EventAdd, Key: key, Value: value, Version: version}
+	if reply.Existed {
+		event.Type = keyspace.EventUpdate
+	}
+	ex.notify(event)
+	return true
+}
+
+// remove logs and applies the deletion of the key, notifying it as an expiry if
+// the key had expired.
+func (ex *execution) remove(key string, expired bool) error {
+	if _, err := ex.logMutation(persistence.Record{Op: persistence.OpDelete, Key: key}); err != nil {
+		return err
+	}
+	ex.store.Remove(key)
+
+	event := keyspace.Event{Type: keyspace.EventDelete, Key: key}
+	if expired {
+		event.Type = keyspace.EventExpire
+	}
+	ex.notify(event)
+	return nil
+}
+
+// live returns the value of the key unless it is missing or has expired. Expired
+// keys stay in the store until their worker sweeps them.
+func (ex *execution) live(key string) (interface{}, bool) {
+	value, exists := ex.store.Get(key)
+	if !exists {
+		return nil, false
+	}
+	if expiresAt, _ := ex.store.Expiry(key); ex.cp.expired(expiresAt) {
+		return nil, false
+	}
+	return value, true
+}
+
+// purgeExpired removes the key if it has expired but was not swept yet, so that
+// writing it again appends it like a new key.
+func (ex *execution) purgeExpired(key string) error {
+	expiresAt, exists := ex.store.Expiry(key)
+	if !exists || !ex.cp.expired(expiresAt) {
+		return nil
+	}
+	return ex.remove(key, true)
+}
+
+// liveItems returns all items in insertion order, leaving out expired ones.
+func (ex *execution) liveItems() []ds.KeyValue {
+	items := ex.store.GetAll()
+	live := items[:0]
+	for _, item := range items {
+		if !ex.cp.expired(item.ExpiresAt) {
+			live = append(live, item)
+		}
+	}
+	return live
+}
+
+// scan examines the next cmd.Count items inserted after the cursor and returns the
+// live ones matching the pattern. The next cursor is the insertion sequence number
+// of the last item examined. Keys present for the whole scan are returned exactly
+// once, since their sequence numbers do not change.
+func (ex *execution) scan(cmd cmd_parser.Command) protocol.Page {
+	examined := ex.store.ScanAfter(cmd.Cursor, cmd.Count)
+
+	page := protocol.Page{}
+	if len(examined) >= cmd.Count {
+		page.Cursor = examined[len(examined)-1].Inserted
+	}
+	items := make([]ds.KeyValue, 0, len(examined))
+	for _, item := range examined {
+		if !ex.cp.expired(item.ExpiresAt) && glob.Match(cmd.Match, item.Key) {
+			items = append(items, item)
+		}
+	}
+	page.Items = items
+	return page
+}
+
+// matching applies getItemsByPrefix, countItems or deleteItems to the items whose
+// key matches cmd.Match, in insertion order. Only keys starting with the literal
+// prefix of the pattern are looked up.
+func (ex *execution) matching(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	items := make([]ds.KeyValue, 0)
+	var expired []string
+	for _, item := range ex.store.WithPrefix(glob.Prefix(cmd.Match)) {
+		if !glob.Match(cmd.Match, item.Key) {
+			continue
+		}
+		if ex.cp.expired(item.ExpiresAt) {
+			expired = append(expired, item.Key)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	switch cmd.Type {
+	case cmd_parser.GetItemsByPrefix:
+		reply.Value = items
+	case cmd_parser.CountItems:
+		reply.Value = len(items)
+	case cmd_parser.DeleteItems:
+		// Expired keys are removed as well, they just do not count as deleted.
+		for _, key := range expired {
+			if err := ex.remove(key, true); err != nil {
+				return ex.persistenceFailed(reply, err)
 			}
-			replies <- queueservice.Message{
-				Body:          string(itemsJSON),
-				ReplyTo:       req.ReplyTo,
-				CorrelationId: req.CorrelationId,
+		}
+		for _, item := range items {
+			if err := ex.remove(item.Key, false); err != nil {
+				return ex.persistenceFailed(reply, err)
 			}
-		default:
-			log.Printf("Worker %d received an unknown command type", processorID)
-			replies <- queueservice.Message{
-				Body:          fmt.Sprintf("Unknown command: %s", req.Body),
-				ReplyTo:       req.ReplyTo,
-				CorrelationId: req.CorrelationId,
+		}
+		reply.Value = len(items)
+	}
+	return reply
+}
+
+func (cp *commandsProcessor) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !expiresAt.After(cp.now())
+}
+
+// expiryAfter returns the expiry of a key given the ttl, at the millisecond precision
+// it is logged with. Transactions reach the store through the log records, so the
+// sweeper only recognises scheduled expiries that survive that round trip.
+func (cp *commandsProcessor) expiryAfter(ttl time.Duration) time.Time {
+	return persistence.FromUnixMilli(persistence.UnixMilli(cp.now().Add(ttl)))
+}
+
+// scheduleExpiry queues the key for the worker's sweeper.
+func (cp *commandsProcessor) scheduleExpiry(processorID int, key string, expiresAt time.Time) {
+	if !expiresAt.IsZero() {
+		cp.expiries[processorID].schedule(key, expiresAt)
+	}
+}
+
+// sweep removes up to sweepBatch expired keys owned by the worker. Queue entries
+// for keys that were deleted or given a different expiry since are dropped.
+func (cp *commandsProcessor) sweep(processorID int) {
+	queue := &cp.expiries[processorID]
+	now := cp.now()
+
+	defer cp.lockShards([]int{processorID}, true)()
+
+	for removed := 0; removed < sweepBatch; {
+		entry, ok := queue.due(now)
+		if !ok {
+			return
+		}
+		expiresAt, exists := cp.dataStore.Expiry(entry.key)
+		if !exists || !expiresAt.Equal(entry.expiresAt) {
+			continue
+		}
+		if _, err := cp.logMutation(persistence.Record{Op: persistence.OpDelete, Key: entry.key}); err != nil {
+			log.Printf("Worker %d failed to log expiry of %s: %v", processorID, entry.key, err)
+			queue.schedule(entry.key, entry.expiresAt)
+			return
+		}
+		cp.dataStore.Remove(entry.key)
+		cp.notify(keyspace.Event{Type: keyspace.EventExpire, Key: entry.key})
+		removed++
+	}
+}
+
+// Snapshot returns a copy of all items together with the sequence number of the
+// last logged mutation they include.
+func (cp *commandsProcessor) Snapshot() ([]ds.KeyValue, uint64) {
+	// Mutations are logged and applied with their shard locked, so with every
+	// shard locked each logged mutation has been applied.
+	defer cp.lockShards(cp.allShards(), false)()
+
+	var seq uint64
+	if cp.mutationLog != nil {
+		seq = cp.mutationLog.LastSeq()
+	}
+	items := cp.dataStore.GetAll()
+	for i := range items {
+		items[i].Value = values.Copy(items[i].Value)
+	}
+	return items, seq
+}
+
+// logMutation writes the mutation ahead of applying it and returns its sequence
+// number, which becomes the version of a written value and orders new keys across
+// shards. Without a mutation log the sequence is kept in memory. Must be called with
+// the shard of the key locked so that the log order of each key matches the order
+// its mutations are applied to the store.
+func (cp *commandsProcessor) logMutation(record persistence.Record) (uint64, error) {
+	if cp.mutationLog == nil {
+		return atomic.AddUint64(&cp.seq, 1), nil
+	}
+	return cp.mutationLog.Append(record)
+}
+
+// notify passes the change to the notifier, if any. It is called with the shard of
+// the key locked, so the changes of a key are notified in the order they are applied.
+func (cp *commandsProcessor) notify(event keyspace.Event) {
+	if cp.notifier != nil {
+		cp.notifier.Notify(event)
+	}
+}
+
+// lockShards locks the given shards in ascending order, which callers locking
+// several shards must share to avoid deadlocks, and returns the unlock function.
+func (cp *commandsProcessor) lockShards(shards []int, exclusive bool) func() {
+	for _, shard := range shards {
+		if exclusive {
+			cp.shards[shard].Lock()
+		} else {
+			cp.shards[shard].RLock()
+		}
+	}
+	return func() {
+		for _, shard := range shards {
+			if exclusive {
+				cp.shards[shard].Unlock()
+			} else {
+				cp.shards[shard].RUnlock()
 			}
 		}
 	}
 }
 
-type CommandsParser interface {
-	ParseCommand(command string) (cmd_parser.Command, error)
+func (cp *commandsProcessor) allShards() []int {
+	shards := make([]int, len(cp.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+type MutationLog interface {
+	Append(record persistence.Record) (uint64, error)
+	LastSeq() uint64
+}
+
+// Notifier is told about every change applied to the store.
+type Notifier interface {
+	Notify(event keyspace.Event)
 }
 
 type KeyValueStorage interface {
-	Add(key string, value interface{})
+	Add(key string, value interface{}, seq uint64)
 	Remove(key string)
 	Get(key string) (interface{}, bool)
 	GetAll() []ds.KeyValue
+	ScanAfter(seq uint64, count int) []ds.KeyValue
+	WithPrefix(prefix string) []ds.KeyValue
+	SetExpiry(key string, expiresAt time.Time) bool
+	Expiry(key string) (time.Time, bool)
+	SetVersion(key string, version uint64) bool
+	Version(key string) (uint64, bool)
 }
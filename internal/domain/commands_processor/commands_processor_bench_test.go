@@ -0,0 +1,68 @@
+package commandsprocessor
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	cmdParser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// BenchmarkProcess routes a mix of writes and reads over many keys to their
+// workers, as the router does, and waits for every reply.
+func BenchmarkProcess(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			partitioner := ds.NewPartitioner(workers)
+			cp := NewCommandsProcessor(ds.NewShardedMap(partitioner), nil, nil, partitioner)
+
+			requests := make([]chan protocol.Request, workers)
+			replies := make(chan queueservice.Message, 1024)
+			var wg sync.WaitGroup
+			for i := range requests {
+				requests[i] = make(chan protocol.Request, 64)
+				wg.Add(1)
+				go cp.Process(i, requests[i], replies, &wg)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < b.N; i++ {
+					<-replies
+				}
+				close(done)
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%len(keys)]
+				cmd := cmdParser.Command{Type: cmdParser.GetItem, Key: key}
+				if i%2 == 0 {
+					cmd = cmdParser.Command{Type: cmdParser.AddItem, Key: key, Value: "value"}
+				}
+				requests[partitioner.WorkerFor(key)] <- protocol.Request{Command: cmd}
+			}
+			<-done
+			b.StopTimer()
+
+			for _, ch := range requests {
+				close(ch)
+			}
+			wg.Wait()
+		})
+	}
+}
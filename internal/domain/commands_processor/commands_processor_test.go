@@ -1,85 +1,95 @@
 package commandsprocessor
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	ds "github.com/avalkov/SCS/internal/datastructures"
 	cmdParser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/glob"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/persistence"
 	"github.com/avalkov/SCS/internal/queueservice"
 )
 
-type mockCommandsParser struct{}
-
-func (m *mockCommandsParser) ParseCommand(command string) (cmdParser.Command, error) {
-	cp := cmdParser.NewCommandsParser()
-	return cp.ParseCommand(command)
+// newRequest builds the routed request the router would produce for the message.
+func newRequest(t *testing.T, msg queueservice.Message) protocol.Request {
+	t.Helper()
+	cmd, err := cmdParser.NewCommandsParser().ParseCommand(msg.Body)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", msg.Body, err)
+	}
+	return protocol.Request{Message: msg, Command: cmd}
 }
 
 func TestCommandsProcessor_Process(t *testing.T) {
-	cmdParser := &mockCommandsParser{}
-	cp := NewCommandsProcessor(cmdParser, ds.NewOrderedMap())
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
 
 	tests := []struct {
 		name          string
 		request       queueservice.Message
-		expectedReply queueservice.Message
+		expectedReply protocol.Reply
 	}{
 		{
 			name: "AddItem",
 			request: queueservice.Message{
 				Body: "addItem('key1', 'value1')",
 			},
-			expectedReply: queueservice.Message{},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "key1", Version: 1},
+		},
+		{
+			name: "AddItem Existing",
+			request: queueservice.Message{
+				Body: "addItem('key1', 'value2')",
+			},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "key1", Previous: "value1", Existed: true, Version: 2},
 		},
 		{
 			name: "GetItem Exists",
 			request: queueservice.Message{
 				Body: "getItem('key1')",
 			},
-			expectedReply: queueservice.Message{
-				Body: "value1",
-			},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "key1", Value: "value2", Existed: true, Version: 2},
 		},
 		{
 			name: "DeleteItem",
 			request: queueservice.Message{
 				Body: "deleteItem('key1')",
 			},
-			expectedReply: queueservice.Message{},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "deleteItem", Key: "key1", Previous: "value2", Existed: true},
 		},
 		{
-			name: "GetItem Not Exists",
+			name: "DeleteItem Not Exists",
 			request: queueservice.Message{
-				Body: "getItem('key1')",
-			},
-			expectedReply: queueservice.Message{
-				Body: "Key not found: key1",
+				Body: "deleteItem('key1')",
 			},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "deleteItem", Key: "key1"},
 		},
 		{
-			name: "GetAllItems",
+			name: "GetItem Not Exists",
 			request: queueservice.Message{
-				Body: "getAllItems()",
-			},
-			expectedReply: queueservice.Message{
-				Body: `[]`,
+				Body: "getItem('key1')",
 			},
+			expectedReply: protocol.Reply{Status: protocol.StatusError, Command: "getItem", Key: "key1", ErrorCode: protocol.ErrKeyNotFound, Error: "key not found: key1"},
 		},
 		{
-			name: "Invalid Command",
+			name: "GetAllItems",
 			request: queueservice.Message{
-				Body: "invalidCommand('key1')",
-			},
-			expectedReply: queueservice.Message{
-				Body: "Failed to parse command: invalid command format",
+				Body: "getAllItems()",
 			},
+			expectedReply: protocol.Reply{Status: protocol.StatusOK, Command: "getAllItems", Value: []interface{}{}},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			requests := make(chan queueservice.Message, 1)
+			requests := make(chan protocol.Request, 1)
 			replies := make(chan queueservice.Message, 1)
 
 			var wg sync.WaitGroup
@@ -87,17 +97,830 @@ func TestCommandsProcessor_Process(t *testing.T) {
 
 			go cp.Process(1, requests, replies, &wg)
 
-			requests <- tt.request
+			requests <- newRequest(t, tt.request)
 			close(requests)
 
 			wg.Wait()
 			close(replies)
 
+			received := 0
 			for reply := range replies {
-				if reply.Body != tt.expectedReply.Body {
-					t.Errorf("expected reply body: %s, got: %s", tt.expectedReply.Body, reply.Body)
+				received++
+				decoded, err := protocol.Decode(reply.Body)
+				if err != nil {
+					t.Fatalf("failed to decode reply: %v", err)
+				}
+				if !reflect.DeepEqual(decoded, tt.expectedReply) {
+					t.Errorf("expected reply: %+v, got: %+v", tt.expectedReply, decoded)
 				}
 			}
+			if received != 1 {
+				t.Errorf("expected 1 reply, got: %d", received)
+			}
+		})
+	}
+}
+
+type failingMutationLog struct{}
+
+func (m *failingMutationLog) Append(record persistence.Record) (uint64, error) {
+	return 0, errors.New("disk full")
+}
+
+func (m *failingMutationLog) LastSeq() uint64 {
+	return 0
+}
+
+func TestCommandsProcessor_ProcessPersistenceFailure(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	cp := NewCommandsProcessor(store, &failingMutationLog{}, nil, ds.NewPartitioner(3))
+
+	requests := make(chan protocol.Request, 1)
+	replies := make(chan queueservice.Message, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go cp.Process(1, requests, replies, &wg)
+
+	delivery := &struct{ tag int }{tag: 7}
+	requests <- newRequest(t, queueservice.Message{Body: "addItem('key1', 'value1')", Delivery: delivery})
+	close(requests)
+	wg.Wait()
+
+	reply := <-replies
+	if !reply.Failed {
+		t.Errorf("expected reply to be marked as failed")
+	}
+	if reply.Delivery != delivery {
+		t.Errorf("expected reply to carry the request delivery")
+	}
+	if reply.DeadLetter == nil || reply.DeadLetter.Worker != "1" || reply.DeadLetter.ErrorCode != string(protocol.ErrPersistenceFailed) {
+		t.Errorf("expected dead-letter details from worker 1, got: %+v", reply.DeadLetter)
+	}
+
+	decoded, err := protocol.Decode(reply.Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if decoded.ErrorCode != protocol.ErrPersistenceFailed {
+		t.Errorf("expected error code: %s, got: %s", protocol.ErrPersistenceFailed, decoded.ErrorCode)
+	}
+	if _, exists := store.Get("key1"); exists {
+		t.Errorf("expected mutation not to be applied")
+	}
+}
+
+// processOne runs a single request through a worker and returns its decoded reply.
+func processOne(t *testing.T, cp *commandsProcessor, processorID int, body string) protocol.Reply {
+	t.Helper()
+	requests := make(chan protocol.Request, 1)
+	replies := make(chan queueservice.Message, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cp.Process(processorID, requests, replies, &wg)
+
+	requests <- newRequest(t, queueservice.Message{Body: body})
+	close(requests)
+	wg.Wait()
+
+	decoded, err := protocol.Decode((<-replies).Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	return decoded
+}
+
+func TestCommandsProcessor_Expiry(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	cp := NewCommandsProcessor(store, nil, nil, ds.NewPartitioner(3))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cp.now = func() time.Time { return now }
+
+	processOne(t, cp, 1, "addItem('a', '1', ttl='30s')")
+	processOne(t, cp, 1, "addItem('b', '2', ttl='30s')")
+	processOne(t, cp, 1, "addItem('c', '3')")
+	processOne(t, cp, 1, "addItem('d', '4', ttl='30s')")
+	// Overwriting without a TTL makes the item persistent again.
+	processOne(t, cp, 1, "addItem('b', '22')")
+
+	if reply := processOne(t, cp, 1, "ttl('a')"); reply.Value != float64(30000) {
+		t.Errorf("expected ttl of 30000ms, got: %v", reply.Value)
+	}
+	if reply := processOne(t, cp, 1, "ttl('c')"); reply.Value != float64(-1) {
+		t.Errorf("expected ttl of -1, got: %v", reply.Value)
+	}
+	if reply := processOne(t, cp, 1, "expire('c', '1m')"); reply.Status != protocol.StatusOK {
+		t.Errorf("expected expire to succeed, got: %+v", reply)
+	}
+	if reply := processOne(t, cp, 1, "expire('missing', '1m')"); reply.ErrorCode != protocol.ErrKeyNotFound {
+		t.Errorf("expected error code: %s, got: %+v", protocol.ErrKeyNotFound, reply)
+	}
+
+	now = now.Add(31 * time.Second)
+
+	// Lazily hidden before the sweeper runs.
+	if reply := processOne(t, cp, 1, "getItem('a')"); reply.ErrorCode != protocol.ErrKeyNotFound {
+		t.Errorf("expected error code: %s, got: %+v", protocol.ErrKeyNotFound, reply)
+	}
+	if reply := processOne(t, cp, 1, "getAllItems()"); len(reply.Value.([]interface{})) != 2 {
+		t.Errorf("expected 2 live items, got: %v", reply.Value)
+	}
+	if _, exists := store.Get("a"); !exists {
+		t.Errorf("expected expired key to stay in the store until swept")
+	}
+
+	cp.sweep(1)
+
+	var keys []string
+	for _, item := range store.GetAll() {
+		keys = append(keys, item.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("expected keys [b c] after sweep, got: %v", keys)
+	}
+	if reply := processOne(t, cp, 1, "ttl('c')"); reply.Value != float64(29000) {
+		t.Errorf("expected ttl of 29000ms, got: %v", reply.Value)
+	}
+}
+
+func TestCommandsProcessor_ExpirySeededFromStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	partitioner := ds.NewPartitioner(3)
+	store := ds.NewShardedMap(partitioner)
+	store.Add("restored", "value", 1)
+	store.SetExpiry("restored", now.Add(-time.Second))
+
+	cp := NewCommandsProcessor(store, nil, nil, partitioner)
+	cp.now = func() time.Time { return now }
+
+	// Only the owning worker sweeps the key.
+	owner := partitioner.WorkerFor("restored")
+	cp.sweep((owner + 1) % 3)
+	if _, exists := store.Get("restored"); !exists {
+		t.Fatalf("expected key to be left alone by a worker that does not own it")
+	}
+	cp.sweep(owner)
+	if _, exists := store.Get("restored"); exists {
+		t.Errorf("expected restored key to be swept by its owner")
+	}
+}
+
+func TestCommandsProcessor_SweepsTransactionExpiry(t *testing.T) {
+	partitioner := ds.NewPartitioner(3)
+	store := ds.NewShardedMap(partitioner)
+	cp := NewCommandsProcessor(store, nil, nil, partitioner)
+	// Not a whole millisecond, the store keeps transactional expiries truncated to one.
+	now := time.Date(2024, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	cp.now = func() time.Time { return now }
+
+	req := newRequest(t, queueservice.Message{Body: "transaction(addItem('a', '1', ttl='1s'), addItem('b', '2'))"})
+	if reply := cp.ExecuteHeld(req.Command); reply.Status != protocol.StatusOK {
+		t.Fatalf("expected transaction to succeed, got: %+v", reply)
+	}
+
+	now = now.Add(2 * time.Second)
+	cp.sweep(partitioner.WorkerFor("a"))
+
+	if _, exists := store.Get("a"); exists {
+		t.Errorf("expected key with a transactional ttl to be swept")
+	}
+	if _, exists := store.Get("b"); !exists {
+		t.Errorf("expected key without a ttl to stay")
+	}
+}
+
+func TestCommandsProcessor_Counters(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	cp := NewCommandsProcessor(store, nil, nil, ds.NewPartitioner(3))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cp.now = func() time.Time { return now }
+
+	processOne(t, cp, 1, "addItem('name', 'alice')")
+	processOne(t, cp, 1, "addItem('max', 9223372036854775807)")
+	processOne(t, cp, 1, "addItem('session', '10', ttl='1m')")
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"incrItem('hits', 5)", protocol.Reply{Status: protocol.StatusOK, Command: "incrItem", Key: "hits", Value: float64(5), Version: 4}},
+		{"incrItem('hits', 2)", protocol.Reply{Status: protocol.StatusOK, Command: "incrItem", Key: "hits", Value: float64(7), Previous: "5", Existed: true, Version: 5}},
+		{"decrItem('hits', 10)", protocol.Reply{Status: protocol.StatusOK, Command: "decrItem", Key: "hits", Value: float64(-3), Previous: "7", Existed: true, Version: 6}},
+		{"incrItem('hits', 3)", protocol.Reply{Status: protocol.StatusOK, Command: "incrItem", Key: "hits", Value: float64(0), Previous: "-3", Existed: true, Version: 7}},
+		{"incrItem('name', 1)", protocol.Reply{Status: protocol.StatusError, Command: "incrItem", Key: "name", ErrorCode: protocol.ErrNotInteger, Error: "value is not an integer: alice"}},
+		{"incrItem('max', 1)", protocol.Reply{Status: protocol.StatusError, Command: "incrItem", Key: "max", ErrorCode: protocol.ErrIntegerOverflow, Error: "max would overflow: 9223372036854775807 +1"}},
+		{"decrItem('session', 1)", protocol.Reply{Status: protocol.StatusOK, Command: "decrItem", Key: "session", Value: float64(9), Previous: "10", Existed: true, Version: 8}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+				t.Errorf("expected reply: %+v, got: %+v", tt.expectedReply, reply)
+			}
 		})
 	}
+
+	if value, _ := store.Get("name"); value != "alice" {
+		t.Errorf("expected failed increment to leave the value unchanged, got: %v", value)
+	}
+	if expiresAt, _ := store.Expiry("session"); !expiresAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected counter to keep its expiry, got: %v", expiresAt)
+	}
+}
+
+func TestCommandsProcessor_CompareAndSwap(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"casItem('k', 0, 'v1')", protocol.Reply{Status: protocol.StatusOK, Command: "casItem", Key: "k", Version: 1}},
+		{"casItem('k', 0, 'v2')", protocol.Reply{Status: protocol.StatusError, Command: "casItem", Key: "k", Version: 1, ErrorCode: protocol.ErrVersionMismatch, Error: "expected version 0, found 1"}},
+		{"casItem('k', 1, 'v2')", protocol.Reply{Status: protocol.StatusOK, Command: "casItem", Key: "k", Previous: "v1", Existed: true, Version: 2}},
+		{"addItem('other', 'x')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "other", Version: 3}},
+		{"getItem('k')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "k", Value: "v2", Existed: true, Version: 2}},
+		{"casItem('missing', 4, 'v')", protocol.Reply{Status: protocol.StatusError, Command: "casItem", Key: "missing", ErrorCode: protocol.ErrKeyNotFound, Error: "key not found: missing"}},
+		{"deleteItem('k', ifVersion=1)", protocol.Reply{Status: protocol.StatusError, Command: "deleteItem", Key: "k", Version: 2, ErrorCode: protocol.ErrVersionMismatch, Error: "expected version 1, found 2"}},
+		{"deleteItem('k', ifVersion=2)", protocol.Reply{Status: protocol.StatusOK, Command: "deleteItem", Key: "k", Previous: "v2", Existed: true}},
+		// Versions keep increasing when a deleted key is written again.
+		{"casItem('k', 0, 'v3')", protocol.Reply{Status: protocol.StatusOK, Command: "casItem", Key: "k", Version: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+				t.Errorf("expected reply: %+v, got: %+v", tt.expectedReply, reply)
+			}
+		})
+	}
+}
+
+func TestCommandsProcessor_ExecuteHeldTransaction(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	cp := NewCommandsProcessor(store, nil, nil, ds.NewPartitioner(3))
+
+	processOne(t, cp, 1, "addItem('a', '1')")
+	processOne(t, cp, 1, "addItem('b', '2')")
+
+	transaction := func(body string) protocol.Reply {
+		req := newRequest(t, queueservice.Message{Body: body})
+		return cp.ExecuteHeld(req.Command)
+	}
+
+	reply := transaction("transaction(addItem('c', '3'), incrItem('a', 5), casItem('b', 1, 'x'))")
+	expected := protocol.Reply{Status: protocol.StatusError, Command: "transaction", ErrorCode: protocol.ErrVersionMismatch,
+		Error: "command 3 (casItem) aborted the transaction: expected version 1, found 2"}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected reply: %+v, got: %+v", expected, reply)
+	}
+	if !reflect.DeepEqual(store.GetAll(), []ds.KeyValue{{Key: "a", Value: "1", Version: 1, Inserted: 1}, {Key: "b", Value: "2", Version: 2, Inserted: 2}}) {
+		t.Errorf("expected aborted transaction to change nothing, got: %+v", store.GetAll())
+	}
+
+	reply = transaction("transaction(deleteItem('a'), addItem('a', 'new'), casItem('b', 2, 'x'), getItem('b'))")
+	expected = protocol.Reply{Status: protocol.StatusOK, Command: "transaction", Value: []protocol.Reply{
+		{Status: protocol.StatusOK, Command: "deleteItem", Key: "a", Previous: "1", Existed: true},
+		{Status: protocol.StatusOK, Command: "addItem", Key: "a", Version: 3},
+		{Status: protocol.StatusOK, Command: "casItem", Key: "b", Previous: "2", Existed: true, Version: 3},
+		{Status: protocol.StatusOK, Command: "getItem", Key: "b", Value: "x", Existed: true, Version: 3},
+	}}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected reply: %+v, got: %+v", expected, reply)
+	}
+	// The deleted and re-added key moves to the end, as it would outside a transaction.
+	if !reflect.DeepEqual(store.GetAll(), []ds.KeyValue{{Key: "b", Value: "x", Version: 3, Inserted: 2}, {Key: "a", Value: "new", Version: 3, Inserted: 3}}) {
+		t.Errorf("expected committed items, got: %+v", store.GetAll())
+	}
+}
+
+func TestCommandsProcessor_ShardedGetAllItemsKeepsInsertionOrder(t *testing.T) {
+	partitioner := ds.NewPartitioner(3)
+	cp := NewCommandsProcessor(ds.NewShardedMap(partitioner), nil, nil, partitioner)
+
+	process := func(key string, body string) {
+		if reply := processOne(t, cp, partitioner.WorkerFor(key), body); reply.Status != protocol.StatusOK {
+			t.Fatalf("failed to process %q: %+v", body, reply)
+		}
+	}
+
+	var expected []string
+	owners := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		process(key, fmt.Sprintf("addItem('%s', '%d')", key, i))
+		owners[partitioner.WorkerFor(key)] = true
+		if i != 2 {
+			expected = append(expected, key)
+		}
+	}
+	if len(owners) < 2 {
+		t.Fatalf("expected keys on several shards, got: %v", owners)
+	}
+
+	// Updating keeps the position, deleting and adding again moves the key to the end.
+	process("k0", "addItem('k0', 'updated')")
+	process("k2", "deleteItem('k2')")
+	process("k2", "addItem('k2', 'again')")
+	expected = append(expected, "k2")
+
+	reply := cp.ExecuteHeld(cmdParser.Command{Type: cmdParser.GetAllItems})
+	var keys []string
+	for _, item := range reply.Value.([]ds.KeyValue) {
+		keys = append(keys, item.Key)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys in insertion order: %v, got: %v", expected, keys)
+	}
+}
+
+func TestCommandsProcessor_GetAllItemsPage(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		processOne(t, cp, 1, fmt.Sprintf("addItem('%s', 'v')", key))
+	}
+
+	tests := []struct {
+		command      string
+		expectedKeys []string
+	}{
+		{"getAllItems()", []string{"a", "b", "c", "d"}},
+		{"getAllItems(1)", []string{"b", "c", "d"}},
+		{"getAllItems(1, 2)", []string{"b", "c"}},
+		{"getAllItems(limit=10)", []string{"a", "b", "c", "d"}},
+		{"getAllItems(4)", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			reply := cp.ExecuteHeld(newRequest(t, queueservice.Message{Body: tt.command}).Command)
+			keys := []string{}
+			for _, item := range reply.Value.([]ds.KeyValue) {
+				keys = append(keys, item.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.expectedKeys) {
+				t.Errorf("expected keys: %v, got: %v", tt.expectedKeys, keys)
+			}
+		})
+	}
+}
+
+func TestCommandsProcessor_ScanIsStableUnderChanges(t *testing.T) {
+	partitioner := ds.NewPartitioner(3)
+	cp := NewCommandsProcessor(ds.NewShardedMap(partitioner), nil, nil, partitioner)
+	process := func(key string, body string) {
+		processOne(t, cp, partitioner.WorkerFor(key), body)
+	}
+
+	surviving := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		process(key, fmt.Sprintf("addItem('%s', 'v')", key))
+		surviving[key] = i%5 != 0
+		process("tmp", fmt.Sprintf("addItem('tmp:%d', 'v')", i))
+	}
+
+	seen := make(map[string]int)
+	var cursor uint64
+	for page := 0; ; page++ {
+		reply := cp.ExecuteHeld(newRequest(t, queueservice.Message{Body: fmt.Sprintf("scan(%d, 7, match='user:*')", cursor)}).Command)
+		result := reply.Value.(protocol.Page)
+		for _, item := range result.Items.([]ds.KeyValue) {
+			seen[item.Key]++
+		}
+
+		// Change the store between pages: delete keys ahead of and behind the
+		// cursor, and add new ones.
+		deleted := fmt.Sprintf("user:%d", page*5)
+		process(deleted, fmt.Sprintf("deleteItem('%s')", deleted))
+		added := fmt.Sprintf("user:new%d", page)
+		process(added, fmt.Sprintf("addItem('%s', 'v')", added))
+
+		if result.Cursor == 0 {
+			break
+		}
+		if result.Cursor <= cursor {
+			t.Fatalf("expected cursor to advance past %d, got: %d", cursor, result.Cursor)
+		}
+		cursor = result.Cursor
+	}
+
+	for key, survives := range surviving {
+		if survives && seen[key] != 1 {
+			t.Errorf("expected surviving key %s to be returned once, got %d times", key, seen[key])
+		}
+	}
+	for key, times := range seen {
+		if times > 1 {
+			t.Errorf("expected key %s to be returned at most once, got %d times", key, times)
+		}
+	}
+	for key := range seen {
+		if !glob.Match("user:*", key) {
+			t.Errorf("expected only keys matching the pattern, got: %s", key)
+		}
+	}
+}
+
+func TestCommandsProcessor_KeyQueries(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%v", indexed), func(t *testing.T) {
+			partitioner := ds.NewPartitioner(3)
+			store := ds.NewShardedMap(partitioner)
+			if indexed {
+				store.IndexKeys()
+			}
+			cp := NewCommandsProcessor(store, nil, nil, partitioner)
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			cp.now = func() time.Time { return now }
+
+			for _, body := range []string{
+				"addItem('user:42:profile', 'p')",
+				"addItem('tmp:1', 't')",
+				"addItem('user:42:settings', 's')",
+				"addItem('user:7', 'u')",
+				"addItem('tmp:2', 't', ttl='1s')",
+				"addItem('user:42:cart', 'c')",
+			} {
+				cmd := newRequest(t, queueservice.Message{Body: body}).Command
+				processOne(t, cp, partitioner.WorkerFor(cmd.Key), body)
+			}
+			now = now.Add(2 * time.Second)
+
+			query := func(body string) protocol.Reply {
+				return cp.ExecuteHeld(newRequest(t, queueservice.Message{Body: body}).Command)
+			}
+
+			var keys []string
+			for _, item := range query("getItemsByPrefix('user:42:')").Value.([]ds.KeyValue) {
+				keys = append(keys, item.Key)
+			}
+			if expected := []string{"user:42:profile", "user:42:settings", "user:42:cart"}; !reflect.DeepEqual(keys, expected) {
+				t.Errorf("expected keys in insertion order: %v, got: %v", expected, keys)
+			}
+
+			tests := []struct {
+				command  string
+				expected int
+			}{
+				{"countItems('user:*')", 4},
+				{"countItems('*:profile')", 1},
+				{"countItems('tmp:*')", 1},
+				// The expired key is removed but not counted.
+				{"deleteItems('tmp:*')", 1},
+				{"countItems('tmp:*')", 0},
+				{"countItems('*')", 4},
+			}
+			for _, tt := range tests {
+				if reply := query(tt.command); reply.Status != protocol.StatusOK || reply.Value != tt.expected {
+					t.Errorf("expected %s to return %d, got: %+v", tt.command, tt.expected, reply)
+				}
+			}
+			if items := store.WithPrefix("tmp:"); len(items) != 0 {
+				t.Errorf("expected all tmp keys to be removed, got: %+v", items)
+			}
+		})
+	}
+}
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []keyspace.Event
+}
+
+func (n *recordingNotifier) Notify(event keyspace.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+}
+
+func (n *recordingNotifier) take() []keyspace.Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	events := n.events
+	n.events = nil
+	return events
+}
+
+func TestCommandsProcessor_NotifiesChanges(t *testing.T) {
+	notifier := &recordingNotifier{}
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, notifier, ds.NewPartitioner(3))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cp.now = func() time.Time { return now }
+
+	processOne(t, cp, 1, "addItem('a', '1')")
+	processOne(t, cp, 1, "addItem('a', '2')")
+	processOne(t, cp, 1, "incrItem('n', 5)")
+	processOne(t, cp, 1, "deleteItem('a')")
+	processOne(t, cp, 1, "deleteItem('a')")
+	processOne(t, cp, 1, "getItem('n')")
+	processOne(t, cp, 1, "addItem('t', 'x', ttl='30s')")
+	processOne(t, cp, 1, "addItem('u', 'y', ttl='30s')")
+
+	now = now.Add(31 * time.Second)
+	processOne(t, cp, 1, "addItem('t', 'z')")
+	cp.sweep(1)
+
+	expected := []keyspace.Event{
+		{Type: keyspace.EventAdd, Key: "a", Value: "1", Version: 1},
+		{Type: keyspace.EventUpdate, Key: "a", Value: "2", Version: 2},
+		{Type: keyspace.EventAdd, Key: "n", Value: "5", Version: 3},
+		{Type: keyspace.EventDelete, Key: "a"},
+		{Type: keyspace.EventAdd, Key: "t", Value: "x", Version: 5},
+		{Type: keyspace.EventAdd, Key: "u", Value: "y", Version: 6},
+		{Type: keyspace.EventExpire, Key: "t"},
+		{Type: keyspace.EventAdd, Key: "t", Value: "z", Version: 8},
+		{Type: keyspace.EventExpire, Key: "u"},
+	}
+	if events := notifier.take(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events: %+v, got: %+v", expected, events)
+	}
+
+	transaction := func(body string) protocol.Reply {
+		req := newRequest(t, queueservice.Message{Body: body})
+		return cp.ExecuteHeld(req.Command)
+	}
+
+	transaction("transaction(addItem('b', '1'), casItem('n', 1, 'x'))")
+	if events := notifier.take(); len(events) != 0 {
+		t.Errorf("expected no events of an aborted transaction, got: %+v", events)
+	}
+
+	// Changes of a transaction are notified once it is committed, with its version.
+	transaction("transaction(addItem('b', '1'), deleteItem('n'))")
+	transaction("deleteItems('*')")
+	expected = []keyspace.Event{
+		{Type: keyspace.EventAdd, Key: "b", Value: "1", Version: 10},
+		{Type: keyspace.EventDelete, Key: "n"},
+		{Type: keyspace.EventDelete, Key: "t"},
+		{Type: keyspace.EventDelete, Key: "b"},
+	}
+	if events := notifier.take(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events: %+v, got: %+v", expected, events)
+	}
+}
+
+func TestCommandsProcessor_Lists(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	notifier := &recordingNotifier{}
+	cp := NewCommandsProcessor(store, nil, notifier, ds.NewPartitioner(3))
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"llen('l')", protocol.Reply{Status: protocol.StatusOK, Command: "llen", Key: "l", Value: float64(0)}},
+		{"lrange('l', 0, -1)", protocol.Reply{Status: protocol.StatusOK, Command: "lrange", Key: "l", Value: []interface{}{}}},
+		{"rpush('l', 'b', 'c')", protocol.Reply{Status: protocol.StatusOK, Command: "rpush", Key: "l", Value: float64(2), Version: 1}},
+		{"lpush('l', 'a', 'z')", protocol.Reply{Status: protocol.StatusOK, Command: "lpush", Key: "l", Value: float64(4), Existed: true, Version: 2}},
+		{"getItem('l')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "l", Value: []interface{}{"z", "a", "b", "c"}, Type: "list", Existed: true, Version: 2}},
+		{"lrange('l', 1, -2)", protocol.Reply{Status: protocol.StatusOK, Command: "lrange", Key: "l", Value: []interface{}{"a", "b"}, Existed: true}},
+		{"lpop('l')", protocol.Reply{Status: protocol.StatusOK, Command: "lpop", Key: "l", Value: "z", Existed: true, Version: 3}},
+		{"rpop('l', 2)", protocol.Reply{Status: protocol.StatusOK, Command: "rpop", Key: "l", Value: []interface{}{"c", "b"}, Existed: true, Version: 4}},
+		{"getAllItems()", protocol.Reply{Status: protocol.StatusOK, Command: "getAllItems", Value: []interface{}{map[string]interface{}{"Key": "l", "Value": []interface{}{"a"}}}}},
+		{"incrItem('l', 1)", protocol.Reply{Status: protocol.StatusError, Command: "incrItem", Key: "l", ErrorCode: protocol.ErrWrongType, Error: "l holds a list, not a string"}},
+		// Popping the last value removes the key.
+		{"rpop('l', 5)", protocol.Reply{Status: protocol.StatusOK, Command: "rpop", Key: "l", Value: []interface{}{"a"}, Existed: true}},
+		{"lpop('l')", protocol.Reply{Status: protocol.StatusError, Command: "lpop", Key: "l", ErrorCode: protocol.ErrKeyNotFound, Error: "key not found: l"}},
+		{"addItem('s', 'text')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "s", Version: 6}},
+		{"lpush('s', 'a')", protocol.Reply{Status: protocol.StatusError, Command: "lpush", Key: "s", ErrorCode: protocol.ErrWrongType, Error: "s holds a string, not a list"}},
+		{"llen('s')", protocol.Reply{Status: protocol.StatusError, Command: "llen", Key: "s", ErrorCode: protocol.ErrWrongType, Error: "s holds a string, not a list"}},
+		{"rpush('s2', 'x')", protocol.Reply{Status: protocol.StatusOK, Command: "rpush", Key: "s2", Value: float64(1), Version: 7}},
+		// Writing a string replaces the list.
+		{"addItem('s2', 'y')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "s2", Previous: []interface{}{"x"}, Existed: true, Version: 8}},
+	}
+
+	for _, tt := range tests {
+		if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+			t.Errorf("%s: expected reply: %+v, got: %+v", tt.command, tt.expectedReply, reply)
+		}
+	}
+
+	expected := []keyspace.Event{
+		{Type: keyspace.EventAdd, Key: "l", Version: 1},
+		{Type: keyspace.EventUpdate, Key: "l", Version: 2},
+		{Type: keyspace.EventUpdate, Key: "l", Version: 3},
+		{Type: keyspace.EventUpdate, Key: "l", Version: 4},
+		{Type: keyspace.EventDelete, Key: "l"},
+		{Type: keyspace.EventAdd, Key: "s", Value: "text", Version: 6},
+		{Type: keyspace.EventAdd, Key: "s2", Version: 7},
+		{Type: keyspace.EventUpdate, Key: "s2", Value: "y", Version: 8},
+	}
+	if events := notifier.take(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events: %+v, got: %+v", expected, events)
+	}
+}
+
+func TestCommandsProcessor_Hashes(t *testing.T) {
+	store := ds.NewShardedMap(ds.NewPartitioner(3))
+	notifier := &recordingNotifier{}
+	cp := NewCommandsProcessor(store, nil, notifier, ds.NewPartitioner(3))
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"hgetall('u')", protocol.Reply{Status: protocol.StatusOK, Command: "hgetall", Key: "u", Value: map[string]interface{}{}}},
+		{"hset('u', 'name', 'Ann')", protocol.Reply{Status: protocol.StatusOK, Command: "hset", Key: "u", Value: float64(1), Version: 1}},
+		{"hset('u', 'city', 'Varna')", protocol.Reply{Status: protocol.StatusOK, Command: "hset", Key: "u", Value: float64(1), Existed: true, Version: 2}},
+		{"hset('u', 'city', 'Sofia')", protocol.Reply{Status: protocol.StatusOK, Command: "hset", Key: "u", Value: float64(0), Existed: true, Version: 3}},
+		{"hget('u', 'city')", protocol.Reply{Status: protocol.StatusOK, Command: "hget", Key: "u", Value: "Sofia", Existed: true}},
+		{"hget('u', 'age')", protocol.Reply{Status: protocol.StatusError, Command: "hget", Key: "u", ErrorCode: protocol.ErrKeyNotFound, Error: "field not found: age"}},
+		{"hincr('u', 'visits', 5)", protocol.Reply{Status: protocol.StatusOK, Command: "hincr", Key: "u", Value: float64(5), Existed: true, Version: 4}},
+		{"hincr('u', 'visits', -2)", protocol.Reply{Status: protocol.StatusOK, Command: "hincr", Key: "u", Value: float64(3), Existed: true, Version: 5}},
+		{"hincr('u', 'name', 1)", protocol.Reply{Status: protocol.StatusError, Command: "hincr", Key: "u", ErrorCode: protocol.ErrNotInteger, Error: `value is not an integer: field name holds "Ann"`}},
+		{"hincr('u', 'visits', 9223372036854775807)", protocol.Reply{Status: protocol.StatusError, Command: "hincr", Key: "u", ErrorCode: protocol.ErrIntegerOverflow, Error: "integer overflow: field visits would be 3 +9223372036854775807"}},
+		{"getItem('u')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "u", Value: map[string]interface{}{"name": "Ann", "city": "Sofia", "visits": "3"}, Type: "hash", Existed: true, Version: 5}},
+		{"hdel('u', 'age')", protocol.Reply{Status: protocol.StatusOK, Command: "hdel", Key: "u", Value: float64(0), Existed: true}},
+		{"hdel('u', 'name', 'age')", protocol.Reply{Status: protocol.StatusOK, Command: "hdel", Key: "u", Value: float64(1), Existed: true, Version: 6}},
+		{"lpush('u', 'a')", protocol.Reply{Status: protocol.StatusError, Command: "lpush", Key: "u", ErrorCode: protocol.ErrWrongType, Error: "u holds a hash, not a list"}},
+		{"addItem('s', 'text')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "s", Version: 7}},
+		{"hget('s', 'a')", protocol.Reply{Status: protocol.StatusError, Command: "hget", Key: "s", ErrorCode: protocol.ErrWrongType, Error: "s holds a string, not a hash"}},
+		// Removing the last field removes the key.
+		{"hdel('u', 'city', 'visits')", protocol.Reply{Status: protocol.StatusOK, Command: "hdel", Key: "u", Value: float64(2), Existed: true}},
+		{"hdel('u', 'city')", protocol.Reply{Status: protocol.StatusOK, Command: "hdel", Key: "u", Value: float64(0)}},
+	}
+
+	for _, tt := range tests {
+		if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+			t.Errorf("%s: expected reply: %+v, got: %+v", tt.command, tt.expectedReply, reply)
+		}
+	}
+
+	if events := notifier.take(); len(events) != 8 || events[6].Type != keyspace.EventAdd || events[7].Type != keyspace.EventDelete {
+		t.Errorf("expected 6 hash events, an add of s and a delete of u, got: %+v", events)
+	}
+}
+
+func TestCommandsProcessor_HashKeepsFieldOrder(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(1)), nil, nil, ds.NewPartitioner(1))
+
+	for _, command := range []string{"hset('u', 'z', '1')", "hset('u', 'a', '2')", "hset('u', 'm', '3')", "hdel('u', 'a')", "hset('u', 'a', '4')", "hset('u', 'z', '5')"} {
+		processOne(t, cp, 0, command)
+	}
+	data, err := json.Marshal(cp.execute(0, newRequest(t, queueservice.Message{Body: "hgetall('u')"}).Command).Value)
+	if err != nil {
+		t.Fatalf("failed to encode fields: %v", err)
+	}
+	if string(data) != `{"z":"5","m":"3","a":"4"}` {
+		t.Errorf("expected fields in insertion order, got: %s", data)
+	}
+}
+
+func TestCommandsProcessor_Sets(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"scard('s')", protocol.Reply{Status: protocol.StatusOK, Command: "scard", Key: "s", Value: float64(0)}},
+		{"sadd('s', 'b', 'a', 'b')", protocol.Reply{Status: protocol.StatusOK, Command: "sadd", Key: "s", Value: float64(2), Version: 1}},
+		{"sadd('s', 'c', 'a')", protocol.Reply{Status: protocol.StatusOK, Command: "sadd", Key: "s", Value: float64(1), Existed: true, Version: 2}},
+		{"sismember('s', 'a')", protocol.Reply{Status: protocol.StatusOK, Command: "sismember", Key: "s", Value: true, Existed: true}},
+		{"sismember('s', 'x')", protocol.Reply{Status: protocol.StatusOK, Command: "sismember", Key: "s", Value: false, Existed: true}},
+		{"smembers('s')", protocol.Reply{Status: protocol.StatusOK, Command: "smembers", Key: "s", Value: []interface{}{"a", "b", "c"}, Existed: true}},
+		{"srem('s', 'x')", protocol.Reply{Status: protocol.StatusOK, Command: "srem", Key: "s", Value: float64(0), Existed: true}},
+		{"srem('s', 'a', 'x')", protocol.Reply{Status: protocol.StatusOK, Command: "srem", Key: "s", Value: float64(1), Existed: true, Version: 3}},
+		{"getItem('s')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "s", Value: []interface{}{"b", "c"}, Type: "set", Existed: true, Version: 3}},
+		{"zadd('s', 1, 'a')", protocol.Reply{Status: protocol.StatusError, Command: "zadd", Key: "s", ErrorCode: protocol.ErrWrongType, Error: "s holds a set, not a zset"}},
+		// Removing the last member removes the key.
+		{"srem('s', 'b', 'c')", protocol.Reply{Status: protocol.StatusOK, Command: "srem", Key: "s", Value: float64(2), Existed: true}},
+		{"smembers('s')", protocol.Reply{Status: protocol.StatusOK, Command: "smembers", Key: "s", Value: []interface{}{}}},
+	}
+
+	for _, tt := range tests {
+		if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+			t.Errorf("%s: expected reply: %+v, got: %+v", tt.command, tt.expectedReply, reply)
+		}
+	}
+}
+
+func TestCommandsProcessor_SortedSets(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
+
+	member := func(name string, score float64) interface{} {
+		return map[string]interface{}{"member": name, "score": score}
+	}
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"zrange('z', 0, -1)", protocol.Reply{Status: protocol.StatusOK, Command: "zrange", Key: "z", Value: []interface{}{}}},
+		{"zadd('z', 30, 'carol')", protocol.Reply{Status: protocol.StatusOK, Command: "zadd", Key: "z", Value: float64(1), Version: 1}},
+		{"zadd('z', 10, 'alice')", protocol.Reply{Status: protocol.StatusOK, Command: "zadd", Key: "z", Value: float64(1), Existed: true, Version: 2}},
+		{"zadd('z', 20.5, 'bob')", protocol.Reply{Status: protocol.StatusOK, Command: "zadd", Key: "z", Value: float64(1), Existed: true, Version: 3}},
+		{"zadd('z', 40, 'alice')", protocol.Reply{Status: protocol.StatusOK, Command: "zadd", Key: "z", Value: float64(0), Existed: true, Version: 4}},
+		{"zrange('z', 0, -1)", protocol.Reply{Status: protocol.StatusOK, Command: "zrange", Key: "z", Value: []interface{}{member("bob", 20.5), member("carol", 30), member("alice", 40)}, Existed: true}},
+		{"zrange('z', -1, -1)", protocol.Reply{Status: protocol.StatusOK, Command: "zrange", Key: "z", Value: []interface{}{member("alice", 40)}, Existed: true}},
+		{"zrank('z', 'carol')", protocol.Reply{Status: protocol.StatusOK, Command: "zrank", Key: "z", Value: float64(1), Existed: true}},
+		{"zrank('z', 'dave')", protocol.Reply{Status: protocol.StatusError, Command: "zrank", Key: "z", ErrorCode: protocol.ErrKeyNotFound, Error: "member not found: dave"}},
+		{"zrem('z', 'carol', 'dave')", protocol.Reply{Status: protocol.StatusOK, Command: "zrem", Key: "z", Value: float64(1), Existed: true, Version: 5}},
+		{"getItem('z')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "z", Value: []interface{}{member("bob", 20.5), member("alice", 40)}, Type: "zset", Existed: true, Version: 5}},
+		{"sadd('z', 'a')", protocol.Reply{Status: protocol.StatusError, Command: "sadd", Key: "z", ErrorCode: protocol.ErrWrongType, Error: "z holds a zset, not a set"}},
+		{"zrem('z', 'bob', 'alice')", protocol.Reply{Status: protocol.StatusOK, Command: "zrem", Key: "z", Value: float64(2), Existed: true}},
+		{"zrem('z', 'bob')", protocol.Reply{Status: protocol.StatusOK, Command: "zrem", Key: "z", Value: float64(0)}},
+	}
+
+	for _, tt := range tests {
+		if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+			t.Errorf("%s: expected reply: %+v, got: %+v", tt.command, tt.expectedReply, reply)
+		}
+	}
+}
+
+func TestCommandsProcessor_JSONDocuments(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(3)), nil, nil, ds.NewPartitioner(3))
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"jsonGet('k')", protocol.Reply{Status: protocol.StatusError, Command: "jsonGet", Key: "k", ErrorCode: protocol.ErrKeyNotFound, Error: "key not found: k"}},
+		{`jsonSet('k', '$', '{"name":"Ann","items":[1,2.50,3]}')`, protocol.Reply{Status: protocol.StatusOK, Command: "jsonSet", Key: "k", Version: 1}},
+		{`jsonSet('k', '$.address.city', '"Sofia"')`, protocol.Reply{Status: protocol.StatusOK, Command: "jsonSet", Key: "k", Existed: true, Version: 2}},
+		{"jsonGet('k', '$.address')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonGet", Key: "k", Value: map[string]interface{}{"city": "Sofia"}, Existed: true}},
+		{"jsonGet('k', '$.items[1]')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonGet", Key: "k", Value: 2.5, Existed: true}},
+		{"jsonGet('k', '$.items[5]')", protocol.Reply{Status: protocol.StatusError, Command: "jsonGet", Key: "k", ErrorCode: protocol.ErrKeyNotFound, Error: "path not found: $.items[5]"}},
+		{`jsonSet('k', '$.name.first', '"Ann"')`, protocol.Reply{Status: protocol.StatusError, Command: "jsonSet", Key: "k", ErrorCode: protocol.ErrInvalidArgument, Error: "$.name: not an object or an array"}},
+		{"jsonDel('k', '$.items[0]')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonDel", Key: "k", Value: float64(1), Existed: true, Version: 3}},
+		{"jsonDel('k', '$.missing')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonDel", Key: "k", Value: float64(0), Existed: true}},
+		{"getItem('k')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "k", Value: map[string]interface{}{
+			"name": "Ann", "items": []interface{}{2.5, float64(3)}, "address": map[string]interface{}{"city": "Sofia"},
+		}, Type: "json", Existed: true, Version: 3}},
+		{"addItem('s', 'text')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "s", Version: 4}},
+		{"jsonGet('s')", protocol.Reply{Status: protocol.StatusError, Command: "jsonGet", Key: "s", ErrorCode: protocol.ErrWrongType, Error: "s holds a string, not a json"}},
+		{"jsonDel('k')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonDel", Key: "k", Value: float64(1), Existed: true}},
+		{"jsonDel('k')", protocol.Reply{Status: protocol.StatusOK, Command: "jsonDel", Key: "k", Value: float64(0)}},
+	}
+
+	for _, tt := range tests {
+		if reply := processOne(t, cp, 1, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+			t.Errorf("%s: expected reply: %+v, got: %+v", tt.command, tt.expectedReply, reply)
+		}
+	}
+}
+
+func TestCommandsProcessor_InvalidArgumentsAreNotDeadLettered(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(1)), nil, nil, ds.NewPartitioner(1))
+	processOne(t, cp, 0, `jsonSet('k', '$', '{"name":"Ann","items":[1]}')`)
+
+	tests := []struct {
+		name    string
+		request protocol.Request
+		error   string
+	}{
+		// The parser rejects such paths, the processor must still not dead-letter them.
+		{"InvalidPath", protocol.Request{Command: cmdParser.Command{Type: cmdParser.JSONGet, Key: "k", Path: "name"}},
+			`invalid path "name": path must start at the root $`},
+		{"FieldOfString", newRequest(t, queueservice.Message{Body: `jsonSet('k', '$.name.first', '"Ann"')`}),
+			"$.name: not an object or an array"},
+		{"FieldOfArray", newRequest(t, queueservice.Message{Body: `jsonSet('k', '$.items.first', '1')`}),
+			"$.items.first: cannot get a field of an array"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan protocol.Request, 1)
+			replies := make(chan queueservice.Message, 1)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go cp.Process(0, requests, replies, &wg)
+
+			requests <- tt.request
+			close(requests)
+			wg.Wait()
+
+			msg := <-replies
+			if msg.Failed || msg.DeadLetter != nil {
+				t.Errorf("expected the request not to be dead-lettered, got: %+v", msg)
+			}
+			reply, err := protocol.Decode(msg.Body)
+			if err != nil {
+				t.Fatalf("failed to decode reply: %v", err)
+			}
+			if reply.ErrorCode != protocol.ErrInvalidArgument || reply.Error != tt.error {
+				t.Errorf("expected error %s %q, got: %s %q", protocol.ErrInvalidArgument, tt.error, reply.ErrorCode, reply.Error)
+			}
+		})
+	}
+}
+
+func TestCommandsProcessor_GetAllItemsEmbedsJSON(t *testing.T) {
+	cp := NewCommandsProcessor(ds.NewShardedMap(ds.NewPartitioner(1)), nil, nil, ds.NewPartitioner(1))
+
+	processOne(t, cp, 0, `addItem('s', '{"a":1}')`)
+	processOne(t, cp, 0, `jsonSet('d', '$', '{"a":1.0,"b":[true,null]}')`)
+	data, err := json.Marshal(cp.execute(0, newRequest(t, queueservice.Message{Body: "getAllItems()"}).Command).Value)
+	if err != nil {
+		t.Fatalf("failed to encode items: %v", err)
+	}
+	// Strings stay escaped, while documents are embedded with their numbers as written.
+	expected := `[{"Key":"s","Value":"{\"a\":1}"},{"Key":"d","Value":{"a":1.0,"b":[true,null]}}]`
+	if string(data) != expected {
+		t.Errorf("expected items: %s, got: %s", expected, data)
+	}
 }
@@ -0,0 +1,40 @@
+package commandsprocessor
+
+import (
+	"container/heap"
+	"time"
+)
+
+type expiryEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryQueue is a min-heap of expiry deadlines for the keys owned by one worker.
+// Entries are not removed when a key is overwritten, deleted or given a new TTL;
+// the sweeper discards them once it finds they no longer match the store.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].expiresAt.Before(q[j].expiresAt) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+func (q *expiryQueue) schedule(key string, expiresAt time.Time) {
+	heap.Push(q, expiryEntry{key: key, expiresAt: expiresAt})
+}
+
+// due pops the earliest entry if it has expired by now.
+func (q *expiryQueue) due(now time.Time) (expiryEntry, bool) {
+	if q.Len() == 0 || (*q)[0].expiresAt.After(now) {
+		return expiryEntry{}, false
+	}
+	return heap.Pop(q).(expiryEntry), true
+}
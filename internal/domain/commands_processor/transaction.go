@@ -0,0 +1,244 @@
+package commandsprocessor
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	cmd_parser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/persistence"
+)
+
+// pendingVersion stands in for the version of values written by a transaction
+// until its batch record is logged and its sequence number is known.
+const pendingVersion = math.MaxUint64
+
+// executeTransaction applies the commands of a transaction all or none. The commands
+// first run against a staging area on top of the store; only if all of them succeed
+// are their mutations logged as one batch record and applied, and their changes notified.
+func (cp *commandsProcessor) executeTransaction(cmd cmd_parser.Command) protocol.Reply {
+	reply := protocol.OK(cmd.Type.String(), "")
+
+	defer cp.lockShards(cp.shardsOf(cmd.Commands), true)()
+
+	staged := newStagedStore(cp.dataStore)
+	var records []persistence.Record
+	stage := func(record persistence.Record) (uint64, error) {
+		records = append(records, record)
+		return pendingVersion, nil
+	}
+	var events []keyspace.Event
+	stageEvent := func(event keyspace.Event) {
+		events = append(events, event)
+	}
+
+	results := make([]protocol.Reply, len(cmd.Commands))
+	for i, sub := range cmd.Commands {
+		ex := &execution{
+			cp:          cp,
+			processorID: cp.partitioner.WorkerFor(sub.Key),
+			store:       staged,
+			logMutation: stage,
+			notify:      stageEvent,
+		}
+		results[i] = ex.apply(sub)
+		if results[i].Status != protocol.StatusOK {
+			return protocol.Error(reply.Command, "", results[i].ErrorCode, "command %d (%s) aborted the transaction: %s", i+1, sub.Type, results[i].Error)
+		}
+	}
+
+	if len(records) > 0 {
+		batch := persistence.Record{Op: persistence.OpBatch, Records: records}
+		seq, err := cp.logMutation(batch)
+		if err != nil {
+			log.Printf("Failed to log transaction: %v", err)
+			return protocol.Error(reply.Command, "", protocol.ErrPersistenceFailed, "%v", err)
+		}
+		batch.Seq = seq
+		if err := persistence.Apply(cp.dataStore, batch); err != nil {
+			return protocol.Error(reply.Command, "", protocol.ErrInternal, "%v", err)
+		}
+		for i := range results {
+			if results[i].Version == pendingVersion {
+				results[i].Version = seq
+			}
+		}
+		for _, event := range events {
+			if event.Version == pendingVersion {
+				event.Version = seq
+			}
+			cp.notify(event)
+		}
+	}
+
+	reply.Value = results
+	return export(reply)
+}
+
+// shardsOf returns the shards owning the keys of the commands in ascending order.
+func (cp *commandsProcessor) shardsOf(commands []cmd_parser.Command) []int {
+	owned := make(map[int]bool)
+	for _, sub := range commands {
+		owned[cp.partitioner.WorkerFor(sub.Key)] = true
+	}
+	shards := make([]int, 0, len(owned))
+	for shard := range owned {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// stagedItem is an item as seen by a transaction; nil marks a deleted key.
+type stagedItem struct {
+	value     interface{}
+	expiresAt time.Time
+	version   uint64
+	inserted  uint64
+}
+
+// stagedStore buffers the writes of a transaction on top of the store, which it
+// never modifies. Items are copied in on first access.
+type stagedStore struct {
+	base  KeyValueStorage
+	items map[string]*stagedItem
+	// appended lists keys added after being deleted or missing, in order.
+	appended []string
+}
+
+func newStagedStore(base KeyValueStorage) *stagedStore {
+	return &stagedStore{
+		base:  base,
+		items: make(map[string]*stagedItem),
+	}
+}
+
+func (s *stagedStore) load(key string) (*stagedItem, bool) {
+	if item, staged := s.items[key]; staged {
+		return item, item != nil
+	}
+	value, exists := s.base.Get(key)
+	if !exists {
+		return nil, false
+	}
+	expiresAt, _ := s.base.Expiry(key)
+	version, _ := s.base.Version(key)
+	item := &stagedItem{value: value, expiresAt: expiresAt, version: version}
+	s.items[key] = item
+	return item, true
+}
+
+func (s *stagedStore) Add(key string, value interface{}, seq uint64) {
+	if item, exists := s.load(key); exists {
+		item.value = value
+		item.expiresAt = time.Time{}
+		return
+	}
+	s.items[key] = &stagedItem{value: value, inserted: seq}
+	s.appended = append(s.appended, key)
+}
+
+func (s *stagedStore) Remove(key string) {
+	s.items[key] = nil
+	for i, appended := range s.appended {
+		if appended == key {
+			s.appended = append(s.appended[:i], s.appended[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *stagedStore) Get(key string) (interface{}, bool) {
+	if item, exists := s.load(key); exists {
+		return item.value, true
+	}
+	return nil, false
+}
+
+func (s *stagedStore) SetExpiry(key string, expiresAt time.Time) bool {
+	item, exists := s.load(key)
+	if exists {
+		item.expiresAt = expiresAt
+	}
+	return exists
+}
+
+func (s *stagedStore) Expiry(key string) (time.Time, bool) {
+	if item, exists := s.load(key); exists {
+		return item.expiresAt, true
+	}
+	return time.Time{}, false
+}
+
+func (s *stagedStore) SetVersion(key string, version uint64) bool {
+	item, exists := s.load(key)
+	if exists {
+		item.version = version
+	}
+	return exists
+}
+
+func (s *stagedStore) Version(key string) (uint64, bool) {
+	if item, exists := s.load(key); exists {
+		return item.version, true
+	}
+	return 0, false
+}
+
+// GetAll returns the items the store would hold after the transaction, in order.
+func (s *stagedStore) GetAll() []ds.KeyValue {
+	fresh := make(map[string]bool, len(s.appended))
+	for _, key := range s.appended {
+		fresh[key] = true
+	}
+
+	var items []ds.KeyValue
+	for _, item := range s.base.GetAll() {
+		if fresh[item.Key] {
+			continue
+		}
+		if staged, ok := s.items[item.Key]; ok {
+			if staged == nil {
+				continue
+			}
+			item = ds.KeyValue{Key: item.Key, Value: staged.value, ExpiresAt: staged.expiresAt, Version: staged.version, Inserted: item.Inserted}
+		}
+		items = append(items, item)
+	}
+	for _, key := range s.appended {
+		staged := s.items[key]
+		items = append(items, ds.KeyValue{Key: key, Value: staged.value, ExpiresAt: staged.expiresAt, Version: staged.version, Inserted: staged.inserted})
+	}
+	return items
+}
+
+// WithPrefix returns the items GetAll returns whose key starts with prefix.
+func (s *stagedStore) WithPrefix(prefix string) []ds.KeyValue {
+	var items []ds.KeyValue
+	for _, item := range s.GetAll() {
+		if strings.HasPrefix(item.Key, prefix) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ScanAfter returns the items GetAll returns the way ds.OrderedMap.ScanAfter does.
+func (s *stagedStore) ScanAfter(seq uint64, count int) []ds.KeyValue {
+	var items []ds.KeyValue
+	for _, item := range s.GetAll() {
+		if item.Inserted <= seq {
+			continue
+		}
+		if len(items) >= count && item.Inserted != items[len(items)-1].Inserted {
+			break
+		}
+		items = append(items, item)
+	}
+	return items
+}
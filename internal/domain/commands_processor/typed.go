@@ -0,0 +1,374 @@
+package commandsprocessor
+
+import (
+	"errors"
+	"strconv"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	cmd_parser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/jsonpath"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/domain/values"
+	"github.com/avalkov/SCS/internal/persistence"
+)
+
+// list applies lpush, rpush, lpop, rpop, lrange or llen to the list at cmd.Key.
+// Reading a missing key gives an empty list.
+func (ex *execution) list(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	switch cmd.Type {
+	case cmd_parser.LRange, cmd_parser.LLen:
+		value, exists := ex.live(cmd.Key)
+		if exists {
+			if err := values.Check(value, values.TypeList); err != nil {
+				return ex.updateFailed(reply, err)
+			}
+		}
+		list, _ := value.(*ds.List)
+		if list == nil {
+			list = ds.NewList()
+		}
+		if cmd.Type == cmd_parser.LLen {
+			reply.Value = list.Len()
+		} else {
+			reply.Value = list.Range(cmd.Start, cmd.Stop)
+		}
+		reply.Existed = exists
+		return reply
+	case cmd_parser.LPush:
+		return ex.push(cmd, values.LPush, reply)
+	case cmd_parser.RPush:
+		return ex.push(cmd, values.RPush, reply)
+	case cmd_parser.LPop:
+		return ex.pop(cmd, values.LPop, reply)
+	default:
+		return ex.pop(cmd, values.RPop, reply)
+	}
+}
+
+// push replies with the length of the list after pushing.
+func (ex *execution) push(cmd cmd_parser.Command, update string, reply protocol.Reply) protocol.Reply {
+	length, ok := ex.update(cmd.Key, update, cmd.Values, &reply)
+	if ok {
+		reply.Value = length
+	}
+	return reply
+}
+
+// pop replies with the popped value, or with a list of them when a count is given.
+func (ex *execution) pop(cmd cmd_parser.Command, update string, reply protocol.Reply) protocol.Reply {
+	if _, exists := ex.live(cmd.Key); !exists {
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key)
+	}
+	count := cmd.Count
+	if count == 0 {
+		count = 1
+	}
+	result, ok := ex.update(cmd.Key, update, []string{strconv.Itoa(count)}, &reply)
+	if !ok {
+		return reply
+	}
+	popped := result.([]string)
+	if cmd.Count == 0 {
+		reply.Value = popped[0]
+	} else {
+		reply.Value = popped
+	}
+	return reply
+}
+
+// hash applies hset, hget, hdel, hgetall or hincr to the hash at cmd.Key.
+// Reading a missing key gives an empty hash.
+func (ex *execution) hash(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	value, exists := ex.live(cmd.Key)
+	if exists {
+		if err := values.Check(value, values.TypeHash); err != nil {
+			return ex.updateFailed(reply, err)
+		}
+	}
+	hash, _ := value.(*ds.OrderedMap)
+	if hash == nil {
+		hash = ds.NewOrderedMap()
+	}
+
+	switch cmd.Type {
+	case cmd_parser.HGet:
+		field, ok := hash.Get(cmd.Field)
+		if !ok {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "field not found: %s", cmd.Field)
+		}
+		reply.Value, reply.Existed = field, true
+		return reply
+	case cmd_parser.HGetAll:
+		reply.Value, reply.Existed = values.Export(hash), exists
+		return reply
+	case cmd_parser.HDel:
+		// Nothing is logged unless a field is removed.
+		removes := false
+		for _, field := range cmd.Fields {
+			if _, ok := hash.Get(field); ok {
+				removes = true
+			}
+		}
+		if !removes {
+			reply.Value, reply.Existed = 0, exists
+			return reply
+		}
+		removed, ok := ex.update(cmd.Key, values.HDel, cmd.Fields, &reply)
+		if ok {
+			reply.Value = removed
+		}
+		return reply
+	case cmd_parser.HIncr:
+		next, ok := ex.update(cmd.Key, values.HIncr, []string{cmd.Field, strconv.FormatInt(cmd.Delta, 10)}, &reply)
+		if ok {
+			reply.Value = next
+		}
+		return reply
+	default:
+		added, ok := ex.update(cmd.Key, values.HSet, []string{cmd.Field, cmd.Value}, &reply)
+		if ok {
+			reply.Value = added
+		}
+		return reply
+	}
+}
+
+// set applies sadd, srem, sismember, smembers or scard to the set at cmd.Key.
+// Reading a missing key gives an empty set.
+func (ex *execution) set(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	value, exists := ex.live(cmd.Key)
+	if exists {
+		if err := values.Check(value, values.TypeSet); err != nil {
+			return ex.updateFailed(reply, err)
+		}
+	}
+	set, _ := value.(*ds.Set)
+	if set == nil {
+		set = ds.NewSet()
+	}
+	reply.Existed = exists
+
+	switch cmd.Type {
+	case cmd_parser.SIsMember:
+		reply.Value = set.Contains(cmd.Member)
+		return reply
+	case cmd_parser.SMembers:
+		reply.Value = set.Members()
+		return reply
+	case cmd_parser.SCard:
+		reply.Value = set.Len()
+		return reply
+	case cmd_parser.SRem:
+		return ex.removeMembers(cmd, values.SRem, set.Contains, reply)
+	default:
+		added, ok := ex.update(cmd.Key, values.SAdd, cmd.Members, &reply)
+		if ok {
+			reply.Value = added
+		}
+		return reply
+	}
+}
+
+// sortedSet applies zadd, zrange, zrank or zrem to the sorted set at cmd.Key.
+// Reading a missing key gives an empty sorted set.
+func (ex *execution) sortedSet(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	value, exists := ex.live(cmd.Key)
+	if exists {
+		if err := values.Check(value, values.TypeSortedSet); err != nil {
+			return ex.updateFailed(reply, err)
+		}
+	}
+	set, _ := value.(*ds.SortedSet)
+	if set == nil {
+		set = ds.NewSortedSet()
+	}
+	reply.Existed = exists
+
+	switch cmd.Type {
+	case cmd_parser.ZRange:
+		reply.Value = set.Range(cmd.Start, cmd.Stop)
+		return reply
+	case cmd_parser.ZRank:
+		rank, ok := set.Rank(cmd.Member)
+		if !ok {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "member not found: %s", cmd.Member)
+		}
+		reply.Value = rank
+		return reply
+	case cmd_parser.ZRem:
+		return ex.removeMembers(cmd, values.ZRem, func(member string) bool {
+			_, ok := set.Score(member)
+			return ok
+		}, reply)
+	default:
+		added, ok := ex.update(cmd.Key, values.ZAdd, []string{cmd.Member, values.FormatScore(cmd.Score)}, &reply)
+		if ok {
+			reply.Value = added
+		}
+		return reply
+	}
+}
+
+// json applies jsonSet, jsonGet or jsonDel to the JSON document at cmd.Key, at
+// its root unless the command has a path.
+func (ex *execution) json(cmd cmd_parser.Command, reply protocol.Reply) protocol.Reply {
+	path := cmd.Path
+	if path == "" {
+		path = "$"
+	}
+	if cmd.Type == cmd_parser.JSONSet {
+		ex.update(cmd.Key, values.JSONSet, []string{path, cmd.Value}, &reply)
+		return reply
+	}
+
+	value, exists := ex.live(cmd.Key)
+	if !exists {
+		if cmd.Type == cmd_parser.JSONDel {
+			reply.Value = 0
+			return reply
+		}
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "key not found: %s", cmd.Key)
+	}
+	if err := values.Check(value, values.TypeJSON); err != nil {
+		return ex.updateFailed(reply, err)
+	}
+	doc := value.(*values.Document)
+	parsed, err := jsonpath.Parse(path)
+	if err != nil {
+		return protocol.Error(reply.Command, cmd.Key, protocol.ErrInvalidArgument, "invalid path %q: %v", path, err)
+	}
+	reply.Existed = true
+
+	if cmd.Type == cmd_parser.JSONGet {
+		node, ok := doc.Get(parsed)
+		if !ok {
+			return protocol.Error(reply.Command, cmd.Key, protocol.ErrKeyNotFound, "path not found: %s", path)
+		}
+		reply.Value = node
+		return reply
+	}
+	// Nothing is logged unless the path exists.
+	if !doc.Has(parsed) {
+		reply.Value = 0
+		return reply
+	}
+	removed, ok := ex.update(cmd.Key, values.JSONDel, []string{path}, &reply)
+	if ok {
+		reply.Value = removed
+	}
+	return reply
+}
+
+// removeMembers applies srem or zrem, replying with the number of members
+// removed. Nothing is logged unless one of the members is present.
+func (ex *execution) removeMembers(cmd cmd_parser.Command, update string, contains func(string) bool, reply protocol.Reply) protocol.Reply {
+	present := false
+	for _, member := range cmd.Members {
+		if contains(member) {
+			present = true
+		}
+	}
+	if !present {
+		reply.Value = 0
+		return reply
+	}
+	removed, ok := ex.update(cmd.Key, update, cmd.Members, &reply)
+	if ok {
+		reply.Value = removed
+	}
+	return reply
+}
+
+// update logs and applies an update of the typed value at key, see values.Prepare.
+// The value is created if the key is missing and the key is removed once the value
+// is left empty. It returns the result of the update, or false after replacing the
+// reply with an error.
+func (ex *execution) update(key string, update string, args []string, reply *protocol.Reply) (interface{}, bool) {
+	if err := ex.purgeExpired(key); err != nil {
+		*reply = ex.persistenceFailed(*reply, err)
+		return nil, false
+	}
+	current, exists := ex.store.Get(key)
+	apply, err := values.Prepare(current, exists, update, args)
+	if err != nil {
+		*reply = ex.updateFailed(*reply, err)
+		return nil, false
+	}
+	version, err := ex.logMutation(persistence.Record{Op: persistence.OpUpdate, Key: key, Update: update, Args: args})
+	if err != nil {
+		*reply = ex.persistenceFailed(*reply, err)
+		return nil, false
+	}
+
+	value, result := apply()
+	reply.Existed = exists
+	if value == nil {
+		ex.store.Remove(key)
+		ex.notify(keyspace.Event{Type: keyspace.EventDelete, Key: key})
+		return result, true
+	}
+	if !exists {
+		ex.store.Add(key, value, version)
+	}
+	ex.store.SetVersion(key, version)
+	reply.Version = version
+
+	// Typed values are not sent along, as they may be large.
+	event := keyspace.Event{Type: keyspace.EventAdd, Key: key, Version: version}
+	if exists {
+		event.Type = keyspace.EventUpdate
+	}
+	ex.notify(event)
+	return result, true
+}
+
+// updateFailed replaces the reply with the error of an invalid update. The command
+// itself is well formed, so the error is the client's and is not dead-lettered.
+func (ex *execution) updateFailed(reply protocol.Reply, err error) protocol.Reply {
+	var wrongType *values.WrongTypeError
+	if errors.As(err, &wrongType) {
+		return protocol.Error(reply.Command, reply.Key, protocol.ErrWrongType, "%s holds a %s, not a %s", reply.Key, wrongType.Have, wrongType.Want)
+	}
+	if errors.Is(err, values.ErrNotInteger) {
+		return protocol.Error(reply.Command, reply.Key, protocol.ErrNotInteger, "%v", err)
+	}
+	if errors.Is(err, values.ErrIntegerOverflow) {
+		return protocol.Error(reply.Command, reply.Key, protocol.ErrIntegerOverflow, "%v", err)
+	}
+	return protocol.Error(reply.Command, reply.Key, protocol.ErrInvalidArgument, "%v", err)
+}
+
+// export replaces the typed values in the reply with copies, which can be encoded
+// once the shards are unlocked, and sets the type of a typed Value.
+func export(reply protocol.Reply) protocol.Reply {
+	switch v := reply.Value.(type) {
+	case []ds.KeyValue:
+		reply.Value = exportItems(v)
+	case protocol.Page:
+		if items, ok := v.Items.([]ds.KeyValue); ok {
+			v.Items = exportItems(items)
+		}
+		reply.Value = v
+	case []protocol.Reply:
+		for i := range v {
+			v[i] = export(v[i])
+		}
+	case nil, string:
+	default:
+		if typeName := values.TypeOf(v); typeName != values.TypeString {
+			reply.Type = typeName
+			reply.Value = values.Export(v)
+		}
+	}
+	reply.Previous = values.Export(reply.Previous)
+	return reply
+}
+
+// exportItems exports the values of items copied out of the store.
+func exportItems(items []ds.KeyValue) []ds.KeyValue {
+	for i := range items {
+		items[i].Value = values.Export(items[i].Value)
+	}
+	return items
+}
@@ -0,0 +1,57 @@
+package delivery
+
+import (
+	"context"
+
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// command is the command name messages to subscriptions are sent under, since
+// they are replies to the subscribe request that asked for them.
+const command = "subscribe"
+
+// defaultQueueSize is how many messages may wait for delivery before Send blocks.
+const defaultQueueSize = 1024
+
+// Queue holds the messages sent to subscriptions, key notifications and pub/sub
+// messages alike, until Run hands them to the reply publisher.
+type Queue chan queueservice.Message
+
+func NewQueue() Queue {
+	return make(Queue, defaultQueueSize)
+}
+
+// Reply returns a reply to a subscription, about key if it is not empty.
+func Reply(key string) protocol.Reply {
+	return protocol.OK(command, key)
+}
+
+// Message addresses the reply to the subscribe request of replyTo with correlationID.
+func Message(replyTo string, correlationID string, reply protocol.Reply) queueservice.Message {
+	req := queueservice.Message{ReplyTo: replyTo, CorrelationId: correlationID}
+	return protocol.NewMessage("", req, reply)
+}
+
+// Send queues the messages in order, blocking while the queue is full.
+func (q Queue) Send(messages ...queueservice.Message) {
+	for _, msg := range messages {
+		q <- msg
+	}
+}
+
+// Run delivers queued messages to replies until ctx is done.
+func (q Queue) Run(ctx context.Context, replies chan<- queueservice.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-q:
+			select {
+			case replies <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package delivery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+func TestQueue_Run(t *testing.T) {
+	q := NewQueue()
+	var messages []queueservice.Message
+	for _, value := range []string{"a", "b", "c"} {
+		reply := Reply("k")
+		reply.Value = value
+		messages = append(messages, Message("q1", "c1", reply))
+	}
+	q.Send(messages...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replies := make(chan queueservice.Message)
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx, replies)
+		close(done)
+	}()
+
+	for _, value := range []string{"a", "b", "c"} {
+		msg := <-replies
+		reply, err := protocol.Decode(msg.Body)
+		if err != nil {
+			t.Fatalf("failed to decode message: %v", err)
+		}
+		if msg.ReplyTo != "q1" || msg.CorrelationId != "c1" || reply.Command != "subscribe" || reply.Key != "k" || reply.Value != value {
+			t.Errorf("expected message %s to the subscription of q1, got: %+v", value, msg)
+		}
+	}
+
+	// Run stops once ctx is done, even with a message waiting for the publisher.
+	q.Send(messages[0])
+	cancel()
+	<-done
+}
@@ -0,0 +1,68 @@
+package glob
+
+import "unicode/utf8"
+
+// Match reports whether key matches pattern, in which '*' matches any run of
+// characters, '?' matches a single character and '\' matches the next character
+// literally. An empty pattern matches every key.
+func Match(pattern string, key string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	// On a mismatch, retry from the last '*' with it matching one more character.
+	starPattern, starKey := -1, 0
+	p, k := 0, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starKey = p, k
+				p++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(key[k:])
+				p, k = p+1, k+size
+				continue
+			default:
+				literal := p
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					literal++
+				}
+				pr, psize := utf8.DecodeRuneInString(pattern[literal:])
+				kr, ksize := utf8.DecodeRuneInString(key[k:])
+				if pr == kr {
+					p, k = literal+psize, k+ksize
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(key[starKey:])
+		starKey += size
+		p, k = starPattern+1, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Prefix returns the literal text every key matching pattern starts with.
+func Prefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+			return string(prefix)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix = append(prefix, pattern[i])
+	}
+	return string(prefix)
+}
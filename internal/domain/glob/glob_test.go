@@ -0,0 +1,56 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		key      string
+		expected bool
+	}{
+		{"", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "user:", true},
+		{"user:*", "users:42", false},
+		{"*:profile", "user:42:profile", true},
+		{"user:*:profile", "user:42:profile", true},
+		{"user:*:profile", "user:42:settings", false},
+		{"user:?", "user:4", true},
+		{"user:?", "user:42", false},
+		{"ключ:?", "ключ:я", true},
+		{"*a*b", "xaybzb", true},
+		{"*a*b", "xaybz", false},
+		{`tmp\*`, "tmp*", true},
+		{`tmp\*`, "tmp1", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			if matched := Match(tt.pattern, tt.key); matched != tt.expected {
+				t.Errorf("expected %v, got: %v", tt.expected, matched)
+			}
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"", ""},
+		{"user:*", "user:"},
+		{"user:?:profile", "user:"},
+		{"*:profile", ""},
+		{`tmp\*x*`, "tmp*x"},
+		{"exact", "exact"},
+	}
+
+	for _, tt := range tests {
+		if prefix := Prefix(tt.pattern); prefix != tt.expected {
+			t.Errorf("expected prefix of %q: %q, got: %q", tt.pattern, tt.expected, prefix)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// step is an object field, or an array index when isIndex is set. Negative
+// indexes count from the end of the array.
+type step struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+// Path is a parsed JSONPath addressing a single node of a document decoded by
+// encoding/json, made of objects as map[string]interface{} and arrays as
+// []interface{}.
+type Path []step
+
+// Parse parses the supported subset of JSONPath: the root '$' followed by any
+// number of '.field', '['field']' with single or double quotes, and '[index]'.
+func Parse(text string) (Path, error) {
+	if !strings.HasPrefix(text, "$") {
+		return nil, fmt.Errorf("path must start at the root $")
+	}
+	var path Path
+	for i := 1; i < len(text); {
+		switch text[i] {
+		case '.':
+			end := i + 1
+			for end < len(text) && text[end] != '.' && text[end] != '[' {
+				end++
+			}
+			if end == i+1 {
+				return nil, fmt.Errorf("missing field name at offset %d", i+1)
+			}
+			path = append(path, step{field: text[i+1 : end]})
+			i = end
+		case '[':
+			end := strings.IndexByte(text[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ at offset %d", i)
+			}
+			inner := text[i+1 : i+end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, step{field: inner[1 : len(inner)-1]})
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				path = append(path, step{index: index, isIndex: true})
+			} else {
+				return nil, fmt.Errorf("expected an index or a quoted field name at offset %d", i+1)
+			}
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", text[i], i)
+		}
+	}
+	return path, nil
+}
+
+// resolve returns the position of an index in an array of length n.
+func (s step) resolve(n int) (int, bool) {
+	index := s.index
+	if index < 0 {
+		index += n
+	}
+	return index, index >= 0 && index < n
+}
+
+func (s step) String() string {
+	if s.isIndex {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return "." + s.field
+}
+
+// Get returns the node at the path, reporting whether it exists.
+func (p Path) Get(root interface{}) (interface{}, bool) {
+	node := root
+	for _, s := range p {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[s.field]
+			if s.isIndex || !ok {
+				return nil, false
+			}
+			node = child
+		case []interface{}:
+			index, ok := s.resolve(len(n))
+			if !s.isIndex || !ok {
+				return nil, false
+			}
+			node = n[index]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// CanSet returns the error Set would fail with, without changing the document.
+// Missing fields on the way are created as objects, but arrays are not extended.
+func (p Path) CanSet(root interface{}) error {
+	node := root
+	for i, s := range p {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if s.isIndex {
+				return fmt.Errorf("%s: cannot index an object", p[:i+1])
+			}
+			child, ok := n[s.field]
+			if !ok {
+				// The rest of the path is created, so it must consist of fields.
+				for _, rest := range p[i+1:] {
+					if rest.isIndex {
+						return fmt.Errorf("%s: cannot create an array", p[:i+1])
+					}
+				}
+				return nil
+			}
+			node = child
+		case []interface{}:
+			if !s.isIndex {
+				return fmt.Errorf("%s: cannot get a field of an array", p[:i+1])
+			}
+			index, ok := s.resolve(len(n))
+			if !ok {
+				return fmt.Errorf("%s: index out of range", p[:i+1])
+			}
+			node = n[index]
+		default:
+			return fmt.Errorf("%s: not an object or an array", p[:i])
+		}
+	}
+	return nil
+}
+
+// Set replaces the node at the path with value and returns the new root, which
+// is value itself for the root path. The document is changed in place, and not
+// at all if it fails; see CanSet.
+func (p Path) Set(root interface{}, value interface{}) (interface{}, error) {
+	if err := p.CanSet(root); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return value, nil
+	}
+
+	node := root
+	for i, s := range p {
+		last := i == len(p)-1
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if last {
+				n[s.field] = value
+				break
+			}
+			child, ok := n[s.field]
+			if !ok {
+				child = map[string]interface{}{}
+				n[s.field] = child
+			}
+			node = child
+		case []interface{}:
+			index, _ := s.resolve(len(n))
+			if last {
+				n[index] = value
+				break
+			}
+			node = n[index]
+		}
+	}
+	return root, nil
+}
+
+// Delete removes the node at the path and returns the new root, nil once the
+// root itself is deleted, reporting whether the node existed. Deleting an array
+// element shifts the following ones.
+func (p Path) Delete(root interface{}) (interface{}, bool) {
+	if len(p) == 0 {
+		return nil, true
+	}
+	parent, ok := p[:len(p)-1].Get(root)
+	if !ok {
+		return root, false
+	}
+
+	s := p[len(p)-1]
+	switch n := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := n[s.field]; s.isIndex || !ok {
+			return root, false
+		}
+		delete(n, s.field)
+		return root, true
+	case []interface{}:
+		index, ok := s.resolve(len(n))
+		if !s.isIndex || !ok {
+			return root, false
+		}
+		shrunk := append(n[:index:index], n[index+1:]...)
+		if len(p) == 1 {
+			return shrunk, true
+		}
+		grandparent, _ := p[:len(p)-2].Get(root)
+		switch g := grandparent.(type) {
+		case map[string]interface{}:
+			g[p[len(p)-2].field] = shrunk
+		case []interface{}:
+			index, _ := p[len(p)-2].resolve(len(g))
+			g[index] = shrunk
+		}
+		return root, true
+	default:
+		return root, false
+	}
+}
+
+// String returns the path in the syntax Parse reads.
+func (p Path) String() string {
+	var b strings.Builder
+	b.WriteByte('$')
+	for _, s := range p {
+		b.WriteString(s.String())
+	}
+	return b.String()
+}
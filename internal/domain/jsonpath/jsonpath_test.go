@@ -0,0 +1,143 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, text string) interface{} {
+	t.Helper()
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		t.Fatalf("failed to decode %s: %v", text, err)
+	}
+	return doc
+}
+
+func encode(t *testing.T, doc interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("failed to encode %v: %v", doc, err)
+	}
+	return string(data)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Path
+	}{
+		{"$", nil},
+		{"$.address.city", Path{{field: "address"}, {field: "city"}}},
+		{"$.items[0]", Path{{field: "items"}, {index: 0, isIndex: true}}},
+		{"$['a.b'][\"c\"][-1]", Path{{field: "a.b"}, {field: "c"}, {index: -1, isIndex: true}}},
+	}
+	for _, tt := range tests {
+		path, err := Parse(tt.text)
+		if err != nil || !reflect.DeepEqual(path, tt.expected) {
+			t.Errorf("%s: expected path %v, got: %v, %v", tt.text, tt.expected, path, err)
+		}
+	}
+
+	for _, text := range []string{"", "a.b", "$.", "$..a", "$[", "$[x]", "$[*]", "$['a]", "$a"} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("expected %q to fail parsing", text)
+		}
+	}
+}
+
+func TestPath_Get(t *testing.T) {
+	doc := decode(t, `{"name":"Ann","address":{"city":"Varna"},"items":[1,{"id":"x"},3]}`)
+
+	tests := []struct {
+		path     string
+		expected string
+		exists   bool
+	}{
+		{"$", `{"address":{"city":"Varna"},"items":[1,{"id":"x"},3],"name":"Ann"}`, true},
+		{"$.address.city", `"Varna"`, true},
+		{"$.items[1].id", `"x"`, true},
+		{"$.items[-1]", `3`, true},
+		{"$.items[3]", ``, false},
+		{"$.items.id", ``, false},
+		{"$.name[0]", ``, false},
+		{"$.missing", ``, false},
+	}
+	for _, tt := range tests {
+		path, _ := Parse(tt.path)
+		node, exists := path.Get(doc)
+		if exists != tt.exists || (exists && encode(t, node) != tt.expected) {
+			t.Errorf("%s: expected %s, %v, got: %v, %v", tt.path, tt.expected, tt.exists, node, exists)
+		}
+	}
+}
+
+func TestPath_Set(t *testing.T) {
+	tests := []struct {
+		doc      string
+		path     string
+		value    string
+		expected string
+	}{
+		{`{"a":1}`, "$", `[1]`, `[1]`},
+		{`{"a":1}`, "$.a", `{"b":2}`, `{"a":{"b":2}}`},
+		{`{"a":1}`, "$.address.city", `"Sofia"`, `{"a":1,"address":{"city":"Sofia"}}`},
+		{`{"items":[1,2]}`, "$.items[-1]", `"x"`, `{"items":[1,"x"]}`},
+		{`[{"a":1}]`, "$[0].b", `true`, `[{"a":1,"b":true}]`},
+	}
+	for _, tt := range tests {
+		path, _ := Parse(tt.path)
+		root, err := path.Set(decode(t, tt.doc), decode(t, tt.value))
+		if err != nil || encode(t, root) != tt.expected {
+			t.Errorf("%s on %s: expected %s, got: %v, %v", tt.path, tt.doc, tt.expected, root, err)
+		}
+	}
+
+	failures := []struct {
+		doc  string
+		path string
+	}{
+		{`{"a":1}`, "$.a.b"},
+		{`{"a":[]}`, "$.a[0]"},
+		{`{"a":[]}`, "$.a.b"},
+		{`{"a":{}}`, "$.a[0]"},
+		{`{}`, "$.a.b[0]"},
+	}
+	for _, tt := range failures {
+		path, _ := Parse(tt.path)
+		doc := decode(t, tt.doc)
+		if _, err := path.Set(doc, "x"); err == nil {
+			t.Errorf("expected setting %s on %s to fail", tt.path, tt.doc)
+		}
+		if encode(t, doc) != tt.doc {
+			t.Errorf("expected %s to stay unchanged, got: %s", tt.doc, encode(t, doc))
+		}
+	}
+}
+
+func TestPath_Delete(t *testing.T) {
+	tests := []struct {
+		doc      string
+		path     string
+		expected string
+		removed  bool
+	}{
+		{`{"a":1,"b":2}`, "$.a", `{"b":2}`, true},
+		{`{"a":{"items":[1,2,3]}}`, "$.a.items[1]", `{"a":{"items":[1,3]}}`, true},
+		{`[[1,2],[3]]`, "$[0][0]", `[[2],[3]]`, true},
+		{`[1,2]`, "$[0]", `[2]`, true},
+		{`{"a":1}`, "$.b", `{"a":1}`, false},
+		{`{"a":[1]}`, "$.a[1]", `{"a":[1]}`, false},
+		{`{"a":1}`, "$.a.b", `{"a":1}`, false},
+		{`{"a":1}`, "$", `null`, true},
+	}
+	for _, tt := range tests {
+		path, _ := Parse(tt.path)
+		root, removed := path.Delete(decode(t, tt.doc))
+		if removed != tt.removed || encode(t, root) != tt.expected {
+			t.Errorf("%s on %s: expected %s, %v, got: %s, %v", tt.path, tt.doc, tt.expected, tt.removed, encode(t, root), removed)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package keyspace
+
+import (
+	"sync"
+
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/glob"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// EventType is the kind of change made to a key.
+type EventType string
+
+const (
+	EventAdd    EventType = "add"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	EventExpire EventType = "expire"
+)
+
+// Event describes a change applied to a key. Value and Version are those of the
+// new value and are only set on add and update events.
+type Event struct {
+	Type    EventType
+	Key     string
+	Value   interface{}
+	Version uint64
+}
+
+// Notifier keeps the key subscriptions of reply queues and sends a notification
+// to each subscription matching a changed key. Subscriptions are identified by the
+// reply queue and the key pattern; notifications carry the CorrelationId of the
+// subscribe request.
+type Notifier struct {
+	mu sync.RWMutex
+	// subscriptions maps a reply queue to its patterns and their correlation ids.
+	subscriptions map[string]map[string]string
+	queue         delivery.Queue
+}
+
+// NewNotifier creates a Notifier with no subscriptions, sending its notifications
+// to the queue. They are delivered once the queue is run.
+func NewNotifier(queue delivery.Queue) *Notifier {
+	return &Notifier{
+		subscriptions: make(map[string]map[string]string),
+		queue:         queue,
+	}
+}
+
+// Subscribe subscribes replyTo to changes of the keys matching pattern and
+// returns how many patterns replyTo is subscribed to. Subscribing again to the
+// same pattern replaces the correlation id of its notifications.
+func (n *Notifier) Subscribe(replyTo string, correlationID string, pattern string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	patterns, ok := n.subscriptions[replyTo]
+	if !ok {
+		patterns = make(map[string]string)
+		n.subscriptions[replyTo] = patterns
+	}
+	patterns[pattern] = correlationID
+	return len(patterns)
+}
+
+// Unsubscribe removes the subscription of replyTo to pattern, or all of its
+// subscriptions when pattern is empty, and returns how many were removed.
+func (n *Notifier) Unsubscribe(replyTo string, pattern string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	patterns := n.subscriptions[replyTo]
+	if pattern == "" {
+		delete(n.subscriptions, replyTo)
+		return len(patterns)
+	}
+	if _, ok := patterns[pattern]; !ok {
+		return 0
+	}
+	delete(patterns, pattern)
+	if len(patterns) == 0 {
+		delete(n.subscriptions, replyTo)
+	}
+	return 1
+}
+
+// Drop removes all subscriptions of a reply queue that no longer exists.
+func (n *Notifier) Drop(replyTo string) {
+	n.Unsubscribe(replyTo, "")
+}
+
+// Notify queues a notification of the event for every subscription matching its
+// key, blocking while the queue is full. Events of a key are notified in the order
+// they are passed in.
+func (n *Notifier) Notify(event Event) {
+	n.mu.RLock()
+	var messages []queueservice.Message
+	for replyTo, patterns := range n.subscriptions {
+		for pattern, correlationID := range patterns {
+			if !glob.Match(pattern, event.Key) {
+				continue
+			}
+			reply := delivery.Reply(event.Key)
+			reply.Event = string(event.Type)
+			reply.Value, reply.Version = event.Value, event.Version
+			messages = append(messages, delivery.Message(replyTo, correlationID, reply))
+		}
+	}
+	n.mu.RUnlock()
+
+	n.queue.Send(messages...)
+}
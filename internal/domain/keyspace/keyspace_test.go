@@ -0,0 +1,135 @@
+package keyspace
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// notification is the part of a delivered notification the tests compare.
+type notification struct {
+	replyTo       string
+	correlationID string
+	reply         protocol.Reply
+}
+
+// drain returns the queued notifications, sorted by reply queue and correlation id.
+func drain(t *testing.T, n *Notifier) []notification {
+	t.Helper()
+	var notifications []notification
+	for {
+		select {
+		case msg := <-n.queue:
+			reply, err := protocol.Decode(msg.Body)
+			if err != nil {
+				t.Fatalf("failed to decode notification: %v", err)
+			}
+			notifications = append(notifications, notification{msg.ReplyTo, msg.CorrelationId, reply})
+		default:
+			sort.Slice(notifications, func(i, j int) bool {
+				if notifications[i].replyTo != notifications[j].replyTo {
+					return notifications[i].replyTo < notifications[j].replyTo
+				}
+				return notifications[i].correlationID < notifications[j].correlationID
+			})
+			return notifications
+		}
+	}
+}
+
+func TestNotifier_Notify(t *testing.T) {
+	n := NewNotifier(delivery.NewQueue())
+
+	if count := n.Subscribe("q1", "c1", "orders:*"); count != 1 {
+		t.Errorf("expected 1 subscription, got: %d", count)
+	}
+	if count := n.Subscribe("q1", "c2", "*:eu"); count != 2 {
+		t.Errorf("expected 2 subscriptions, got: %d", count)
+	}
+	n.Subscribe("q2", "c3", "orders:1")
+
+	n.Notify(Event{Type: EventUpdate, Key: "orders:1", Value: "paid", Version: 7})
+	expected := []notification{
+		{"q1", "c1", protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:1", Value: "paid", Version: 7, Event: "update"}},
+		{"q2", "c3", protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:1", Value: "paid", Version: 7, Event: "update"}},
+	}
+	if notifications := drain(t, n); !reflect.DeepEqual(notifications, expected) {
+		t.Errorf("expected notifications: %+v, got: %+v", expected, notifications)
+	}
+
+	// A key matching several patterns of a queue is notified once per subscription.
+	n.Notify(Event{Type: EventDelete, Key: "orders:eu"})
+	expected = []notification{
+		{"q1", "c1", protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:eu", Event: "delete"}},
+		{"q1", "c2", protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:eu", Event: "delete"}},
+	}
+	if notifications := drain(t, n); !reflect.DeepEqual(notifications, expected) {
+		t.Errorf("expected notifications: %+v, got: %+v", expected, notifications)
+	}
+
+	n.Notify(Event{Type: EventAdd, Key: "users:1", Value: "x", Version: 8})
+	if notifications := drain(t, n); len(notifications) != 0 {
+		t.Errorf("expected no notifications, got: %+v", notifications)
+	}
+}
+
+func TestNotifier_Unsubscribe(t *testing.T) {
+	n := NewNotifier(delivery.NewQueue())
+	n.Subscribe("q1", "c1", "orders:*")
+	n.Subscribe("q1", "c2", "users:*")
+	n.Subscribe("q2", "c3", "orders:*")
+
+	if removed := n.Unsubscribe("q1", "missing"); removed != 0 {
+		t.Errorf("expected 0 subscriptions removed, got: %d", removed)
+	}
+	if removed := n.Unsubscribe("q1", "orders:*"); removed != 1 {
+		t.Errorf("expected 1 subscription removed, got: %d", removed)
+	}
+	n.Notify(Event{Type: EventDelete, Key: "orders:1"})
+	if notifications := drain(t, n); len(notifications) != 1 || notifications[0].replyTo != "q2" {
+		t.Errorf("expected only q2 to be notified, got: %+v", notifications)
+	}
+
+	if removed := n.Unsubscribe("q1", ""); removed != 1 {
+		t.Errorf("expected 1 subscription removed, got: %d", removed)
+	}
+	n.Drop("q2")
+	n.Notify(Event{Type: EventDelete, Key: "orders:1"})
+	n.Notify(Event{Type: EventDelete, Key: "users:1"})
+	if notifications := drain(t, n); len(notifications) != 0 {
+		t.Errorf("expected no notifications, got: %+v", notifications)
+	}
+	if len(n.subscriptions) != 0 {
+		t.Errorf("expected no reply queues left, got: %v", n.subscriptions)
+	}
+}
+
+func TestNotifier_Run(t *testing.T) {
+	queue := delivery.NewQueue()
+	n := NewNotifier(queue)
+	n.Subscribe("q1", "c1", "*")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replies := make(chan queueservice.Message)
+	go queue.Run(ctx, replies)
+
+	for _, key := range []string{"a", "b", "c"} {
+		n.Notify(Event{Type: EventAdd, Key: key})
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		msg := <-replies
+		reply, err := protocol.Decode(msg.Body)
+		if err != nil {
+			t.Fatalf("failed to decode notification: %v", err)
+		}
+		if msg.ReplyTo != "q1" || msg.CorrelationId != "c1" || reply.Key != key {
+			t.Errorf("expected notification of %s to q1, got: %+v", key, msg)
+		}
+	}
+}
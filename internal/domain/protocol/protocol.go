@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	cmd_parser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// Request is a message routed to a worker together with the command parsed from it,
+// so that each message is parsed only once.
+type Request struct {
+	Message queueservice.Message
+	Command cmd_parser.Command
+	// Hold, when set, carries no command. The worker must wait until it is closed,
+	// leaving its keys to a transaction being applied meanwhile.
+	Hold <-chan struct{}
+	// Results, when set, receives the reply instead of the sender of Message. It is
+	// used for the part of a multi-key command the router sent to one worker.
+	Results chan<- Reply
+}
+
+type Status string
+
+const (
+	StatusOK    Status = "OK"
+	StatusError Status = "ERROR"
+)
+
+// ErrorCode is a machine-readable reason attached to replies with StatusError.
+type ErrorCode string
+
+const (
+	ErrInvalidCommand    ErrorCode = "INVALID_COMMAND"
+	ErrInvalidArgument   ErrorCode = "INVALID_ARGUMENT"
+	ErrUnknownCommand    ErrorCode = "UNKNOWN_COMMAND"
+	ErrKeyNotFound       ErrorCode = "KEY_NOT_FOUND"
+	ErrNotInteger        ErrorCode = "NOT_INTEGER"
+	ErrIntegerOverflow   ErrorCode = "INTEGER_OVERFLOW"
+	ErrVersionMismatch   ErrorCode = "VERSION_MISMATCH"
+	ErrWrongType         ErrorCode = "WRONG_TYPE"
+	ErrEncodingFailed    ErrorCode = "ENCODING_FAILED"
+	ErrPersistenceFailed ErrorCode = "PERSISTENCE_FAILED"
+	ErrInternal          ErrorCode = "INTERNAL_ERROR"
+)
+
+// Retryable reports whether the error is caused by the server rather than the
+// command itself, so processing the same command again may succeed.
+func (c ErrorCode) Retryable() bool {
+	switch c {
+	case ErrPersistenceFailed, ErrInternal:
+		return true
+	}
+	return false
+}
+
+// DeadLetter reports whether requests failing with this error should be kept
+// for inspection: malformed commands and server-side failures.
+func (c ErrorCode) DeadLetter() bool {
+	return c == ErrInvalidCommand || c.Retryable()
+}
+
+// Reply is the envelope sent back for every processed command.
+type Reply struct {
+	Status  Status      `json:"status"`
+	Command string      `json:"command,omitempty"`
+	Key     string      `json:"key,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	// Type is the type of Value when it is not a string, e.g. list.
+	Type     string      `json:"type,omitempty"`
+	Previous interface{} `json:"previous,omitempty"`
+	Existed  bool        `json:"existed,omitempty"`
+	// Version is the version of the item after the command, or its current
+	// version when a conditional command does not apply.
+	Version   uint64    `json:"version,omitempty"`
+	ErrorCode ErrorCode `json:"errorCode,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Chunk is set on the parts of a reply streamed in chunks.
+	Chunk *Chunk `json:"chunk,omitempty"`
+	// Event is the kind of change a keyspace notification reports.
+	Event string `json:"event,omitempty"`
+	// Channel is the pub/sub channel a message was published to.
+	Channel string `json:"channel,omitempty"`
+}
+
+// OK creates a successful reply for the given command and key.
+func OK(command string, key string) Reply {
+	return Reply{Status: StatusOK, Command: command, Key: key}
+}
+
+// Error creates a failed reply carrying the given error code.
+func Error(command string, key string, code ErrorCode, format string, args ...interface{}) Reply {
+	return Reply{
+		Status:    StatusError,
+		Command:   command,
+		Key:       key,
+		ErrorCode: code,
+		Error:     fmt.Sprintf(format, args...),
+	}
+}
+
+// Page is the value of a scan reply. Cursor resumes the scan and is 0 once no
+// items are left.
+type Page struct {
+	Cursor uint64      `json:"cursor"`
+	Items  interface{} `json:"items"`
+}
+
+// Batch combines the per-key replies of a multi-key command, in the reply's Value.
+// The batch itself only fails if a key failed for a reason worth retrying, so that
+// the whole command is retried.
+func Batch(command string, results []Reply) Reply {
+	reply := OK(command, "")
+	for _, r := range results {
+		if r.Status == StatusError && r.ErrorCode.Retryable() {
+			reply = Error(command, "", r.ErrorCode, "key %s failed: %s", r.Key, r.Error)
+			break
+		}
+	}
+	reply.Value = results
+	return reply
+}
+
+// NewMessage encodes the reply as JSON and addresses it to the sender of req,
+// carrying over the delivery handle of req. worker identifies who produced the reply
+// and is recorded when the request is dead-lettered.
+func NewMessage(worker string, req queueservice.Message, reply Reply) queueservice.Message {
+	body, err := json.Marshal(reply)
+	if err != nil {
+		body, _ = json.Marshal(Error(reply.Command, reply.Key, ErrEncodingFailed, "failed to encode reply: %v", err))
+	}
+	msg := queueservice.Message{
+		Body:          string(body),
+		ReplyTo:       req.ReplyTo,
+		CorrelationId: req.CorrelationId,
+		Delivery:      req.Delivery,
+	}
+	if reply.Status == StatusError {
+		msg.Failed = reply.ErrorCode.Retryable()
+		if reply.ErrorCode.DeadLetter() {
+			msg.DeadLetter = &queueservice.DeadLetter{
+				Reason:    reply.Error,
+				ErrorCode: string(reply.ErrorCode),
+				Worker:    worker,
+			}
+		}
+	}
+	return msg
+}
+
+// Decode parses a reply previously produced by NewMessage.
+func Decode(body string) (Reply, error) {
+	var reply Reply
+	if err := json.Unmarshal([]byte(body), &reply); err != nil {
+		return Reply{}, fmt.Errorf("failed to decode reply: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// Chunk marks one part of a reply streamed as several messages sharing the
+// CorrelationId of the request. Every part is a reply carrying some of the items
+// of the whole reply's value, a list or a Page; concatenating them in Seq order
+// gives the items of the whole reply. The last part has End set.
+type Chunk struct {
+	Seq int  `json:"seq"`
+	End bool `json:"end,omitempty"`
+}
+
+// rawReply is a reply whose value is kept encoded. Its Value field hides the one
+// of the embedded Reply.
+type rawReply struct {
+	Reply
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type rawPage struct {
+	Cursor uint64            `json:"cursor"`
+	Items  []json.RawMessage `json:"items"`
+}
+
+// MinReplySize is the smallest maxSize accepted for Split besides 0, leaving room
+// for the envelope every chunk repeats: status, command, key, cursor and marker.
+const MinReplySize = 256
+
+// Split streams a reply message whose body exceeds maxSize bytes as chunks of at
+// most about maxSize bytes each; a single item larger than that gets a chunk of its
+// own. Only the last chunk carries the delivery handle, so the request is settled
+// once the whole reply has been sent. Replies whose value is not a list or a Page
+// or has no items, failed replies, which are redelivered rather than sent, and all
+// replies when maxSize is 0 are returned as they are.
+func Split(msg queueservice.Message, maxSize int) []queueservice.Message {
+	if maxSize <= 0 || len(msg.Body) <= maxSize || msg.Failed {
+		return []queueservice.Message{msg}
+	}
+
+	var reply rawReply
+	if err := json.Unmarshal([]byte(msg.Body), &reply); err != nil || len(reply.Value) == 0 {
+		return []queueservice.Message{msg}
+	}
+
+	var items []json.RawMessage
+	var page *rawPage
+	switch reply.Value[0] {
+	case '[':
+		if err := json.Unmarshal(reply.Value, &items); err != nil {
+			return []queueservice.Message{msg}
+		}
+	case '{':
+		page = &rawPage{}
+		if err := json.Unmarshal(reply.Value, page); err != nil || page.Items == nil {
+			return []queueservice.Message{msg}
+		}
+		items = page.Items
+	default:
+		return []queueservice.Message{msg}
+	}
+	if len(items) == 0 {
+		return []queueservice.Message{msg}
+	}
+
+	// The envelope of every chunk is the reply without its items.
+	envelope := reply
+	envelope.Chunk = &Chunk{Seq: len(items), End: true}
+	envelope.Value = encodeItems(page, nil)
+	overhead, _ := json.Marshal(envelope)
+
+	var chunks []queueservice.Message
+	for start := 0; start < len(items); {
+		end, size := start+1, len(overhead)+len(items[start])
+		for end < len(items) && size+len(items[end])+1 <= maxSize {
+			size += len(items[end]) + 1
+			end++
+		}
+
+		part := reply
+		part.Chunk = &Chunk{Seq: len(chunks), End: end == len(items)}
+		part.Value = encodeItems(page, items[start:end])
+		body, _ := json.Marshal(part)
+
+		chunk := queueservice.Message{
+			Body:          string(body),
+			ReplyTo:       msg.ReplyTo,
+			CorrelationId: msg.CorrelationId,
+		}
+		if part.Chunk.End {
+			chunk.Delivery, chunk.Failed, chunk.DeadLetter = msg.Delivery, msg.Failed, msg.DeadLetter
+		}
+		chunks = append(chunks, chunk)
+		start = end
+	}
+	return chunks
+}
+
+// encodeItems encodes items as a list, or as a page with the cursor of page.
+func encodeItems(page *rawPage, items []json.RawMessage) json.RawMessage {
+	if items == nil {
+		items = []json.RawMessage{}
+	}
+	var encoded []byte
+	if page != nil {
+		encoded, _ = json.Marshal(rawPage{Cursor: page.Cursor, Items: items})
+	} else {
+		encoded, _ = json.Marshal(items)
+	}
+	return encoded
+}
+
+// Assembler reassembles replies streamed in chunks, keeping the parts received so
+// far per CorrelationId and sequence number. A part received again, as a duplicate
+// delivery or in a stream sent again, replaces the earlier one. It is safe for
+// concurrent use, so consumers sharing a reply queue can share it.
+type Assembler struct {
+	mu      sync.Mutex
+	pending map[string]map[int]Reply
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{pending: make(map[string]map[int]Reply)}
+}
+
+// Add decodes a reply message. It returns the whole reply once every part of it
+// has been added, and false while parts are still missing. Replies that are not
+// streamed are returned right away.
+func (a *Assembler) Add(msg queueservice.Message) (Reply, bool, error) {
+	reply, err := Decode(msg.Body)
+	if err != nil {
+		return reply, false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if reply.Chunk == nil {
+		// The reply was sent again whole, so earlier parts of it are not needed.
+		delete(a.pending, msg.CorrelationId)
+		return reply, true, nil
+	}
+
+	received := a.pending[msg.CorrelationId]
+	if received == nil {
+		received = make(map[int]Reply)
+		a.pending[msg.CorrelationId] = received
+	}
+	received[reply.Chunk.Seq] = reply
+
+	// The reply is complete once the last part and all parts before it are in.
+	// Parts after it are left over from a longer stream sent earlier.
+	last := -1
+	for seq, part := range received {
+		if part.Chunk.End && (last < 0 || seq < last) {
+			last = seq
+		}
+	}
+	if last < 0 {
+		return Reply{}, false, nil
+	}
+	parts := make([]Reply, 0, last+1)
+	for seq := 0; seq <= last; seq++ {
+		part, ok := received[seq]
+		if !ok {
+			return Reply{}, false, nil
+		}
+		parts = append(parts, part)
+	}
+	delete(a.pending, msg.CorrelationId)
+
+	whole := parts[0]
+	whole.Chunk = nil
+	var items []interface{}
+	for _, part := range parts {
+		partItems, err := chunkItems(part.Value)
+		if err != nil {
+			return Reply{}, false, fmt.Errorf("failed to reassemble reply %s: %v", msg.CorrelationId, err)
+		}
+		items = append(items, partItems...)
+	}
+	if page, ok := whole.Value.(map[string]interface{}); ok {
+		page["items"] = items
+	} else {
+		whole.Value = items
+	}
+	return whole, true, nil
+}
+
+// chunkItems returns the items of a decoded chunk value, a list or a page.
+func chunkItems(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		if items, ok := v["items"].([]interface{}); ok {
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected chunk value %T", value)
+}
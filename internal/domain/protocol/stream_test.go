@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+func TestSplit(t *testing.T) {
+	items := make([]interface{}, 50)
+	for i := range items {
+		items[i] = map[string]interface{}{"Key": strings.Repeat("k", i), "Value": "v"}
+	}
+
+	tests := []struct {
+		name  string
+		reply Reply
+	}{
+		{"List", Reply{Status: StatusOK, Command: "getAllItems", Value: items}},
+		{"Page", Reply{Status: StatusOK, Command: "scan", Value: map[string]interface{}{"cursor": float64(42), "items": items}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := struct{}{}
+			msg := NewMessage("router", queueservice.Message{CorrelationId: "c", ReplyTo: "r", Delivery: delivery}, tt.reply)
+
+			chunks := Split(msg, 300)
+			if len(chunks) < 2 {
+				t.Fatalf("expected several chunks, got %d", len(chunks))
+			}
+
+			// Chunks may arrive in any order.
+			assembler := NewAssembler()
+			for i := len(chunks) - 1; i >= 0; i-- {
+				chunk := chunks[i]
+				if len(chunk.Body) > 300 {
+					t.Errorf("expected chunk %d to fit in 300 bytes, got %d", i, len(chunk.Body))
+				}
+				if chunk.CorrelationId != "c" || chunk.ReplyTo != "r" {
+					t.Errorf("expected chunk %d to be addressed like the reply, got: %+v", i, chunk)
+				}
+				if (chunk.Delivery != nil) != (i == len(chunks)-1) {
+					t.Errorf("expected only the last chunk to carry the delivery, chunk %d does not", i)
+				}
+
+				reply, complete, err := assembler.Add(chunk)
+				if err != nil {
+					t.Fatalf("failed to add chunk %d: %v", i, err)
+				}
+				if complete != (i == 0) {
+					t.Fatalf("expected the reply to be complete only after all chunks, got %v at chunk %d", complete, i)
+				}
+				if complete && !reflect.DeepEqual(reply, tt.reply) {
+					t.Errorf("expected reply: %+v, got: %+v", tt.reply, reply)
+				}
+			}
+		})
+	}
+}
+
+func TestSplit_KeepsSmallAndScalarReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   Reply
+		maxSize int
+		failed  bool
+	}{
+		{"Small", Reply{Status: StatusOK, Command: "getAllItems", Value: []interface{}{"a"}}, 300, false},
+		{"Scalar", Reply{Status: StatusOK, Command: "getItem", Key: "k", Value: strings.Repeat("v", 500)}, 300, false},
+		// Empty values have no items to split but must still be sent, with their delivery.
+		{"EmptyList", Reply{Status: StatusOK, Command: "getAllItems", Value: []interface{}{}}, 20, false},
+		{"EmptyPage", Reply{Status: StatusOK, Command: "scan", Value: map[string]interface{}{"cursor": float64(0), "items": []interface{}{}}}, 20, false},
+		{"Disabled", Reply{Status: StatusOK, Command: "getAllItems", Value: []interface{}{strings.Repeat("v", 500)}}, 0, false},
+		// A failed reply is redelivered instead of being sent, so it must stay whole.
+		{"Failed", Reply{Status: StatusError, Command: "getItems", Value: []interface{}{strings.Repeat("v", 200), strings.Repeat("w", 200)},
+			ErrorCode: ErrPersistenceFailed, Error: "disk full"}, 300, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("router", queueservice.Message{CorrelationId: "c", Delivery: struct{}{}}, tt.reply)
+			msg.Failed = tt.failed
+			chunks := Split(msg, tt.maxSize)
+			if !reflect.DeepEqual(chunks, []queueservice.Message{msg}) {
+				t.Errorf("expected the message to be kept as is, got: %+v", chunks)
+			}
+
+			reply, complete, err := NewAssembler().Add(msg)
+			if err != nil || !complete || !reflect.DeepEqual(reply, tt.reply) {
+				t.Errorf("expected reply: %+v, got: %+v (%v, %v)", tt.reply, reply, complete, err)
+			}
+		})
+	}
+}
+
+func TestAssembler_DuplicateAndRestartedStreams(t *testing.T) {
+	items := make([]interface{}, 30)
+	for i := range items {
+		items[i] = strings.Repeat("x", i)
+	}
+	whole := Reply{Status: StatusOK, Command: "getAllItems", Value: items}
+	chunks := Split(NewMessage("router", queueservice.Message{CorrelationId: "c"}, whole), 200)
+	if len(chunks) < 3 {
+		t.Fatalf("expected at least 3 chunks, got %d", len(chunks))
+	}
+	// Shorter replies sent again under the same CorrelationId, streamed and whole.
+	shorter := Reply{Status: StatusOK, Command: "getAllItems", Value: items[:20]}
+	restart := Split(NewMessage("router", queueservice.Message{CorrelationId: "c"}, shorter), 200)
+	if len(restart) < 2 || len(restart) >= len(chunks) {
+		t.Fatalf("expected the restarted stream to be shorter, got %d chunks", len(restart))
+	}
+	small := Reply{Status: StatusOK, Command: "getAllItems", Value: items[:2]}
+	resent := NewMessage("router", queueservice.Message{CorrelationId: "c"}, small)
+
+	tests := []struct {
+		name     string
+		messages []queueservice.Message
+		expected Reply
+	}{
+		{"Duplicates", append([]queueservice.Message{chunks[0], chunks[1], chunks[0]}, chunks[1:]...), whole},
+		{"Restarted", append(append([]queueservice.Message{}, chunks[:len(chunks)-1]...), restart...), shorter},
+		{"ResentWhole", append(append([]queueservice.Message{}, chunks[:len(chunks)-1]...), resent), small},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := NewAssembler()
+			for i, msg := range tt.messages {
+				reply, complete, err := assembler.Add(msg)
+				if err != nil {
+					t.Fatalf("failed to add message %d: %v", i, err)
+				}
+				if complete != (i == len(tt.messages)-1) {
+					t.Fatalf("expected the reply to be complete only after the last message, got %v at %d", complete, i)
+				}
+				if complete && !reflect.DeepEqual(reply, tt.expected) {
+					t.Errorf("expected reply: %+v, got: %+v", tt.expected, reply)
+				}
+			}
+			if len(assembler.pending) != 0 {
+				t.Errorf("expected no pending parts left, got: %v", assembler.pending)
+			}
+		})
+	}
+}
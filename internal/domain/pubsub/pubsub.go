@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/glob"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// topic is what a reply queue subscribes to: a channel, or a glob pattern of
+// channels.
+type topic struct {
+	name    string
+	pattern bool
+}
+
+// Broker keeps the channel subscriptions of reply queues and delivers every
+// published message to each subscription whose channel or pattern it matches.
+// Messages carry the CorrelationId of the subscribe request.
+type Broker struct {
+	mu sync.RWMutex
+	// subscriptions maps a reply queue to its topics and their correlation ids.
+	subscriptions map[string]map[topic]string
+	// subscribers maps a topic to the reply queues subscribed to it.
+	subscribers map[topic]map[string]bool
+	// patterns lists the pattern topics, which every publish matches against.
+	patterns map[string]bool
+	queue    delivery.Queue
+}
+
+// NewBroker creates a Broker with no subscriptions, sending its messages to the
+// queue. They are delivered once the queue is run.
+func NewBroker(queue delivery.Queue) *Broker {
+	return &Broker{
+		subscriptions: make(map[string]map[topic]string),
+		subscribers:   make(map[topic]map[string]bool),
+		patterns:      make(map[string]bool),
+		queue:         queue,
+	}
+}
+
+// Subscribe subscribes replyTo to the channel, or to the channels matching it if
+// pattern is set, and returns how many channels and patterns replyTo is subscribed
+// to. Subscribing again replaces the correlation id of its messages.
+func (b *Broker) Subscribe(replyTo string, correlationID string, channel string, pattern bool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := topic{name: channel, pattern: pattern}
+	topics, ok := b.subscriptions[replyTo]
+	if !ok {
+		topics = make(map[topic]string)
+		b.subscriptions[replyTo] = topics
+	}
+	topics[t] = correlationID
+
+	queues, ok := b.subscribers[t]
+	if !ok {
+		queues = make(map[string]bool)
+		b.subscribers[t] = queues
+		if pattern {
+			b.patterns[channel] = true
+		}
+	}
+	queues[replyTo] = true
+	return len(topics)
+}
+
+// Unsubscribe removes the subscription of replyTo to the channel or pattern, or
+// all of its subscriptions when channel is empty, and returns how many were removed.
+func (b *Broker) Unsubscribe(replyTo string, channel string, pattern bool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := b.subscriptions[replyTo]
+	if channel == "" {
+		removed := len(topics)
+		for t := range topics {
+			b.remove(replyTo, t)
+		}
+		return removed
+	}
+	t := topic{name: channel, pattern: pattern}
+	if _, ok := topics[t]; !ok {
+		return 0
+	}
+	b.remove(replyTo, t)
+	return 1
+}
+
+// remove deletes the subscription of replyTo to t. Must be called with mu locked.
+func (b *Broker) remove(replyTo string, t topic) {
+	delete(b.subscriptions[replyTo], t)
+	if len(b.subscriptions[replyTo]) == 0 {
+		delete(b.subscriptions, replyTo)
+	}
+	delete(b.subscribers[t], replyTo)
+	if len(b.subscribers[t]) == 0 {
+		delete(b.subscribers, t)
+		if t.pattern {
+			delete(b.patterns, t.name)
+		}
+	}
+}
+
+// Drop removes all channel subscriptions of replyTo, once the queue is gone.
+func (b *Broker) Drop(replyTo string) {
+	b.Unsubscribe(replyTo, "", false)
+}
+
+// Publish queues the message for every subscription to the channel or to a pattern
+// matching it, blocking while the queue is full, and returns how many subscriptions
+// it was queued for. Messages published one after another are delivered in that order.
+func (b *Broker) Publish(channel string, message string) int {
+	b.mu.RLock()
+	var messages []queueservice.Message
+	deliver := func(t topic) {
+		for replyTo := range b.subscribers[t] {
+			reply := delivery.Reply("")
+			reply.Channel, reply.Value = channel, message
+			messages = append(messages, delivery.Message(replyTo, b.subscriptions[replyTo][t], reply))
+		}
+	}
+	deliver(topic{name: channel})
+	for pattern := range b.patterns {
+		if glob.Match(pattern, channel) {
+			deliver(topic{name: pattern, pattern: true})
+		}
+	}
+	b.mu.RUnlock()
+
+	b.queue.Send(messages...)
+	return len(messages)
+}
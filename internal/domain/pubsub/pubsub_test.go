@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/queueservice"
+)
+
+// received is the part of a delivered message the tests compare.
+type received struct {
+	replyTo       string
+	correlationID string
+	reply         protocol.Reply
+}
+
+// drain returns the queued messages, sorted by reply queue and correlation id.
+func drain(t *testing.T, b *Broker) []received {
+	t.Helper()
+	var deliveries []received
+	for {
+		select {
+		case msg := <-b.queue:
+			reply, err := protocol.Decode(msg.Body)
+			if err != nil {
+				t.Fatalf("failed to decode message: %v", err)
+			}
+			deliveries = append(deliveries, received{msg.ReplyTo, msg.CorrelationId, reply})
+		default:
+			sort.Slice(deliveries, func(i, j int) bool {
+				if deliveries[i].replyTo != deliveries[j].replyTo {
+					return deliveries[i].replyTo < deliveries[j].replyTo
+				}
+				return deliveries[i].correlationID < deliveries[j].correlationID
+			})
+			return deliveries
+		}
+	}
+}
+
+func TestBroker_Publish(t *testing.T) {
+	b := NewBroker(delivery.NewQueue())
+
+	if count := b.Subscribe("q1", "c1", "news", false); count != 1 {
+		t.Errorf("expected 1 subscription, got: %d", count)
+	}
+	if count := b.Subscribe("q1", "c2", "news.*", true); count != 2 {
+		t.Errorf("expected 2 subscriptions, got: %d", count)
+	}
+	b.Subscribe("q2", "c3", "news", false)
+	b.Subscribe("q3", "c4", "sports", false)
+
+	if delivered := b.Publish("news", "hello"); delivered != 2 {
+		t.Errorf("expected 2 deliveries, got: %d", delivered)
+	}
+	message := protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Value: "hello", Channel: "news"}
+	expected := []received{{"q1", "c1", message}, {"q2", "c3", message}}
+	if deliveries := drain(t, b); !reflect.DeepEqual(deliveries, expected) {
+		t.Errorf("expected deliveries: %+v, got: %+v", expected, deliveries)
+	}
+
+	if delivered := b.Publish("news.eu", "hallo"); delivered != 1 {
+		t.Errorf("expected 1 delivery, got: %d", delivered)
+	}
+	expected = []received{{"q1", "c2", protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Value: "hallo", Channel: "news.eu"}}}
+	if deliveries := drain(t, b); !reflect.DeepEqual(deliveries, expected) {
+		t.Errorf("expected deliveries: %+v, got: %+v", expected, deliveries)
+	}
+
+	if delivered := b.Publish("weather", "sunny"); delivered != 0 {
+		t.Errorf("expected no deliveries, got: %d", delivered)
+	}
+}
+
+func TestBroker_Unsubscribe(t *testing.T) {
+	b := NewBroker(delivery.NewQueue())
+	b.Subscribe("q1", "c1", "news", false)
+	b.Subscribe("q1", "c2", "news*", true)
+	b.Subscribe("q2", "c3", "news", false)
+
+	// A channel and a pattern with the same name are different subscriptions.
+	if removed := b.Unsubscribe("q1", "news*", false); removed != 0 {
+		t.Errorf("expected 0 subscriptions removed, got: %d", removed)
+	}
+	if removed := b.Unsubscribe("q1", "news", false); removed != 1 {
+		t.Errorf("expected 1 subscription removed, got: %d", removed)
+	}
+	if delivered := b.Publish("news", "x"); delivered != 2 {
+		t.Errorf("expected the pattern of q1 and the channel of q2 to get the message, got: %d", delivered)
+	}
+	drain(t, b)
+
+	if removed := b.Unsubscribe("q1", "", false); removed != 1 {
+		t.Errorf("expected 1 subscription removed, got: %d", removed)
+	}
+	b.Drop("q2")
+	if delivered := b.Publish("news", "x"); delivered != 0 {
+		t.Errorf("expected no deliveries, got: %d", delivered)
+	}
+	if len(b.subscriptions) != 0 || len(b.subscribers) != 0 || len(b.patterns) != 0 {
+		t.Errorf("expected no subscriptions left, got: %v %v %v", b.subscriptions, b.subscribers, b.patterns)
+	}
+}
+
+func TestBroker_Run(t *testing.T) {
+	queue := delivery.NewQueue()
+	b := NewBroker(queue)
+	b.Subscribe("q1", "c1", "news", false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replies := make(chan queueservice.Message)
+	go queue.Run(ctx, replies)
+
+	for _, message := range []string{"a", "b", "c"} {
+		b.Publish("news", message)
+	}
+	for _, message := range []string{"a", "b", "c"} {
+		msg := <-replies
+		reply, err := protocol.Decode(msg.Body)
+		if err != nil {
+			t.Fatalf("failed to decode message: %v", err)
+		}
+		if msg.ReplyTo != "q1" || msg.CorrelationId != "c1" || reply.Value != message {
+			t.Errorf("expected message %s to q1, got: %+v", message, msg)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package values
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+)
+
+var (
+	// ErrNotInteger is returned by hincr for a field whose value is not an integer.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrIntegerOverflow is returned by hincr when the result does not fit in 64 bits.
+	ErrIntegerOverflow = errors.New("integer overflow")
+)
+
+// Field is a field of a hash and its value.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Fields are the fields of a hash in insertion order. They are encoded as a JSON
+// object that keeps that order.
+type Fields []Field
+
+func (f Fields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a JSON object of string values, keeping the order of its fields.
+func (f *Fields) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("expected an object of fields")
+	}
+	fields := Fields{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var value string
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("failed to decode field %v: %v", token, err)
+		}
+		fields = append(fields, Field{Name: token.(string), Value: value})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	*f = fields
+	return nil
+}
+
+// fieldsOf returns the fields of a hash.
+func fieldsOf(hash *ds.OrderedMap) Fields {
+	items := hash.GetAll()
+	fields := make(Fields, len(items))
+	for i, item := range items {
+		fields[i] = Field{Name: item.Key, Value: item.Value.(string)}
+	}
+	return fields
+}
+
+// newHash returns a hash holding the fields in order.
+func newHash(fields Fields) *ds.OrderedMap {
+	hash := ds.NewOrderedMap()
+	for _, field := range fields {
+		hash.Add(field.Name, field.Value, 0)
+	}
+	return hash
+}
+
+// hashOf returns the current hash, or a new one if there is no current value.
+func hashOf(current interface{}, exists bool) (*ds.OrderedMap, error) {
+	if !exists {
+		return ds.NewOrderedMap(), nil
+	}
+	if err := Check(current, TypeHash); err != nil {
+		return nil, err
+	}
+	return current.(*ds.OrderedMap), nil
+}
+
+// prepareHash prepares hset, hdel and hincr. hset results in 1 if it added the
+// field and 0 if it replaced its value, hdel in the number of fields removed and
+// hincr in the new value of the field.
+func prepareHash(current interface{}, exists bool, update string, args []string) (Update, error) {
+	hash, err := hashOf(current, exists)
+	if err != nil {
+		return nil, err
+	}
+
+	switch update {
+	case HSet:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected a field and a value, got %d arguments", len(args))
+		}
+		return func() (interface{}, interface{}) {
+			_, existed := hash.Get(args[0])
+			hash.Add(args[0], args[1], 0)
+			if existed {
+				return hash, 0
+			}
+			return hash, 1
+		}, nil
+	case HDel:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expected fields to delete")
+		}
+		return func() (interface{}, interface{}) {
+			removed := 0
+			for _, field := range args {
+				if _, exists := hash.Get(field); exists {
+					hash.Remove(field)
+					removed++
+				}
+			}
+			if hash.Len() == 0 {
+				return nil, removed
+			}
+			return hash, removed
+		}, nil
+	default:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected a field and a delta, got %d arguments", len(args))
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delta %q", args[1])
+		}
+		var n int64
+		if value, exists := hash.Get(args[0]); exists {
+			if n, err = strconv.ParseInt(value.(string), 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: field %s holds %q", ErrNotInteger, args[0], value)
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, fmt.Errorf("%w: field %s would be %d %+d", ErrIntegerOverflow, args[0], n, delta)
+		}
+		return func() (interface{}, interface{}) {
+			hash.Add(args[0], strconv.FormatInt(n+delta, 10), 0)
+			return hash, n + delta
+		}, nil
+	}
+}
@@ -0,0 +1,138 @@
+package values
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/avalkov/SCS/internal/domain/jsonpath"
+)
+
+// Document is a JSON document. Numbers are kept as json.Number, so they are
+// encoded exactly as they were written.
+type Document struct {
+	root interface{}
+}
+
+// ParseJSON decodes a single JSON value, rejecting malformed JSON and trailing data.
+func ParseJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("malformed JSON: data after the value")
+	}
+	return value, nil
+}
+
+// Get returns the encoded node at the path, reporting whether it exists.
+func (d *Document) Get(path jsonpath.Path) (json.RawMessage, bool) {
+	node, ok := path.Get(d.root)
+	if !ok {
+		return nil, false
+	}
+	return marshalJSON(node), true
+}
+
+// Has reports whether the node at the path exists.
+func (d *Document) Has(path jsonpath.Path) bool {
+	_, ok := path.Get(d.root)
+	return ok
+}
+
+// marshalJSON encodes a decoded document, which cannot fail.
+func marshalJSON(node interface{}) json.RawMessage {
+	data, _ := json.Marshal(node)
+	return data
+}
+
+// copyJSON returns a deep copy of a decoded document.
+func copyJSON(node interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			copied[k] = copyJSON(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(n))
+		for i, v := range n {
+			copied[i] = copyJSON(v)
+		}
+		return copied
+	default:
+		return node
+	}
+}
+
+// documentOf returns the current document, or nil if there is no current value.
+func documentOf(current interface{}, exists bool) (*Document, error) {
+	if !exists {
+		return nil, nil
+	}
+	if err := Check(current, TypeJSON); err != nil {
+		return nil, err
+	}
+	return current.(*Document), nil
+}
+
+// prepareJSON prepares jsonSet, whose arguments are a path and a JSON value, and
+// jsonDel, whose argument is a path and which results in 1 if it removed a node
+// and 0 otherwise. A document is created by setting its root, or any path made
+// of fields, which starts it as an object.
+func prepareJSON(current interface{}, exists bool, update string, args []string) (Update, error) {
+	doc, err := documentOf(current, exists)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected a path")
+	}
+	path, err := jsonpath.Parse(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %v", args[0], err)
+	}
+
+	if update == JSONDel {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a path, got %d arguments", len(args))
+		}
+		return func() (interface{}, interface{}) {
+			if doc == nil {
+				return nil, 0
+			}
+			root, removed := path.Delete(doc.root)
+			if !removed {
+				return doc, 0
+			}
+			if len(path) == 0 {
+				return nil, 1
+			}
+			doc.root = root
+			return doc, 1
+		}, nil
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expected a path and a value, got %d arguments", len(args))
+	}
+	value, err := ParseJSON(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = &Document{root: map[string]interface{}{}}
+	}
+	if err := path.CanSet(doc.root); err != nil {
+		return nil, err
+	}
+	return func() (interface{}, interface{}) {
+		doc.root, _ = path.Set(doc.root, value)
+		return doc, nil
+	}, nil
+}
@@ -0,0 +1,121 @@
+package values
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+)
+
+// newSortedSet returns a sorted set holding the members.
+func newSortedSet(members []ds.ScoredMember) *ds.SortedSet {
+	set := ds.NewSortedSet()
+	for _, m := range members {
+		set.Add(m.Member, m.Score)
+	}
+	return set
+}
+
+// setOf returns the current set, or a new one if there is no current value.
+func setOf(current interface{}, exists bool) (*ds.Set, error) {
+	if !exists {
+		return ds.NewSet(), nil
+	}
+	if err := Check(current, TypeSet); err != nil {
+		return nil, err
+	}
+	return current.(*ds.Set), nil
+}
+
+// sortedSetOf returns the current sorted set, or a new one if there is no current value.
+func sortedSetOf(current interface{}, exists bool) (*ds.SortedSet, error) {
+	if !exists {
+		return ds.NewSortedSet(), nil
+	}
+	if err := Check(current, TypeSortedSet); err != nil {
+		return nil, err
+	}
+	return current.(*ds.SortedSet), nil
+}
+
+// FormatScore formats a score the way ParseScore reads it back exactly.
+func FormatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// ParseScore parses a finite score.
+func ParseScore(text string) (float64, error) {
+	score, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(score) || math.IsInf(score, 0) {
+		return 0, fmt.Errorf("invalid score %q", text)
+	}
+	return score, nil
+}
+
+// prepareSet prepares sadd and srem, which result in the number of members added
+// or removed.
+func prepareSet(current interface{}, exists bool, update string, args []string) (Update, error) {
+	set, err := setOf(current, exists)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected members")
+	}
+
+	if update == SAdd {
+		return func() (interface{}, interface{}) {
+			return set, set.Add(args...)
+		}, nil
+	}
+	return func() (interface{}, interface{}) {
+		removed := set.Remove(args...)
+		if set.Len() == 0 {
+			return nil, removed
+		}
+		return set, removed
+	}, nil
+}
+
+// prepareSortedSet prepares zadd, whose arguments are a member and its score and
+// which results in 1 if it added the member and 0 if it updated its score, and
+// zrem, which results in the number of members removed.
+func prepareSortedSet(current interface{}, exists bool, update string, args []string) (Update, error) {
+	set, err := sortedSetOf(current, exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if update == ZAdd {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected a member and a score, got %d arguments", len(args))
+		}
+		score, err := ParseScore(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func() (interface{}, interface{}) {
+			if set.Add(args[0], score) {
+				return set, 1
+			}
+			return set, 0
+		}, nil
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected members")
+	}
+	return func() (interface{}, interface{}) {
+		removed := 0
+		for _, member := range args {
+			if set.Remove(member) {
+				removed++
+			}
+		}
+		if set.Len() == 0 {
+			return nil, removed
+		}
+		return set, removed
+	}, nil
+}
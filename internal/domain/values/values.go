@@ -0,0 +1,283 @@
+package values
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+)
+
+// Type names of stored values.
+const (
+	TypeString    = "string"
+	TypeList      = "list"
+	TypeHash      = "hash"
+	TypeSet       = "set"
+	TypeSortedSet = "zset"
+	TypeJSON      = "json"
+)
+
+// Updates of typed values, changing them in place. They are logged by name
+// together with their arguments and replayed on startup with Apply.
+const (
+	// LPush and RPush push their arguments to the front or back of a list.
+	LPush = "lpush"
+	RPush = "rpush"
+	// LPop and RPop pop as many values as their argument from the front or back of a list.
+	LPop = "lpop"
+	RPop = "rpop"
+	// HSet sets a field of a hash to a value, HDel removes fields and HIncr adds
+	// a delta to the integer value of a field.
+	HSet  = "hset"
+	HDel  = "hdel"
+	HIncr = "hincr"
+	// SAdd adds members to a set and SRem removes them.
+	SAdd = "sadd"
+	SRem = "srem"
+	// ZAdd sets the score of a member of a sorted set and ZRem removes members.
+	ZAdd = "zadd"
+	ZRem = "zrem"
+	// JSONSet sets the node at a path of a JSON document and JSONDel removes it.
+	JSONSet = "jsonSet"
+	JSONDel = "jsonDel"
+)
+
+// WrongTypeError is returned for an operation on a value of another type.
+type WrongTypeError struct {
+	Have string
+	Want string
+}
+
+func (e *WrongTypeError) Error() string {
+	return fmt.Sprintf("value is a %s, not a %s", e.Have, e.Want)
+}
+
+// TypeOf returns the type name of a stored value.
+func TypeOf(value interface{}) string {
+	switch value.(type) {
+	case *ds.List:
+		return TypeList
+	case *ds.OrderedMap:
+		return TypeHash
+	case *ds.Set:
+		return TypeSet
+	case *ds.SortedSet:
+		return TypeSortedSet
+	case *Document:
+		return TypeJSON
+	default:
+		return TypeString
+	}
+}
+
+// Check returns a WrongTypeError unless the value is of type want.
+func Check(value interface{}, want string) error {
+	if have := TypeOf(value); have != want {
+		return &WrongTypeError{Have: have, Want: want}
+	}
+	return nil
+}
+
+// Export returns a copy of a stored value that stays unchanged by later updates,
+// so it can be encoded after the store is unlocked. Lists and sets become slices,
+// sorted sets slices of scored members, hashes Fields and JSON documents their
+// encoding, so they are embedded in replies as JSON.
+func Export(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *ds.List:
+		return v.Values()
+	case *ds.OrderedMap:
+		return fieldsOf(v)
+	case *ds.Set:
+		return v.Members()
+	case *ds.SortedSet:
+		return v.Range(0, -1)
+	case *Document:
+		return marshalJSON(v.root)
+	default:
+		return value
+	}
+}
+
+// Copy returns a copy of a stored value of the same type, so it can be read once
+// the store is unlocked.
+func Copy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *ds.List:
+		list := ds.NewList()
+		list.PushBack(v.Values()...)
+		return list
+	case *ds.OrderedMap:
+		return newHash(fieldsOf(v))
+	case *ds.Set:
+		set := ds.NewSet()
+		set.Add(v.Members()...)
+		return set
+	case *ds.SortedSet:
+		return newSortedSet(v.Range(0, -1))
+	case *Document:
+		return &Document{root: copyJSON(v.root)}
+	default:
+		return value
+	}
+}
+
+// Encode returns the type name of a value and its text form, which is the value
+// itself for strings and its JSON encoding for other types.
+func Encode(value interface{}) (string, string, error) {
+	switch v := value.(type) {
+	case string:
+		return TypeString, v, nil
+	case *ds.List:
+		data, err := json.Marshal(v.Values())
+		return TypeList, string(data), err
+	case *ds.OrderedMap:
+		data, err := json.Marshal(fieldsOf(v))
+		return TypeHash, string(data), err
+	case *ds.Set:
+		data, err := json.Marshal(v.Members())
+		return TypeSet, string(data), err
+	case *ds.SortedSet:
+		data, err := json.Marshal(v.Range(0, -1))
+		return TypeSortedSet, string(data), err
+	case *Document:
+		return TypeJSON, string(marshalJSON(v.root)), nil
+	default:
+		return "", "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+// Decode is the inverse of Encode. An empty type name stands for a string.
+func Decode(typeName string, text string) (interface{}, error) {
+	switch typeName {
+	case "", TypeString:
+		return text, nil
+	case TypeList:
+		var items []string
+		if err := json.Unmarshal([]byte(text), &items); err != nil {
+			return nil, fmt.Errorf("failed to decode list: %v", err)
+		}
+		list := ds.NewList()
+		list.PushBack(items...)
+		return list, nil
+	case TypeHash:
+		var fields Fields
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			return nil, fmt.Errorf("failed to decode hash: %v", err)
+		}
+		return newHash(fields), nil
+	case TypeSet:
+		var members []string
+		if err := json.Unmarshal([]byte(text), &members); err != nil {
+			return nil, fmt.Errorf("failed to decode set: %v", err)
+		}
+		set := ds.NewSet()
+		set.Add(members...)
+		return set, nil
+	case TypeSortedSet:
+		var members []ds.ScoredMember
+		if err := json.Unmarshal([]byte(text), &members); err != nil {
+			return nil, fmt.Errorf("failed to decode sorted set: %v", err)
+		}
+		return newSortedSet(members), nil
+	case TypeJSON:
+		root, err := ParseJSON(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JSON document: %v", err)
+		}
+		return &Document{root: root}, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %q", typeName)
+	}
+}
+
+// Update is an update validated by Prepare, ready to be applied.
+type Update func() (value interface{}, result interface{})
+
+// Prepare validates the update of the current value, which exists only if exists
+// is set, and returns the function applying it. Applying it changes the value in
+// place, or creates it if it does not exist, and returns the updated value, nil
+// once it is left empty, together with the result of the update. Nothing is
+// changed if the update is invalid, so it can be logged before being applied.
+func Prepare(current interface{}, exists bool, update string, args []string) (Update, error) {
+	switch update {
+	case LPush, RPush:
+		list, err := listOf(current, exists)
+		if err != nil {
+			return nil, err
+		}
+		return func() (interface{}, interface{}) {
+			if update == LPush {
+				list.PushFront(args...)
+			} else {
+				list.PushBack(args...)
+			}
+			return list, list.Len()
+		}, nil
+	case LPop, RPop:
+		list, err := listOf(current, exists)
+		if err != nil {
+			return nil, err
+		}
+		count, err := countArg(args)
+		if err != nil {
+			return nil, err
+		}
+		return func() (interface{}, interface{}) {
+			var popped []string
+			if update == LPop {
+				popped = list.PopFront(count)
+			} else {
+				popped = list.PopBack(count)
+			}
+			if list.Len() == 0 {
+				return nil, popped
+			}
+			return list, popped
+		}, nil
+	case HSet, HDel, HIncr:
+		return prepareHash(current, exists, update, args)
+	case SAdd, SRem:
+		return prepareSet(current, exists, update, args)
+	case ZAdd, ZRem:
+		return prepareSortedSet(current, exists, update, args)
+	case JSONSet, JSONDel:
+		return prepareJSON(current, exists, update, args)
+	default:
+		return nil, fmt.Errorf("unknown update %q", update)
+	}
+}
+
+// Apply validates and applies the update the way Prepare does.
+func Apply(current interface{}, exists bool, update string, args []string) (interface{}, interface{}, error) {
+	apply, err := Prepare(current, exists, update, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, result := apply()
+	return value, result, nil
+}
+
+// listOf returns the current list, or a new one if there is no current value.
+func listOf(current interface{}, exists bool) (*ds.List, error) {
+	if !exists {
+		return ds.NewList(), nil
+	}
+	if err := Check(current, TypeList); err != nil {
+		return nil, err
+	}
+	return current.(*ds.List), nil
+}
+
+// countArg parses the single argument of an update as a positive count.
+func countArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a count, got %d arguments", len(args))
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid count %q", args[0])
+	}
+	return count, nil
+}
@@ -0,0 +1,199 @@
+package values
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+)
+
+func TestApply_Lists(t *testing.T) {
+	value, result, err := Apply(nil, false, RPush, []string{"a", "b"})
+	if err != nil || result != 2 {
+		t.Fatalf("expected a list of length 2, got: %v, %v", result, err)
+	}
+	value, result, err = Apply(value, true, LPop, []string{"1"})
+	if err != nil || !reflect.DeepEqual(result, []string{"a"}) {
+		t.Fatalf("expected to pop [a], got: %v, %v", result, err)
+	}
+	value, result, err = Apply(value, true, RPop, []string{"5"})
+	if err != nil || value != nil || !reflect.DeepEqual(result, []string{"b"}) {
+		t.Errorf("expected the emptied list to be removed after popping [b], got: %v, %v, %v", value, result, err)
+	}
+
+	var wrongType *WrongTypeError
+	if _, _, err := Apply("text", true, RPush, []string{"a"}); !errors.As(err, &wrongType) || wrongType.Have != TypeString || wrongType.Want != TypeList {
+		t.Errorf("expected a wrong type error, got: %v", err)
+	}
+	for _, args := range [][]string{nil, {"0"}, {"x"}, {"1", "2"}} {
+		if _, err := Prepare(ds.NewList(), true, LPop, args); err == nil {
+			t.Errorf("expected pop with arguments %v to fail", args)
+		}
+	}
+	if _, err := Prepare(nil, false, "unknown", nil); err == nil {
+		t.Errorf("expected an unknown update to fail")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	list := ds.NewList()
+	list.PushBack("a", "b")
+	hash := newHash(Fields{{"b", "1"}, {"a", "2"}})
+	set := ds.NewSet()
+	set.Add("b", "a")
+	sortedSet := newSortedSet([]ds.ScoredMember{{Member: "b", Score: 0.1}, {Member: "a", Score: -3}})
+
+	doc, _ := ParseJSON(`{"a":[1.50,"x",null]}`)
+
+	for _, value := range []interface{}{"text", list, hash, set, sortedSet, &Document{root: doc}} {
+		typeName, text, err := Encode(value)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", value, err)
+		}
+		decoded, err := Decode(typeName, text)
+		if err != nil {
+			t.Fatalf("failed to decode %q: %v", text, err)
+		}
+		if !reflect.DeepEqual(Export(decoded), Export(value)) {
+			t.Errorf("expected %v after a round trip, got: %v", Export(value), Export(decoded))
+		}
+	}
+
+	if _, err := Decode(TypeList, "not json"); err == nil {
+		t.Errorf("expected malformed list to fail decoding")
+	}
+	if _, err := Decode("unknown", ""); err == nil {
+		t.Errorf("expected unknown type to fail decoding")
+	}
+}
+
+func TestApply_Hashes(t *testing.T) {
+	value, result, err := Apply(nil, false, HSet, []string{"name", "Ann"})
+	if err != nil || result != 1 {
+		t.Fatalf("expected to add a field, got: %v, %v", result, err)
+	}
+	value, _, _ = Apply(value, true, HSet, []string{"visits", "1"})
+	if _, result, _ = Apply(value, true, HSet, []string{"name", "Bob"}); result != 0 {
+		t.Errorf("expected to replace a field, got: %v", result)
+	}
+	if _, result, err = Apply(value, true, HIncr, []string{"visits", "-3"}); err != nil || result != int64(-2) {
+		t.Errorf("expected visits -2, got: %v, %v", result, err)
+	}
+	if _, _, err = Apply(value, true, HIncr, []string{"name", "1"}); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("expected a not integer error, got: %v", err)
+	}
+	if _, _, err = Apply(value, true, HIncr, []string{"visits", "-9223372036854775807"}); !errors.Is(err, ErrIntegerOverflow) {
+		t.Errorf("expected an overflow error, got: %v", err)
+	}
+	if fields := Export(value); !reflect.DeepEqual(fields, Fields{{"name", "Bob"}, {"visits", "-2"}}) {
+		t.Errorf("expected fields in insertion order, got: %v", fields)
+	}
+
+	if _, result, _ = Apply(value, true, HDel, []string{"name", "missing"}); result != 1 {
+		t.Errorf("expected 1 field removed, got: %v", result)
+	}
+	if value, result, _ = Apply(value, true, HDel, []string{"visits"}); value != nil || result != 1 {
+		t.Errorf("expected the emptied hash to be removed, got: %v, %v", value, result)
+	}
+	if _, err := Prepare(ds.NewList(), true, HSet, []string{"a", "b"}); err == nil {
+		t.Errorf("expected hset on a list to fail")
+	}
+}
+
+func TestFields_JSON(t *testing.T) {
+	fields := Fields{{"z", "1"}, {"a", `"quoted"`}, {"m", ""}}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("failed to encode fields: %v", err)
+	}
+	if string(data) != `{"z":"1","a":"\"quoted\"","m":""}` {
+		t.Errorf("expected fields in order, got: %s", data)
+	}
+
+	var decoded Fields
+	if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, fields) {
+		t.Errorf("expected %v after a round trip, got: %v, %v", fields, decoded, err)
+	}
+	for _, malformed := range []string{`[]`, `{"a":1}`, `{"a":"b"`} {
+		if err := json.Unmarshal([]byte(malformed), &decoded); err == nil {
+			t.Errorf("expected %s to fail decoding", malformed)
+		}
+	}
+}
+
+func TestApply_Sets(t *testing.T) {
+	value, result, err := Apply(nil, false, SAdd, []string{"a", "b", "a"})
+	if err != nil || result != 2 {
+		t.Fatalf("expected 2 members added, got: %v, %v", result, err)
+	}
+	if value, result, _ = Apply(value, true, SRem, []string{"a", "x"}); result != 1 {
+		t.Errorf("expected 1 member removed, got: %v", result)
+	}
+	if value, _, _ = Apply(value, true, SRem, []string{"b"}); value != nil {
+		t.Errorf("expected the emptied set to be removed, got: %v", value)
+	}
+
+	value, result, err = Apply(nil, false, ZAdd, []string{"a", "2.5"})
+	if err != nil || result != 1 {
+		t.Fatalf("expected a member added, got: %v, %v", result, err)
+	}
+	value, _, _ = Apply(value, true, ZAdd, []string{"b", "1"})
+	if _, result, _ = Apply(value, true, ZAdd, []string{"a", "0.5"}); result != 0 {
+		t.Errorf("expected a score updated, got: %v", result)
+	}
+	expected := []ds.ScoredMember{{Member: "a", Score: 0.5}, {Member: "b", Score: 1}}
+	if members := Export(value); !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected members %v, got: %v", expected, members)
+	}
+	for _, args := range [][]string{{"a"}, {"a", "x"}, {"a", "NaN"}, {"a", "Inf"}} {
+		if _, err := Prepare(value, true, ZAdd, args); err == nil {
+			t.Errorf("expected zadd with arguments %v to fail", args)
+		}
+	}
+	if _, err := Prepare(value, true, SAdd, []string{"a"}); err == nil {
+		t.Errorf("expected sadd on a sorted set to fail")
+	}
+	if value, result, _ = Apply(value, true, ZRem, []string{"a", "b"}); value != nil || result != 2 {
+		t.Errorf("expected the emptied sorted set to be removed, got: %v, %v", value, result)
+	}
+}
+
+func TestApply_JSON(t *testing.T) {
+	value, _, err := Apply(nil, false, JSONSet, []string{"$.address.city", `"Varna"`})
+	if err != nil {
+		t.Fatalf("failed to create a document: %v", err)
+	}
+	value, _, _ = Apply(value, true, JSONSet, []string{"$.items", `[1, 2e3, {"id": 7}]`})
+	if _, _, err := Apply(value, true, JSONSet, []string{"$.items", `[1,`}); err == nil {
+		t.Errorf("expected malformed JSON to be rejected")
+	}
+	if _, _, err := Apply(value, true, JSONSet, []string{"$.items", `1 2`}); err == nil {
+		t.Errorf("expected trailing data to be rejected")
+	}
+	if _, _, err := Apply(value, true, JSONSet, []string{"$.address.city.name", `"x"`}); err == nil {
+		t.Errorf("expected setting a field of a string to fail")
+	}
+	if _, err := Prepare(value, true, JSONSet, []string{"address", `"x"`}); err == nil {
+		t.Errorf("expected an invalid path to fail")
+	}
+
+	value, result, _ := Apply(value, true, JSONDel, []string{"$.items[0]"})
+	if result != 1 {
+		t.Errorf("expected a node removed, got: %v", result)
+	}
+	if _, result, _ = Apply(value, true, JSONDel, []string{"$.missing"}); result != 0 {
+		t.Errorf("expected nothing removed, got: %v", result)
+	}
+	expected := `{"address":{"city":"Varna"},"items":[2e3,{"id":7}]}`
+	if data := Export(value); string(data.(json.RawMessage)) != expected {
+		t.Errorf("expected document %s, got: %s", expected, data)
+	}
+	if value, result, _ = Apply(value, true, JSONDel, []string{"$"}); value != nil || result != 1 {
+		t.Errorf("expected deleting the root to remove the document, got: %v, %v", value, result)
+	}
+	if _, err := Prepare("text", true, JSONSet, []string{"$", `1`}); err == nil {
+		t.Errorf("expected jsonSet on a string to fail")
+	}
+}
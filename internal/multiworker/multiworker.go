@@ -3,45 +3,62 @@ package multiworker
 import (
 	"context"
 	"log"
-	"strconv"
 	"sync"
 
 	ds "github.com/avalkov/SCS/internal/datastructures"
+	cmd_parser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/protocol"
 	"github.com/avalkov/SCS/internal/queueservice"
 )
 
+// routerID identifies the router in dead-lettered requests it rejects.
+const routerID = "router"
+
 type MultiWorker struct {
-	workersCount      int
+	partitioner       *ds.Partitioner
 	commandsParser    CommandsParser
 	commandsProcessor CommandsProcessor
+	subscriptions     Subscriptions
+	broker            Broker
+	maxReplySize      int
 }
 
-func NewMultiWorker(workersCount int, commandsParser CommandsParser, commandsProcessor CommandsProcessor) *MultiWorker {
+// NewMultiWorker creates a MultiWorker running one worker per partition. The same
+// partitioner must be given to the commands processor so both agree on key ownership.
+// Key subscriptions are registered with subscriptions and channel subscriptions and
+// messages are handed to broker; either may be nil if it is not supported. Replies
+// larger than maxReplySize bytes are streamed in chunks; 0 disables chunking.
+func NewMultiWorker(partitioner *ds.Partitioner, commandsParser CommandsParser, commandsProcessor CommandsProcessor, subscriptions Subscriptions, broker Broker, maxReplySize int) *MultiWorker {
 	return &MultiWorker{
-		workersCount:      workersCount,
+		partitioner:       partitioner,
 		commandsParser:    commandsParser,
 		commandsProcessor: commandsProcessor,
+		subscriptions:     subscriptions,
+		broker:            broker,
+		maxReplySize:      maxReplySize,
 	}
 }
 
 func (mw *MultiWorker) Run(ctx context.Context, requests <-chan queueservice.Message, replies chan<- queueservice.Message) {
 	defer ctx.Done()
 
-	consistentHash := ds.NewConsistentHash(mw.workersCount, nil)
+	workersCount := mw.partitioner.Workers()
 
-	for i := 0; i < mw.workersCount; i++ {
-		consistentHash.Add(strconv.Itoa(i))
+	if mw.maxReplySize > 0 {
+		unsplit := make(chan queueservice.Message)
+		go mw.runSplitter(ctx, unsplit, replies)
+		replies = unsplit
 	}
 
-	workerChans := make([]chan queueservice.Message, mw.workersCount)
+	workerChans := make([]chan protocol.Request, workersCount)
 	for i := range workerChans {
-		workerChans[i] = make(chan queueservice.Message)
+		workerChans[i] = make(chan protocol.Request)
 	}
 
 	var wg sync.WaitGroup
 
 	// Start worker goroutines
-	for i := 0; i < mw.workersCount; i++ {
+	for i := 0; i < workersCount; i++ {
 		wg.Add(1)
 		go mw.commandsProcessor.Process(i, workerChans[i], replies, &wg)
 	}
@@ -50,24 +67,40 @@ func (mw *MultiWorker) Run(ctx context.Context, requests <-chan queueservice.Mes
 	// Route requests to the appropriate worker based on consistent hashing
 	go func() {
 		for req := range requests {
-			commandID, err := mw.commandsParser.GetCommandID(req.Body)
+			cmd, err := mw.commandsParser.ParseCommand(req.Body)
 			if err != nil {
-				log.Printf("Failed to get command ID: %v", err)
-				replies <- queueservice.Message{
-					Body:          "Failed to get command ID",
-					ReplyTo:       req.ReplyTo,
-					CorrelationId: req.CorrelationId,
-				}
+				log.Printf("Failed to parse command: %v", err)
+				replies <- protocol.NewMessage(routerID, req, protocol.Error("", "", protocol.ErrInvalidCommand, "failed to parse command: %v", err))
 				continue
 			}
 
-			workerID := consistentHash.Get(commandID)
-			workerIndex, err := strconv.Atoi(workerID)
-			if err != nil {
-				log.Printf("Failed to convert worker ID to index: %v", err)
+			switch cmd.Type {
+			case cmd_parser.Transaction:
+				involved := make([]bool, len(workerChans))
+				for _, sub := range cmd.Commands {
+					involved[mw.partitioner.WorkerFor(sub.Key)] = true
+				}
+				mw.runHeld(req, cmd, involved, workerChans, replies)
+				continue
+			case cmd_parser.GetAllItems, cmd_parser.Scan, cmd_parser.GetItemsByPrefix, cmd_parser.CountItems, cmd_parser.DeleteItems:
+				all := make([]bool, len(workerChans))
+				for i := range all {
+					all[i] = true
+				}
+				mw.runHeld(req, cmd, all, workerChans, replies)
+				continue
+			case cmd_parser.GetItems, cmd_parser.AddItems:
+				mw.scatter(req, cmd, workerChans, replies)
+				continue
+			case cmd_parser.Subscribe, cmd_parser.Unsubscribe:
+				replies <- protocol.NewMessage(routerID, req, mw.subscribe(req, cmd))
+				continue
+			case cmd_parser.Publish:
+				replies <- protocol.NewMessage(routerID, req, mw.publish(cmd))
 				continue
 			}
-			workerChans[workerIndex] <- req
+
+			workerChans[mw.partitioner.WorkerFor(cmd.Key)] <- protocol.Request{Message: req, Command: cmd}
 		}
 	}()
 
@@ -79,10 +112,168 @@ func (mw *MultiWorker) Run(ctx context.Context, requests <-chan queueservice.Mes
 	}
 }
 
+// runSplitter forwards replies to the transport, streaming the ones larger than
+// maxReplySize in chunks. The chunks of a reply are forwarded back to back, so
+// they are sent in order.
+func (mw *MultiWorker) runSplitter(ctx context.Context, unsplit <-chan queueservice.Message, replies chan<- queueservice.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-unsplit:
+			for _, chunk := range protocol.Split(msg, mw.maxReplySize) {
+				select {
+				case replies <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// runHeld holds the involved workers and executes the command once all of them are
+// held. This is how transactions are applied across workers and how commands on
+// all keys, such as getAllItems, scan or deleteItems, hold every worker to see one
+// consistent cut of the store. A worker is held as
+// soon as it receives the hold, so requests routed before the command are processed
+// before it and requests routed after it wait until it is done, keeping the per-key
+// order. Holds are only taken here, by the single router, and a held command never
+// waits for the router, so held commands cannot deadlock each other.
+func (mw *MultiWorker) runHeld(req queueservice.Message, cmd cmd_parser.Command, involved []bool, workerChans []chan protocol.Request, replies chan<- queueservice.Message) {
+	hold := make(chan struct{})
+	for i, ok := range involved {
+		if ok {
+			workerChans[i] <- protocol.Request{Hold: hold}
+		}
+	}
+
+	go func() {
+		reply := mw.commandsProcessor.ExecuteHeld(cmd)
+		close(hold)
+		replies <- protocol.NewMessage(routerID, req, reply)
+	}()
+}
+
+// part is the share of a multi-key command sent to one worker.
+type part struct {
+	worker  int
+	indexes []int
+	results chan protocol.Reply
+}
+
+// scatter splits a multi-key command by the worker owning each key, sends every
+// worker its part and merges the partial replies into one reply, in the original
+// key order. Workers answer on buffered channels, so neither they nor the router
+// wait for the merge.
+func (mw *MultiWorker) scatter(req queueservice.Message, cmd cmd_parser.Command, workerChans []chan protocol.Request, replies chan<- queueservice.Message) {
+	byWorker := make([]*part, len(workerChans))
+	var parts []*part
+	for i, sub := range cmd.Commands {
+		worker := mw.partitioner.WorkerFor(sub.Key)
+		if byWorker[worker] == nil {
+			byWorker[worker] = &part{worker: worker, results: make(chan protocol.Reply, 1)}
+			parts = append(parts, byWorker[worker])
+		}
+		byWorker[worker].indexes = append(byWorker[worker].indexes, i)
+	}
+
+	for _, p := range parts {
+		share := cmd
+		share.Commands = make([]cmd_parser.Command, len(p.indexes))
+		for j, i := range p.indexes {
+			share.Commands[j] = cmd.Commands[i]
+		}
+		workerChans[p.worker] <- protocol.Request{Message: req, Command: share, Results: p.results}
+	}
+
+	go func() {
+		results := make([]protocol.Reply, len(cmd.Commands))
+		for _, p := range parts {
+			partial := <-p.results
+			shareResults, _ := partial.Value.([]protocol.Reply)
+			for j, i := range p.indexes {
+				if j < len(shareResults) {
+					results[i] = shareResults[j]
+				} else {
+					results[i] = protocol.Error(cmd.Commands[i].Type.String(), cmd.Commands[i].Key, partial.ErrorCode, "%s", partial.Error)
+				}
+			}
+		}
+		replies <- protocol.NewMessage(routerID, req, protocol.Batch(cmd.Type.String(), results))
+	}()
+}
+
+// subscribe registers or removes the key or channel subscriptions of the request's
+// reply queue. Subscriptions do not involve any worker, so they are handled by the
+// router. unsubscribe without a key pattern or channel removes both kinds.
+func (mw *MultiWorker) subscribe(req queueservice.Message, cmd cmd_parser.Command) protocol.Reply {
+	reply := protocol.OK(cmd.Type.String(), "")
+	reply.Channel = cmd.Channel
+	channels := cmd.Channel != ""
+	all := cmd.Type == cmd_parser.Unsubscribe && !channels && cmd.Match == ""
+	if (channels || all) && mw.broker == nil {
+		return protocol.Error(reply.Command, "", protocol.ErrUnknownCommand, "channels are not supported")
+	}
+	if (!channels || all) && mw.subscriptions == nil {
+		return protocol.Error(reply.Command, "", protocol.ErrUnknownCommand, "key subscriptions are not supported")
+	}
+	if req.ReplyTo == "" {
+		return protocol.Error(reply.Command, "", protocol.ErrInvalidCommand, "%s requires a reply queue", reply.Command)
+	}
+
+	switch {
+	case cmd.Type == cmd_parser.Subscribe && channels:
+		reply.Value = mw.broker.Subscribe(req.ReplyTo, req.CorrelationId, cmd.Channel, cmd.ChannelPattern)
+	case cmd.Type == cmd_parser.Subscribe:
+		reply.Value = mw.subscriptions.Subscribe(req.ReplyTo, req.CorrelationId, cmd.Match)
+	case all:
+		reply.Value = mw.subscriptions.Unsubscribe(req.ReplyTo, "") + mw.broker.Unsubscribe(req.ReplyTo, "", false)
+	case channels:
+		reply.Value = mw.broker.Unsubscribe(req.ReplyTo, cmd.Channel, cmd.ChannelPattern)
+	default:
+		reply.Value = mw.subscriptions.Unsubscribe(req.ReplyTo, cmd.Match)
+	}
+	return reply
+}
+
+// publish hands the message to the broker, replying with the number of
+// subscriptions it is delivered to.
+func (mw *MultiWorker) publish(cmd cmd_parser.Command) protocol.Reply {
+	reply := protocol.OK(cmd.Type.String(), "")
+	if mw.broker == nil {
+		return protocol.Error(reply.Command, "", protocol.ErrUnknownCommand, "channels are not supported")
+	}
+	reply.Channel = cmd.Channel
+	reply.Value = mw.broker.Publish(cmd.Channel, cmd.Value)
+	return reply
+}
+
 type CommandsProcessor interface {
-	Process(processorID int, requests <-chan queueservice.Message, replies chan<- queueservice.Message, wg *sync.WaitGroup)
+	Process(processorID int, requests <-chan protocol.Request, replies chan<- queueservice.Message, wg *sync.WaitGroup)
+	// ExecuteHeld executes a transaction or a command on all keys while the workers it touches are held.
+	ExecuteHeld(cmd cmd_parser.Command) protocol.Reply
+}
+
+// Subscriptions keeps the key subscriptions of reply queues.
+type Subscriptions interface {
+	// Subscribe returns how many patterns the reply queue is subscribed to.
+	Subscribe(replyTo string, correlationID string, pattern string) int
+	// Unsubscribe returns how many subscriptions were removed; an empty pattern removes all.
+	Unsubscribe(replyTo string, pattern string) int
+}
+
+// Broker keeps the channel subscriptions of reply queues and delivers the messages
+// published to them.
+type Broker interface {
+	// Publish returns how many subscriptions the message is delivered to.
+	Publish(channel string, message string) int
+	// Subscribe returns how many channels and patterns the reply queue is subscribed to.
+	Subscribe(replyTo string, correlationID string, channel string, pattern bool) int
+	// Unsubscribe returns how many subscriptions were removed; an empty channel removes all.
+	Unsubscribe(replyTo string, channel string, pattern bool) int
 }
 
 type CommandsParser interface {
-	GetCommandID(command string) (string, error)
+	ParseCommand(command string) (cmd_parser.Command, error)
 }
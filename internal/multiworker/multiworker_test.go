@@ -4,15 +4,20 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	cmdParser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	"github.com/avalkov/SCS/internal/domain/protocol"
 	"github.com/avalkov/SCS/internal/queueservice"
 )
 
 func TestMultiWorker_Run(t *testing.T) {
 	commandsParser := &mockCommandsParser{}
 	commandsProcessor := &mockCommandProcessor{}
-	multiWorker := NewMultiWorker(3, commandsParser, commandsProcessor)
+	multiWorker := NewMultiWorker(ds.NewPartitioner(3), commandsParser, commandsProcessor, nil, nil, 0)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -51,7 +56,7 @@ func TestMultiWorker_Run(t *testing.T) {
 				Body: "invalid",
 			},
 			expectedReply: queueservice.Message{
-				Body: "Failed to get command ID",
+				Body: `{"status":"ERROR","errorCode":"INVALID_COMMAND","error":"failed to parse command: invalid command"}`,
 			},
 		},
 		{
@@ -81,26 +86,182 @@ func TestMultiWorker_Run(t *testing.T) {
 
 type mockCommandsParser struct{}
 
-func (m *mockCommandsParser) GetCommandID(command string) (string, error) {
+func (m *mockCommandsParser) ParseCommand(command string) (cmdParser.Command, error) {
 	if command == "invalid" {
-		return "", fmt.Errorf("invalid command")
+		return cmdParser.Command{}, fmt.Errorf("invalid command")
 	}
-	return "key", nil
+	if command == "getAllItems" {
+		return cmdParser.Command{Type: cmdParser.GetAllItems}, nil
+	}
+	if command == "getItems" {
+		cmd := cmdParser.Command{Type: cmdParser.GetItems}
+		for i := 0; i < 6; i++ {
+			cmd.Commands = append(cmd.Commands, cmdParser.Command{Type: cmdParser.GetItem, Key: fmt.Sprintf("key%d", i)})
+		}
+		return cmd, nil
+	}
+	if command == "transaction" {
+		return cmdParser.Command{Type: cmdParser.Transaction, Commands: []cmdParser.Command{
+			{Type: cmdParser.AddItem, Key: "key1"},
+			{Type: cmdParser.AddItem, Key: "key2"},
+			{Type: cmdParser.AddItem, Key: "key3"},
+		}}, nil
+	}
+	return cmdParser.Command{Type: cmdParser.GetItem, Key: "key"}, nil
 }
 
-type mockCommandProcessor struct{}
+type mockCommandProcessor struct {
+	held int32
+	// holds receives a signal from every worker once it is held, and
+	// ExecuteHeld waits for expectHeld of them.
+	holds      chan struct{}
+	expectHeld int
+}
+
+func newHoldingProcessor(expectHeld int) *mockCommandProcessor {
+	return &mockCommandProcessor{holds: make(chan struct{}, expectHeld), expectHeld: expectHeld}
+}
 
-func (m *mockCommandProcessor) Process(processorID int, requests <-chan queueservice.Message, replies chan<- queueservice.Message, wg *sync.WaitGroup) {
+func (m *mockCommandProcessor) Process(processorID int, requests <-chan protocol.Request, replies chan<- queueservice.Message, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for req := range requests {
-		if req.Body == "processError" {
+		if req.Hold != nil {
+			atomic.AddInt32(&m.held, 1)
+			if m.holds != nil {
+				m.holds <- struct{}{}
+			}
+			<-req.Hold
+			atomic.AddInt32(&m.held, -1)
+			continue
+		}
+		if req.Results != nil {
+			results := make([]protocol.Reply, len(req.Command.Commands))
+			for i, sub := range req.Command.Commands {
+				results[i] = protocol.OK(sub.Type.String(), sub.Key)
+				results[i].Value = processorID
+			}
+			req.Results <- protocol.Batch(req.Command.Type.String(), results)
+			continue
+		}
+		if req.Message.Body == "processError" {
 			replies <- queueservice.Message{
 				Body: "error",
 			}
 			continue
 		}
 		replies <- queueservice.Message{
-			Body: "processed: " + req.Body,
+			Body: "processed: " + req.Message.Body,
+		}
+	}
+}
+
+// ExecuteHeld reports how many workers were held while it ran. A held worker
+// counts itself right after receiving the hold, so it first waits for the signals
+// of expectHeld workers. The timeout only keeps a broken router from hanging the
+// test, which then fails on the count.
+func (m *mockCommandProcessor) ExecuteHeld(cmd cmdParser.Command) protocol.Reply {
+	timeout := time.After(5 * time.Second)
+wait:
+	for i := 0; i < m.expectHeld; i++ {
+		select {
+		case <-m.holds:
+		case <-timeout:
+			break wait
+		}
+	}
+	reply := protocol.OK(cmd.Type.String(), "")
+	reply.Value = atomic.LoadInt32(&m.held)
+	return reply
+}
+
+func TestMultiWorker_RunTransactionHoldsOwners(t *testing.T) {
+	partitioner := ds.NewPartitioner(3)
+	owners := map[int]bool{}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		owners[partitioner.WorkerFor(key)] = true
+	}
+	processor := newHoldingProcessor(len(owners))
+	multiWorker := NewMultiWorker(partitioner, &mockCommandsParser{}, processor, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan queueservice.Message, 10)
+	replies := make(chan queueservice.Message, 10)
+	defer close(requests)
+
+	go multiWorker.Run(ctx, requests, replies)
+
+	requests <- queueservice.Message{Body: "transaction"}
+
+	reply, err := protocol.Decode((<-replies).Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if reply.Value != float64(len(owners)) {
+		t.Errorf("expected %d workers to be held, got: %v", len(owners), reply.Value)
+	}
+
+	// The holds are released once the transaction is applied.
+	requests <- queueservice.Message{Body: "after"}
+	if next := <-replies; next.Body != "processed: after" {
+		t.Errorf("expected reply body: processed: after, got: %s", next.Body)
+	}
+}
+
+func TestMultiWorker_RunScatterGather(t *testing.T) {
+	partitioner := ds.NewPartitioner(3)
+	multiWorker := NewMultiWorker(partitioner, &mockCommandsParser{}, &mockCommandProcessor{}, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan queueservice.Message, 10)
+	replies := make(chan queueservice.Message, 10)
+	defer close(requests)
+
+	go multiWorker.Run(ctx, requests, replies)
+
+	requests <- queueservice.Message{Body: "getItems"}
+
+	reply, err := protocol.Decode((<-replies).Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	results, _ := reply.Value.([]interface{})
+	if len(results) != 6 {
+		t.Fatalf("expected 6 results, got: %v", reply.Value)
+	}
+	// Every key is answered by its owner, in the order the keys were given.
+	for i, result := range results {
+		key := fmt.Sprintf("key%d", i)
+		fields := result.(map[string]interface{})
+		if fields["key"] != key || fields["value"] != float64(partitioner.WorkerFor(key)) {
+			t.Errorf("expected %s from worker %d, got: %v", key, partitioner.WorkerFor(key), fields)
 		}
 	}
 }
+
+func TestMultiWorker_RunGetAllItemsHoldsAllWorkers(t *testing.T) {
+	processor := newHoldingProcessor(3)
+	multiWorker := NewMultiWorker(ds.NewPartitioner(3), &mockCommandsParser{}, processor, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan queueservice.Message, 10)
+	replies := make(chan queueservice.Message, 10)
+	defer close(requests)
+
+	go multiWorker.Run(ctx, requests, replies)
+
+	requests <- queueservice.Message{Body: "getAllItems"}
+
+	reply, err := protocol.Decode((<-replies).Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if reply.Value != float64(3) {
+		t.Errorf("expected all 3 workers to be held, got: %v", reply.Value)
+	}
+}
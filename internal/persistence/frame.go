@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Records in both log segments and snapshots are framed as:
+// payload length (uint32), CRC32 of payload (uint32), payload.
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 64 << 20
+)
+
+func frame(payload []byte) []byte {
+	buf := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[frameHeaderSize:], payload)
+	return buf
+}
+
+// readFrames calls fn with the payload of every frame from the start of r and returns
+// the offset just past the last valid one. Reading stops at the first incomplete,
+// oversized or corrupted frame.
+func readFrames(r io.ReadSeeker, fn func(payload []byte) error) (int64, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek: %v", err)
+	}
+
+	var offset int64
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("failed to read: %v", err)
+		}
+
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > maxFrameSize {
+			return offset, nil
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("failed to read: %v", err)
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return offset, nil
+		}
+
+		if err := fn(payload); err != nil {
+			return 0, err
+		}
+
+		offset += int64(frameHeaderSize + len(payload))
+	}
+}
+
+// syncDir makes file creations, renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
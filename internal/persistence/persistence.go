@@ -0,0 +1,177 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	"github.com/avalkov/SCS/internal/domain/values"
+)
+
+// Storage is the subset of the key-value store needed to rebuild it on startup.
+type Storage interface {
+	Add(key string, value interface{}, seq uint64)
+	Remove(key string)
+	Get(key string) (interface{}, bool)
+	SetExpiry(key string, expiresAt time.Time) bool
+	SetVersion(key string, version uint64) bool
+}
+
+// Restore loads the newest valid snapshot into the storage and replays the log
+// records written after it, reproducing the original insertion order.
+func Restore(snapshots *SnapshotStore, wal *WAL, storage Storage) error {
+	seq, found, err := snapshots.LoadLatest(func(item ds.KeyValue) {
+		storage.Add(item.Key, item.Value, item.Inserted)
+		storage.SetExpiry(item.Key, item.ExpiresAt)
+		storage.SetVersion(item.Key, item.Version)
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		log.Printf("Loaded snapshot at seq %d", seq)
+	}
+
+	if first := wal.FirstSeq(); first > seq+1 {
+		return fmt.Errorf("WAL starts at seq %d but no valid snapshot covers the records before it", first)
+	}
+
+	if err := wal.Replay(seq, func(r Record) error {
+		return Apply(storage, r)
+	}); err != nil {
+		return err
+	}
+
+	// The log may have lost unsynced records that the snapshot already includes.
+	// Continue numbering after the snapshot so new records are not mistaken for them.
+	if last := wal.LastSeq(); seq > last {
+		log.Printf("WAL ends at seq %d, behind snapshot at seq %d", last, seq)
+		return wal.skipTo(seq)
+	}
+	return nil
+}
+
+// Apply applies a logged mutation to the storage.
+func Apply(storage Storage, r Record) error {
+	switch r.Op {
+	case OpAdd:
+		// The version of a value is the sequence number of the record that wrote it.
+		storage.Add(r.Key, r.Value, r.Seq)
+		storage.SetExpiry(r.Key, FromUnixMilli(r.ExpiresAt))
+		storage.SetVersion(r.Key, r.Seq)
+	case OpDelete:
+		storage.Remove(r.Key)
+	case OpExpire:
+		storage.SetExpiry(r.Key, FromUnixMilli(r.ExpiresAt))
+	case OpUpdate:
+		current, exists := storage.Get(r.Key)
+		value, _, err := values.Apply(current, exists, r.Update, r.Args)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s of %s at seq %d: %v", r.Update, r.Key, r.Seq, err)
+		}
+		switch {
+		case value == nil:
+			storage.Remove(r.Key)
+			return nil
+		case !exists:
+			storage.Add(r.Key, value, r.Seq)
+		}
+		storage.SetVersion(r.Key, r.Seq)
+	case OpBatch:
+		for _, nested := range r.Records {
+			nested.Seq = r.Seq
+			if err := Apply(storage, nested); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown WAL operation %q at seq %d", r.Op, r.Seq)
+	}
+	return nil
+}
+
+type SnapshotSource interface {
+	// Snapshot returns a copy of all items in insertion order together with the
+	// sequence number of the last logged mutation they include.
+	Snapshot() ([]ds.KeyValue, uint64)
+}
+
+// Snapshotter periodically saves snapshots of the source and compacts the log
+// up to the oldest retained snapshot, so that any of them can be used on startup.
+type Snapshotter struct {
+	source    SnapshotSource
+	snapshots *SnapshotStore
+	wal       *WAL
+	interval  time.Duration
+	lastSeq   uint64
+}
+
+func NewSnapshotter(source SnapshotSource, snapshots *SnapshotStore, wal *WAL, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		source:    source,
+		snapshots: snapshots,
+		wal:       wal,
+		interval:  interval,
+	}
+}
+
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Take(); err != nil {
+				log.Printf("Failed to take snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// Take saves a snapshot unless nothing has changed since the previous one.
+func (s *Snapshotter) Take() error {
+	items, seq := s.source.Snapshot()
+	if seq == s.lastSeq {
+		return nil
+	}
+
+	// Start a new segment so the records covered by this snapshot can later be
+	// removed as whole files.
+	if err := s.wal.Rotate(); err != nil {
+		return err
+	}
+
+	if err := s.snapshots.Save(seq, items); err != nil {
+		return err
+	}
+	s.lastSeq = seq
+
+	log.Printf("Saved snapshot of %d items at seq %d", len(items), seq)
+
+	oldest, found, err := s.snapshots.OldestSeq()
+	if err != nil || !found {
+		return err
+	}
+	return s.wal.Compact(oldest)
+}
+
+// UnixMilli converts an expiry to its log representation, mapping the zero time to 0.
+func UnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// FromUnixMilli is the inverse of UnixMilli.
+func FromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
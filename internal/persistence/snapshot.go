@@ -0,0 +1,246 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	"github.com/avalkov/SCS/internal/domain/values"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+// snapshotHeader is the first frame of a snapshot file. It is followed by Count
+// snapshotEntry frames in insertion order.
+type snapshotHeader struct {
+	Seq   uint64 `json:"seq"`
+	Count int    `json:"count"`
+}
+
+type snapshotEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Type is the type of the value, whose text form Value holds; empty for strings.
+	Type      string `json:"type,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Version   uint64 `json:"version,omitempty"`
+	Inserted  uint64 `json:"inserted,omitempty"`
+}
+
+// SnapshotStore keeps point-in-time copies of the store in a directory,
+// retaining only the newest ones.
+type SnapshotStore struct {
+	dir       string
+	retention int
+}
+
+func NewSnapshotStore(dir string, retention int) (*SnapshotStore, error) {
+	if retention < 1 {
+		return nil, fmt.Errorf("snapshot retention must be at least 1, got %d", retention)
+	}
+	return &SnapshotStore{dir: dir, retention: retention}, nil
+}
+
+// Save atomically writes a snapshot of items, which must reflect every mutation up
+// to and including seq, and removes snapshots beyond the retention count.
+func (ss *SnapshotStore) Save(seq uint64, items []ds.KeyValue) error {
+	path := filepath.Join(ss.dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix))
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+
+	if err := writeSnapshot(file, seq, items); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close snapshot: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename snapshot: %v", err)
+	}
+	if err := syncDir(ss.dir); err != nil {
+		return err
+	}
+
+	return ss.prune()
+}
+
+// OldestSeq returns the sequence number of the oldest retained snapshot.
+func (ss *SnapshotStore) OldestSeq() (uint64, bool, error) {
+	seqs, err := ss.list()
+	if err != nil || len(seqs) == 0 {
+		return 0, false, err
+	}
+	return seqs[0], true, nil
+}
+
+// LoadLatest calls add for every item of the newest valid snapshot, in insertion
+// order, and returns its sequence number. Snapshots that fail validation are skipped
+// in favor of older ones. found is false when no valid snapshot exists.
+func (ss *SnapshotStore) LoadLatest(add func(item ds.KeyValue)) (seq uint64, found bool, err error) {
+	seqs, err := ss.list()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		path := filepath.Join(ss.dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seqs[i], snapshotSuffix))
+		entries, err := readSnapshot(path, seqs[i])
+		if err != nil {
+			log.Printf("Skipping invalid snapshot %s: %v", path, err)
+			continue
+		}
+		items, err := decodeEntries(entries)
+		if err != nil {
+			log.Printf("Skipping invalid snapshot %s: %v", path, err)
+			continue
+		}
+		for _, item := range items {
+			add(item)
+		}
+		return seqs[i], true, nil
+	}
+
+	return 0, false, nil
+}
+
+// decodeEntries decodes the values of all entries, failing if any is invalid.
+func decodeEntries(entries []snapshotEntry) ([]ds.KeyValue, error) {
+	items := make([]ds.KeyValue, len(entries))
+	for i, e := range entries {
+		value, err := values.Decode(e.Type, e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: %v", e.Key, err)
+		}
+		items[i] = ds.KeyValue{Key: e.Key, Value: value, ExpiresAt: FromUnixMilli(e.ExpiresAt), Version: e.Version, Inserted: e.Inserted}
+	}
+	return items, nil
+}
+
+func (ss *SnapshotStore) prune() error {
+	seqs, err := ss.list()
+	if err != nil {
+		return err
+	}
+	for len(seqs) > ss.retention {
+		path := filepath.Join(ss.dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seqs[0], snapshotSuffix))
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove snapshot: %v", err)
+		}
+		seqs = seqs[1:]
+	}
+	return nil
+}
+
+func (ss *SnapshotStore) list() ([]uint64, error) {
+	entries, err := os.ReadDir(ss.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory: %v", err)
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func writeSnapshot(file *os.File, seq uint64, items []ds.KeyValue) error {
+	header, err := json.Marshal(snapshotHeader{Seq: seq, Count: len(items)})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot header: %v", err)
+	}
+	if _, err := file.Write(frame(header)); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	for _, item := range items {
+		typeName, value, err := values.Encode(item.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode value of %s: %v", item.Key, err)
+		}
+		if typeName == values.TypeString {
+			typeName = ""
+		}
+		payload, err := json.Marshal(snapshotEntry{Key: item.Key, Value: value, Type: typeName, ExpiresAt: UnixMilli(item.ExpiresAt), Version: item.Version, Inserted: item.Inserted})
+		if err != nil {
+			return fmt.Errorf("failed to encode snapshot entry: %v", err)
+		}
+		if _, err := file.Write(frame(payload)); err != nil {
+			return fmt.Errorf("failed to write snapshot: %v", err)
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot: %v", err)
+	}
+	return nil
+}
+
+func readSnapshot(path string, seq uint64) ([]snapshotEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var header *snapshotHeader
+	var entries []snapshotEntry
+	end, err := readFrames(file, func(payload []byte) error {
+		if header == nil {
+			header = &snapshotHeader{}
+			return json.Unmarshal(payload, header)
+		}
+		var entry snapshotEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case end != info.Size():
+		return nil, fmt.Errorf("corrupted at offset %d", end)
+	case header == nil:
+		return nil, fmt.Errorf("missing header")
+	case header.Seq != seq:
+		return nil, fmt.Errorf("header seq %d does not match file name", header.Seq)
+	case header.Count != len(entries):
+		return nil, fmt.Errorf("expected %d entries, found %d", header.Count, len(entries))
+	}
+	return entries, nil
+}
@@ -0,0 +1,229 @@
+package persistence
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	"github.com/avalkov/SCS/internal/domain/values"
+)
+
+type storeSource struct {
+	store *ds.OrderedMap
+	wal   *WAL
+}
+
+func (s *storeSource) Snapshot() ([]ds.KeyValue, uint64) {
+	return s.store.GetAll(), s.wal.LastSeq()
+}
+
+func restoreFrom(t *testing.T, dir string, retention int) (*ds.OrderedMap, *WAL) {
+	t.Helper()
+	snapshots, err := NewSnapshotStore(dir, retention)
+	if err != nil {
+		t.Fatalf("failed to create snapshot store: %v", err)
+	}
+	wal := openTestWAL(t, dir)
+	restored := ds.NewOrderedMap()
+	if err := Restore(snapshots, wal, restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	return restored, wal
+}
+
+func TestSnapshotter_RestoresSnapshotAndTail(t *testing.T) {
+	dir := t.TempDir()
+
+	original := ds.NewOrderedMap()
+	wal := openTestWAL(t, dir)
+	snapshots, _ := NewSnapshotStore(dir, 2)
+	snapshotter := NewSnapshotter(&storeSource{original, wal}, snapshots, wal, 0)
+
+	appendAndApply(t, wal, original,
+		Record{Op: OpAdd, Key: "key1", Value: "val1"},
+		Record{Op: OpAdd, Key: "key2", Value: "val2"},
+	)
+	if err := snapshotter.Take(); err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	appendAndApply(t, wal, original,
+		Record{Op: OpDelete, Key: "key1"},
+		Record{Op: OpAdd, Key: "key3", Value: "val3"},
+	)
+	if err := snapshotter.Take(); err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	appendAndApply(t, wal, original,
+		Record{Op: OpAdd, Key: "key1", Value: "val11"},
+	)
+	if err := snapshotter.Take(); err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	appendAndApply(t, wal, original,
+		Record{Op: OpAdd, Key: "key4", Value: "val4"},
+	)
+	wal.Close()
+
+	// Only the two newest snapshots are retained and the log is compacted
+	// up to the oldest of them.
+	if seq, _, _ := snapshots.OldestSeq(); seq != 4 {
+		t.Errorf("expected oldest snapshot at seq 4, got: %d", seq)
+	}
+	if seqs, _ := snapshots.list(); len(seqs) != 2 {
+		t.Errorf("expected 2 snapshots, got: %d", len(seqs))
+	}
+
+	restored, wal := restoreFrom(t, dir, 2)
+	defer wal.Close()
+
+	if wal.FirstSeq() != 5 {
+		t.Errorf("expected WAL to start at seq 5, got: %d", wal.FirstSeq())
+	}
+	if !reflect.DeepEqual(original.GetAll(), restored.GetAll()) {
+		t.Errorf("expected items: %+v, got: %+v", original.GetAll(), restored.GetAll())
+	}
+}
+
+func TestRestore_FallsBackToOlderSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	original := ds.NewOrderedMap()
+	wal := openTestWAL(t, dir)
+	snapshots, _ := NewSnapshotStore(dir, 2)
+	snapshotter := NewSnapshotter(&storeSource{original, wal}, snapshots, wal, 0)
+
+	appendAndApply(t, wal, original, Record{Op: OpAdd, Key: "key1", Value: "val1"})
+	snapshotter.Take()
+	appendAndApply(t, wal, original, Record{Op: OpAdd, Key: "key2", Value: "val2"})
+	snapshotter.Take()
+	wal.Close()
+
+	newest := filepath.Join(dir, "snapshot-00000000000000000002.snap")
+	if err := os.Truncate(newest, 10); err != nil {
+		t.Fatalf("failed to corrupt snapshot: %v", err)
+	}
+
+	restored, wal := restoreFrom(t, dir, 2)
+	defer wal.Close()
+
+	if !reflect.DeepEqual(original.GetAll(), restored.GetAll()) {
+		t.Errorf("expected items: %+v, got: %+v", original.GetAll(), restored.GetAll())
+	}
+}
+
+func TestRestore_ContinuesAfterSnapshotAheadOfLog(t *testing.T) {
+	dir := t.TempDir()
+
+	snapshots, _ := NewSnapshotStore(dir, 1)
+	if err := snapshots.Save(7, []ds.KeyValue{{Key: "key1", Value: "val1"}}); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	restored, wal := restoreFrom(t, dir, 1)
+	appendAndApply(t, wal, restored, Record{Op: OpAdd, Key: "key2", Value: "val2"})
+	if wal.LastSeq() != 8 {
+		t.Errorf("expected last seq: 8, got: %d", wal.LastSeq())
+	}
+	wal.Close()
+
+	again, wal := restoreFrom(t, dir, 1)
+	defer wal.Close()
+
+	if !reflect.DeepEqual(restored.GetAll(), again.GetAll()) {
+		t.Errorf("expected items: %+v, got: %+v", restored.GetAll(), again.GetAll())
+	}
+}
+
+func TestRestore_PreservesExpiryAndVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	original := ds.NewOrderedMap()
+	wal := openTestWAL(t, dir)
+	snapshots, _ := NewSnapshotStore(dir, 2)
+	snapshotter := NewSnapshotter(&storeSource{original, wal}, snapshots, wal, 0)
+
+	appendAndApply(t, wal, original,
+		Record{Op: OpAdd, Key: "key1", Value: "val1", ExpiresAt: 1700000000000},
+		Record{Op: OpAdd, Key: "key2", Value: "val2"},
+	)
+	if err := snapshotter.Take(); err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	appendAndApply(t, wal, original,
+		Record{Op: OpExpire, Key: "key2", ExpiresAt: 1700000005000},
+		Record{Op: OpAdd, Key: "key1", Value: "val11"},
+	)
+	wal.Close()
+
+	restored, wal := restoreFrom(t, dir, 2)
+	defer wal.Close()
+
+	expected := []ds.KeyValue{
+		{Key: "key1", Value: "val11", Version: 4, Inserted: 1},
+		{Key: "key2", Value: "val2", ExpiresAt: time.UnixMilli(1700000005000), Version: 2, Inserted: 2},
+	}
+	if !reflect.DeepEqual(restored.GetAll(), expected) {
+		t.Errorf("expected items: %+v, got: %+v", expected, restored.GetAll())
+	}
+}
+
+func TestRestore_TypedValues(t *testing.T) {
+	dir := t.TempDir()
+
+	original := ds.NewOrderedMap()
+	wal := openTestWAL(t, dir)
+	snapshots, _ := NewSnapshotStore(dir, 2)
+	snapshotter := NewSnapshotter(&storeSource{original, wal}, snapshots, wal, 0)
+
+	appendAndApply(t, wal, original,
+		Record{Op: OpUpdate, Key: "list1", Update: values.RPush, Args: []string{"a", "b"}},
+		Record{Op: OpAdd, Key: "key1", Value: "val1"},
+		Record{Op: OpUpdate, Key: "hash1", Update: values.HSet, Args: []string{"name", "Ann"}},
+		Record{Op: OpUpdate, Key: "hash1", Update: values.HSet, Args: []string{"city", "Varna"}},
+		Record{Op: OpUpdate, Key: "set1", Update: values.SAdd, Args: []string{"b", "a"}},
+		Record{Op: OpUpdate, Key: "zset1", Update: values.ZAdd, Args: []string{"ann", "2"}},
+	)
+	if err := snapshotter.Take(); err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	appendAndApply(t, wal, original,
+		Record{Op: OpUpdate, Key: "list1", Update: values.LPush, Args: []string{"z"}},
+		Record{Op: OpUpdate, Key: "list1", Update: values.RPop, Args: []string{"1"}},
+		Record{Op: OpUpdate, Key: "list2", Update: values.RPush, Args: []string{"x"}},
+		Record{Op: OpUpdate, Key: "list2", Update: values.LPop, Args: []string{"1"}},
+		Record{Op: OpUpdate, Key: "hash1", Update: values.HIncr, Args: []string{"visits", "2"}},
+		Record{Op: OpUpdate, Key: "hash1", Update: values.HDel, Args: []string{"name"}},
+		Record{Op: OpUpdate, Key: "set1", Update: values.SRem, Args: []string{"b"}},
+		Record{Op: OpUpdate, Key: "zset1", Update: values.ZAdd, Args: []string{"bob", "1.5"}},
+		Record{Op: OpUpdate, Key: "doc1", Update: values.JSONSet, Args: []string{"$", `{"items":[1,2]}`}},
+		Record{Op: OpUpdate, Key: "doc1", Update: values.JSONDel, Args: []string{"$.items[0]"}},
+	)
+	wal.Close()
+
+	restored, wal := restoreFrom(t, dir, 2)
+	defer wal.Close()
+
+	items := restored.GetAll()
+	for i := range items {
+		items[i].Value = values.Export(items[i].Value)
+	}
+	expected := []ds.KeyValue{
+		{Key: "list1", Value: []string{"z", "a"}, Version: 8, Inserted: 1},
+		{Key: "key1", Value: "val1", Version: 2, Inserted: 2},
+		{Key: "hash1", Value: values.Fields{{Name: "city", Value: "Varna"}, {Name: "visits", Value: "2"}}, Version: 12, Inserted: 3},
+		{Key: "set1", Value: []string{"a"}, Version: 13, Inserted: 5},
+		{Key: "zset1", Value: []ds.ScoredMember{{Member: "bob", Score: 1.5}, {Member: "ann", Score: 2}}, Version: 14, Inserted: 6},
+		{Key: "doc1", Value: json.RawMessage(`{"items":[2]}`), Version: 16, Inserted: 15},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("expected items: %+v, got: %+v", expected, items)
+	}
+
+	if err := Apply(restored, Record{Op: OpUpdate, Key: "key1", Update: values.RPush, Args: []string{"a"}, Seq: 17}); err == nil {
+		t.Errorf("expected an update of the wrong type to fail")
+	}
+}
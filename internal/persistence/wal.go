@@ -0,0 +1,402 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the log to disk before every append returns.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs the log in the background every FsyncInterval.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+type Op string
+
+const (
+	OpAdd    Op = "add"
+	OpDelete Op = "delete"
+	OpExpire Op = "expire"
+	// OpUpdate changes a typed value in place, see values.Prepare.
+	OpUpdate Op = "update"
+	// OpBatch groups the records of a transaction so they are replayed all or none.
+	OpBatch Op = "batch"
+)
+
+// Record is a single applied mutation stored in the write-ahead log.
+type Record struct {
+	Seq   uint64 `json:"seq"`
+	Op    Op     `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// ExpiresAt is the absolute expiry in Unix milliseconds, zero for none.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Update and Args are the update of an OpUpdate record and its arguments.
+	Update string   `json:"update,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	// Records are the mutations of an OpBatch record. They share its sequence number.
+	Records []Record `json:"records,omitempty"`
+}
+
+type WALConfig struct {
+	Dir           string
+	FsyncPolicy   FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+)
+
+// segment is a log file holding the records starting at firstSeq.
+type segment struct {
+	firstSeq uint64
+	path     string
+}
+
+// WAL is an append-only log of mutations split into segments, safe for concurrent use.
+// A new segment is started on every Rotate so that Compact can drop whole files.
+type WAL struct {
+	config   WALConfig
+	segments []segment
+	file     *os.File
+	mu       sync.Mutex
+	lastSeq  uint64
+	dirty    bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// OpenWAL opens or creates the log in config.Dir. A torn or corrupted tail left
+// by a crash is truncated so that new records are appended after the last valid one.
+func OpenWAL(config WALConfig) (*WAL, error) {
+	switch config.FsyncPolicy {
+	case FsyncAlways, FsyncNever:
+	case FsyncInterval:
+		if config.FsyncInterval <= 0 {
+			return nil, fmt.Errorf("fsync interval must be positive, got %v", config.FsyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fsync policy: %q", config.FsyncPolicy)
+	}
+
+	segments, err := listSegments(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		config:   config,
+		segments: segments,
+		done:     make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		if err := w.openSegment(1); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := w.scan(0, func(r Record) error { return nil }); err != nil {
+			return nil, err
+		}
+		if err := w.openTail(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.FsyncPolicy == FsyncInterval {
+		w.wg.Add(1)
+		go w.runSyncer()
+	}
+
+	return w, nil
+}
+
+// Replay calls apply for every record with a sequence number greater than afterSeq,
+// in the order they were appended.
+func (w *WAL) Replay(afterSeq uint64, apply func(Record) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.scan(afterSeq, apply)
+}
+
+// Append assigns the next sequence number to the record, writes it to the log and
+// returns the assigned sequence number.
+func (w *WAL) Append(record Record) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record.Seq = w.lastSeq + 1
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode WAL record: %v", err)
+	}
+
+	if _, err := w.file.Write(frame(payload)); err != nil {
+		return 0, fmt.Errorf("failed to write WAL record: %v", err)
+	}
+
+	if w.config.FsyncPolicy == FsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return 0, fmt.Errorf("failed to sync WAL: %v", err)
+		}
+	} else {
+		w.dirty = true
+	}
+
+	w.lastSeq = record.Seq
+	return record.Seq, nil
+}
+
+// LastSeq returns the sequence number of the last appended record.
+func (w *WAL) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastSeq
+}
+
+// FirstSeq returns the sequence number of the oldest record still kept in the log.
+func (w *WAL) FirstSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segments[0].firstSeq
+}
+
+// Rotate closes the active segment and starts a new one with the next sequence number.
+func (w *WAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.segments[len(w.segments)-1].firstSeq > w.lastSeq {
+		// The active segment is still empty.
+		return nil
+	}
+
+	if err := w.closeActive(); err != nil {
+		return err
+	}
+	return w.openSegment(w.lastSeq + 1)
+}
+
+// skipTo starts a new segment so that the next appended record gets seq+1.
+func (w *WAL) skipTo(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.closeActive(); err != nil {
+		return err
+	}
+	w.lastSeq = seq
+	if err := w.openSegment(seq + 1); err != nil {
+		return err
+	}
+
+	// Older segments only hold records already covered by the snapshot, and
+	// keeping them would leave a gap in the sequence.
+	for len(w.segments) > 1 {
+		if err := os.Remove(w.segments[0].path); err != nil {
+			return fmt.Errorf("failed to remove WAL segment: %v", err)
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// Compact removes segments containing only records with sequence numbers up to and
+// including seq. The active segment is never removed.
+func (w *WAL) Compact(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.segments) > 1 && w.segments[1].firstSeq-1 <= seq {
+		if err := os.Remove(w.segments[0].path); err != nil {
+			return fmt.Errorf("failed to remove WAL segment: %v", err)
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+func (w *WAL) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closeActive()
+}
+
+func (w *WAL) runSyncer() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.config.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				if err := w.file.Sync(); err != nil {
+					log.Printf("Failed to sync WAL: %v", err)
+				} else {
+					w.dirty = false
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *WAL) closeActive() error {
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync WAL: %v", err)
+	}
+	w.dirty = false
+	return w.file.Close()
+}
+
+func (w *WAL) openSegment(firstSeq uint64) error {
+	path := filepath.Join(w.config.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, firstSeq, segmentSuffix))
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %v", err)
+	}
+	if err := syncDir(w.config.Dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.segments = append(w.segments, segment{firstSeq: firstSeq, path: path})
+	if w.lastSeq < firstSeq-1 {
+		w.lastSeq = firstSeq - 1
+	}
+	return nil
+}
+
+// openTail reopens the newest segment for appending, cutting off anything after
+// its last valid record.
+func (w *WAL) openTail() error {
+	tail := w.segments[len(w.segments)-1]
+
+	file, err := os.OpenFile(tail.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %v", err)
+	}
+
+	end, err := readFrames(file, func([]byte) error { return nil })
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Truncate(end); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to truncate WAL: %v", err)
+	}
+	file.Close()
+
+	w.segments = w.segments[:len(w.segments)-1]
+	return w.openSegment(tail.firstSeq)
+}
+
+// scan reads every segment in order, calling apply for records after afterSeq.
+// Only the newest segment may end in an incomplete record.
+func (w *WAL) scan(afterSeq uint64, apply func(Record) error) error {
+	for i, seg := range w.segments {
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return fmt.Errorf("failed to open WAL segment: %v", err)
+		}
+
+		expected := seg.firstSeq
+		end, err := readFrames(file, func(payload []byte) error {
+			var record Record
+			if err := json.Unmarshal(payload, &record); err != nil {
+				return fmt.Errorf("failed to decode WAL record in %s: %v", seg.path, err)
+			}
+			if record.Seq != expected {
+				return fmt.Errorf("unexpected WAL seq %d in %s, expected %d", record.Seq, seg.path, expected)
+			}
+			expected++
+			if record.Seq > w.lastSeq {
+				w.lastSeq = record.Seq
+			}
+			if record.Seq <= afterSeq {
+				return nil
+			}
+			return apply(record)
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to stat WAL segment: %v", err)
+		}
+		if end != info.Size() {
+			if i != len(w.segments)-1 {
+				return fmt.Errorf("WAL segment %s is corrupted at offset %d", seg.path, end)
+			}
+			log.Printf("Discarding incomplete WAL tail in %s at offset %d", seg.path, end)
+		}
+
+		if i+1 < len(w.segments) && w.segments[i+1].firstSeq != expected {
+			return fmt.Errorf("WAL segment %s ends at seq %d but the next one starts at %d",
+				seg.path, expected-1, w.segments[i+1].firstSeq)
+		}
+		if w.lastSeq < expected-1 {
+			w.lastSeq = expected - 1
+		}
+	}
+	return nil
+}
+
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory: %v", err)
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil || firstSeq == 0 {
+			continue
+		}
+		segments = append(segments, segment{firstSeq: firstSeq, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstSeq < segments[j].firstSeq
+	})
+	return segments, nil
+}
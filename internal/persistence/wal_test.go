@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+)
+
+func openTestWAL(t *testing.T, dir string) *WAL {
+	t.Helper()
+	wal, err := OpenWAL(WALConfig{Dir: dir, FsyncPolicy: FsyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open WAL: %v", err)
+	}
+	return wal
+}
+
+func appendAndApply(t *testing.T, wal *WAL, storage Storage, records ...Record) {
+	t.Helper()
+	for _, r := range records {
+		seq, err := wal.Append(r)
+		if err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		r.Seq = seq
+		if err := Apply(storage, r); err != nil {
+			t.Fatalf("failed to apply: %v", err)
+		}
+	}
+}
+
+func replayKeys(t *testing.T, wal *WAL) []string {
+	t.Helper()
+	var keys []string
+	if err := wal.Replay(0, func(r Record) error {
+		keys = append(keys, r.Key)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	return keys
+}
+
+func TestWAL_RestorePreservesOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	original := ds.NewOrderedMap()
+	wal := openTestWAL(t, dir)
+
+	mutations := []Record{
+		{Op: OpAdd, Key: "key1", Value: "val1"},
+		{Op: OpAdd, Key: "key2", Value: "val2"},
+		{Op: OpAdd, Key: "key3", Value: "val3"},
+		{Op: OpDelete, Key: "key1"},
+		{Op: OpAdd, Key: "key2", Value: "val22"},
+		{Op: OpAdd, Key: "key1", Value: "val11"},
+		{Op: OpBatch, Records: []Record{
+			{Op: OpDelete, Key: "key3"},
+			{Op: OpAdd, Key: "key4", Value: "val4"},
+		}},
+	}
+	appendAndApply(t, wal, original, mutations...)
+	if err := wal.Close(); err != nil {
+		t.Fatalf("failed to close WAL: %v", err)
+	}
+
+	restored := ds.NewOrderedMap()
+	wal = openTestWAL(t, dir)
+	defer wal.Close()
+
+	snapshots, _ := NewSnapshotStore(dir, 1)
+	if err := Restore(snapshots, wal, restored); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	if !reflect.DeepEqual(original.GetAll(), restored.GetAll()) {
+		t.Errorf("expected items: %+v, got: %+v", original.GetAll(), restored.GetAll())
+	}
+	if wal.LastSeq() != uint64(len(mutations)) {
+		t.Errorf("expected last seq: %d, got: %d", len(mutations), wal.LastSeq())
+	}
+}
+
+func TestWAL_TruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir)
+	appendAndApply(t, wal, ds.NewOrderedMap(),
+		Record{Op: OpAdd, Key: "key1", Value: "val"},
+		Record{Op: OpAdd, Key: "key2", Value: "val"},
+	)
+	wal.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	segments, _ := listSegments(dir)
+	file, err := os.OpenFile(segments[len(segments)-1].path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open WAL segment: %v", err)
+	}
+	file.Write([]byte{0x20, 0x00, 0x00, 0x00, 0x01, 0x02})
+	file.Close()
+
+	wal = openTestWAL(t, dir)
+	appendAndApply(t, wal, ds.NewOrderedMap(), Record{Op: OpAdd, Key: "key3", Value: "val"})
+	wal.Close()
+
+	wal = openTestWAL(t, dir)
+	defer wal.Close()
+
+	expected := []string{"key1", "key2", "key3"}
+	if keys := replayKeys(t, wal); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys: %v, got: %v", expected, keys)
+	}
+}
+
+func TestWAL_RotateAndCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	wal := openTestWAL(t, dir)
+	defer wal.Close()
+
+	storage := ds.NewOrderedMap()
+	appendAndApply(t, wal, storage, Record{Op: OpAdd, Key: "key1", Value: "val"})
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	appendAndApply(t, wal, storage, Record{Op: OpAdd, Key: "key2", Value: "val"})
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	// Rotating an empty segment is a no-op.
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	appendAndApply(t, wal, storage, Record{Op: OpAdd, Key: "key3", Value: "val"})
+
+	if segments, _ := listSegments(dir); len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got: %d", len(segments))
+	}
+
+	if err := wal.Compact(1); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if wal.FirstSeq() != 2 {
+		t.Errorf("expected first seq: 2, got: %d", wal.FirstSeq())
+	}
+
+	expected := []string{"key2", "key3"}
+	if keys := replayKeys(t, wal); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys: %v, got: %v", expected, keys)
+	}
+}
+
+func TestOpenWAL_InvalidPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := OpenWAL(WALConfig{Dir: dir, FsyncPolicy: "sometimes"}); err == nil {
+		t.Errorf("expected error for unknown fsync policy")
+	}
+	if _, err := OpenWAL(WALConfig{Dir: dir, FsyncPolicy: FsyncInterval}); err == nil {
+		t.Errorf("expected error for zero fsync interval")
+	}
+}
@@ -2,46 +2,155 @@ package amqp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 
 	qs "github.com/avalkov/SCS/internal/queueservice"
 )
 
+const (
+	defaultReconnectMinBackoff = 500 * time.Millisecond
+	defaultReconnectMaxBackoff = 30 * time.Second
+	defaultPrefetchCount       = 10
+	defaultMaxDeliveries       = 3
+	defaultDeadLetterExchange  = "scs.dead-letter"
+	defaultDeadLetterQueue     = "scs.dead-letter"
+)
+
+const (
+	// DeliveryCountHeader counts how many times a request has been delivered,
+	// since the broker does not track this for classic queues.
+	DeliveryCountHeader = "x-scs-delivery-count"
+
+	// Headers recorded on dead-lettered requests.
+	FailureReasonHeader   = "x-scs-failure-reason"
+	ErrorCodeHeader       = "x-scs-error-code"
+	WorkerHeader          = "x-scs-worker"
+	OriginalReplyToHeader = "x-scs-original-reply-to"
+	OriginalQueueHeader   = "x-scs-original-queue"
+)
+
 type AmqpConfig struct {
 	Host      string
 	Port      int
 	User      string
 	Pass      string
 	QueueName string
+	// ReconnectMinBackoff and ReconnectMaxBackoff bound the exponential backoff
+	// between reconnection attempts. Zero values fall back to defaults.
+	ReconnectMinBackoff time.Duration
+	ReconnectMaxBackoff time.Duration
+	// PrefetchCount limits how many unacknowledged requests the broker hands out at once.
+	PrefetchCount int
+	// MaxDeliveries is how many times a request failing with a server-side error is
+	// attempted before it is dead-lettered.
+	MaxDeliveries int
+	// DeadLetterExchange receives malformed and failed requests, which it routes
+	// to DeadLetterQueue.
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// OnUnroutable, if set, is called with the name of a reply queue a reply was
+	// returned from because the queue no longer exists.
+	OnUnroutable func(replyTo string)
 }
 
-type amqpWorker struct {
-	config  AmqpConfig
+// session is a single connection to the broker with its channel and consumer.
+// It is replaced as a whole when the connection is lost.
+type session struct {
+	conn    *amqp.Connection
 	channel *amqp.Channel
 	msgs    <-chan amqp.Delivery
+	// returns receives the replies the broker could not route to a queue.
+	returns <-chan amqp.Return
+	// A channel-level error leaves the connection open, so both are watched
+	// and either closing is treated as losing the session.
+	connClosed    chan *amqp.Error
+	channelClosed chan *amqp.Error
+}
+
+// delivery is the queueservice.Message.Delivery handle of a received request.
+type delivery struct {
+	msg amqp.Delivery
+}
+
+type amqpWorker struct {
+	config AmqpConfig
+
+	mu      sync.Mutex
+	session *session
+	// changed is closed and replaced whenever session is replaced.
+	changed chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewAmqpWorker(config AmqpConfig) qs.QueueService {
+	if config.ReconnectMinBackoff <= 0 {
+		config.ReconnectMinBackoff = defaultReconnectMinBackoff
+	}
+	if config.ReconnectMaxBackoff <= 0 {
+		config.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+	if config.ReconnectMaxBackoff < config.ReconnectMinBackoff {
+		config.ReconnectMaxBackoff = config.ReconnectMinBackoff
+	}
+	if config.PrefetchCount <= 0 {
+		config.PrefetchCount = defaultPrefetchCount
+	}
+	if config.MaxDeliveries <= 0 {
+		config.MaxDeliveries = defaultMaxDeliveries
+	}
+	if config.DeadLetterExchange == "" {
+		config.DeadLetterExchange = defaultDeadLetterExchange
+	}
+	if config.DeadLetterQueue == "" {
+		config.DeadLetterQueue = defaultDeadLetterQueue
+	}
 	return &amqpWorker{
 		config:  config,
-		channel: nil,
-		msgs:    nil,
+		session: nil,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
 
 func (aw *amqpWorker) Initialize() error {
+	s, err := aw.connect()
+	if err != nil {
+		return err
+	}
+	aw.setSession(s)
+	return nil
+}
+
+// connect dials the broker, declares the queue and registers the consumer.
+func (aw *amqpWorker) connect() (*session, error) {
 	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/",
 		aw.config.User, aw.config.Pass, aw.config.Host, aw.config.Port))
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		return fmt.Errorf("failed to open a channel: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	if err := ch.Qos(
+		aw.config.PrefetchCount, // prefetch count
+		0,                       // prefetch size
+		false,                   // global
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set QoS: %v", err)
 	}
 
 	q, err := ch.QueueDeclare(
@@ -53,79 +162,382 @@ func (aw *amqpWorker) Initialize() error {
 		nil,                 // arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare a queue: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare a queue: %v", err)
+	}
+
+	if err := ch.ExchangeDeclare(
+		aw.config.DeadLetterExchange, // name
+		"fanout",                     // kind
+		true,                         // durable
+		false,                        // auto-deleted
+		false,                        // internal
+		false,                        // no-wait
+		nil,                          // arguments
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare the dead-letter exchange: %v", err)
+	}
+
+	dlq, err := ch.QueueDeclare(
+		aw.config.DeadLetterQueue, // name
+		true,                      // durable
+		false,                     // delete when unused
+		false,                     // exclusive
+		false,                     // no-wait
+		nil,                       // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare the dead-letter queue: %v", err)
+	}
+
+	if err := ch.QueueBind(
+		dlq.Name,                     // queue
+		"",                           // routing key
+		aw.config.DeadLetterExchange, // exchange
+		false,                        // no-wait
+		nil,                          // arguments
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind the dead-letter queue: %v", err)
 	}
 
 	msgs, err := ch.Consume(
 		q.Name, // queue
 		"",     // consumer
-		true,   // auto-ack
+		false,  // auto-ack
 		false,  // exclusive
 		false,  // no-local
 		false,  // no-wait
 		nil,    // args
 	)
 	if err != nil {
-		return fmt.Errorf("failed to register a consumer: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to register a consumer: %v", err)
 	}
 
-	aw.channel = ch
-	aw.msgs = msgs
-
-	return nil
+	return &session{
+		conn:          conn,
+		channel:       ch,
+		msgs:          msgs,
+		returns:       ch.NotifyReturn(make(chan amqp.Return, 1)),
+		connClosed:    conn.NotifyClose(make(chan *amqp.Error, 1)),
+		channelClosed: ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
 }
 
 func (aw *amqpWorker) Run(ctx context.Context, requests chan<- qs.Message, replies <-chan qs.Message) error {
-	if aw.msgs == nil {
+	if aw.currentSession() == nil {
 		return fmt.Errorf("worker not initialized")
 	}
 	// TODO: Can run multiple recievers and senders
+	go aw.runSupervisor(ctx)
 	go aw.runReceiver(ctx, requests)
 	go aw.runSender(ctx, replies)
+	go aw.runReturns(ctx)
 	return nil
 }
 
+// runSupervisor waits for the current session to close and reconnects with
+// exponential backoff and jitter until it succeeds or the worker is closed.
+func (aw *amqpWorker) runSupervisor(ctx context.Context) {
+	for {
+		s := aw.currentSession()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-aw.done:
+			return
+		case err := <-s.connClosed:
+			if aw.isClosed() {
+				return
+			}
+			log.Printf("AMQP connection lost: %v", err)
+		case err := <-s.channelClosed:
+			if aw.isClosed() {
+				return
+			}
+			log.Printf("AMQP channel lost: %v", err)
+			s.conn.Close()
+		}
+
+		backoff := aw.config.ReconnectMinBackoff
+		for {
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-ctx.Done():
+				return
+			case <-aw.done:
+				return
+			case <-time.After(delay):
+			}
+
+			next, err := aw.connect()
+			if err == nil {
+				log.Printf("AMQP connection restored")
+				aw.setSession(next)
+				break
+			}
+
+			log.Printf("Failed to reconnect to RabbitMQ, retrying: %v", err)
+			backoff *= 2
+			if backoff > aw.config.ReconnectMaxBackoff {
+				backoff = aw.config.ReconnectMaxBackoff
+			}
+		}
+	}
+}
+
 func (aw *amqpWorker) runReceiver(ctx context.Context, requests chan<- qs.Message) {
 	defer ctx.Done()
-	for d := range aw.msgs {
-		log.Printf("Received a message: %s", d.Body)
 
-		requests <- qs.Message{
-			Body:          string(d.Body),
-			ReplyTo:       d.ReplyTo,
-			CorrelationId: d.CorrelationId,
+	var s *session
+	for {
+		var ok bool
+		if s, ok = aw.nextSession(ctx, s); !ok {
+			break
 		}
+
+		for d := range s.msgs {
+			log.Printf("Received a message: %s", d.Body)
+
+			requests <- qs.Message{
+				Body:          string(d.Body),
+				ReplyTo:       d.ReplyTo,
+				CorrelationId: d.CorrelationId,
+				Delivery:      &delivery{msg: d},
+			}
+		}
+
+		log.Printf("Consumer channel closed")
 	}
 
-	log.Printf("Consumer channel closed")
+	log.Printf("Receiver stopped")
+}
+
+// runReturns reports the replies returned by the broker to OnUnroutable. Returns
+// must be consumed for as long as the channel is open, as the channel blocks on them.
+func (aw *amqpWorker) runReturns(ctx context.Context) {
+	var s *session
+	for {
+		var ok bool
+		if s, ok = aw.nextSession(ctx, s); !ok {
+			return
+		}
+
+		for r := range s.returns {
+			log.Printf("Reply %s returned from %s: %s", r.CorrelationId, r.RoutingKey, r.ReplyText)
+			if aw.config.OnUnroutable != nil {
+				aw.config.OnUnroutable(r.RoutingKey)
+			}
+		}
+	}
 }
 
 func (aw *amqpWorker) runSender(ctx context.Context, replies <-chan qs.Message) {
 	defer ctx.Done()
 	for d := range replies {
-		if err := aw.channel.Publish(
-			"",        // exchange
-			d.ReplyTo, // routing key (reply_to)
-			false,     // mandatory
-			false,     // immediate
-			amqp.Publishing{
-				ContentType:   "text/plain",
-				CorrelationId: d.CorrelationId,
-				Body:          []byte(d.Body),
-			}); err != nil {
-			log.Printf("Failed to publish a message: %v", err)
-		}
+		aw.handleReply(ctx, d)
 	}
 
 	log.Printf("Publisher channel closed")
 }
 
+// handleReply publishes the reply and then settles the request it answers. Requests
+// that failed with a server-side error are redelivered until MaxDeliveries is reached,
+// without replying to the client in between. Requests the reply marks for dead-lettering
+// are then moved to the dead-letter exchange.
+func (aw *amqpWorker) handleReply(ctx context.Context, d qs.Message) {
+	req, _ := d.Delivery.(*delivery)
+
+	if d.Failed && req != nil && deliveryCount(req.msg) < aw.config.MaxDeliveries {
+		aw.redeliver(ctx, req)
+		return
+	}
+
+	// Replies are mandatory so that replies to reply queues that are gone are
+	// returned and the queues can be forgotten.
+	if err := aw.publish(ctx, "", d.ReplyTo, true, amqp.Publishing{
+		ContentType:   "text/plain",
+		CorrelationId: d.CorrelationId,
+		Body:          []byte(d.Body),
+	}); err != nil {
+		log.Printf("Failed to publish a message: %v", err)
+		if req != nil {
+			req.settle(req.msg.Nack(false, true))
+		}
+		return
+	}
+
+	if req == nil {
+		return
+	}
+	if d.DeadLetter != nil {
+		aw.deadLetter(ctx, req, d.DeadLetter)
+		return
+	}
+	req.settle(req.msg.Ack(false))
+}
+
+// deadLetter publishes a copy of the request to the dead-letter exchange, annotated
+// with why and where it failed, and acknowledges the original.
+func (aw *amqpWorker) deadLetter(ctx context.Context, req *delivery, dl *qs.DeadLetter) {
+	log.Printf("Dead-lettering message %s after %d deliveries: %s", req.msg.CorrelationId, deliveryCount(req.msg), dl.Reason)
+
+	headers := copyHeaders(req.msg.Headers)
+	headers[FailureReasonHeader] = dl.Reason
+	headers[ErrorCodeHeader] = dl.ErrorCode
+	headers[WorkerHeader] = dl.Worker
+	headers[OriginalReplyToHeader] = req.msg.ReplyTo
+	headers[OriginalQueueHeader] = aw.config.QueueName
+
+	if err := aw.publish(ctx, aw.config.DeadLetterExchange, "", false, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   req.msg.ContentType,
+		CorrelationId: req.msg.CorrelationId,
+		ReplyTo:       req.msg.ReplyTo,
+		Timestamp:     time.Now(),
+		Body:          req.msg.Body,
+	}); err != nil {
+		log.Printf("Failed to dead-letter message %s: %v", req.msg.CorrelationId, err)
+		req.settle(req.msg.Nack(false, true))
+		return
+	}
+	req.settle(req.msg.Ack(false))
+}
+
+// redeliver publishes a copy of the request with an incremented delivery count
+// to the back of the queue and acknowledges the original.
+func (aw *amqpWorker) redeliver(ctx context.Context, req *delivery) {
+	headers := copyHeaders(req.msg.Headers)
+	headers[DeliveryCountHeader] = int32(deliveryCount(req.msg) + 1)
+
+	if err := aw.publish(ctx, "", aw.config.QueueName, false, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   req.msg.ContentType,
+		CorrelationId: req.msg.CorrelationId,
+		ReplyTo:       req.msg.ReplyTo,
+		Body:          req.msg.Body,
+	}); err != nil {
+		log.Printf("Failed to redeliver message %s: %v", req.msg.CorrelationId, err)
+		req.settle(req.msg.Nack(false, true))
+		return
+	}
+	req.settle(req.msg.Ack(false))
+}
+
+// publish sends the message, waiting for the connection to be restored if it is
+// currently down. Mandatory messages that cannot be routed are returned.
+func (aw *amqpWorker) publish(ctx context.Context, exchange string, routingKey string, mandatory bool, msg amqp.Publishing) error {
+	var s *session
+	for {
+		var ok bool
+		if s, ok = aw.nextSession(ctx, s); !ok {
+			return fmt.Errorf("worker stopped")
+		}
+
+		err := s.channel.Publish(
+			exchange,   // exchange
+			routingKey, // routing key
+			mandatory,  // mandatory
+			false,      // immediate
+			msg)
+		if err == nil || !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+	}
+}
+
+// settle logs the result of acknowledging the delivery. Deliveries received on a
+// session that has since been lost are requeued by the broker, so failing to
+// settle them is expected.
+func (d *delivery) settle(err error) {
+	if err != nil {
+		log.Printf("Failed to settle message %s: %v", d.msg.CorrelationId, err)
+	}
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+// deliveryCount returns how many times the request has been delivered, including this time.
+func deliveryCount(d amqp.Delivery) int {
+	switch v := d.Headers[DeliveryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 1
+}
+
+// nextSession returns the current session if it differs from prev, otherwise it
+// waits for a new one. ok is false once the worker is closed or ctx is done.
+func (aw *amqpWorker) nextSession(ctx context.Context, prev *session) (*session, bool) {
+	for {
+		aw.mu.Lock()
+		s, changed := aw.session, aw.changed
+		aw.mu.Unlock()
+
+		if s != prev {
+			return s, true
+		}
+
+		select {
+		case <-changed:
+		case <-aw.done:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (aw *amqpWorker) currentSession() *session {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	return aw.session
+}
+
+func (aw *amqpWorker) setSession(s *session) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.session = s
+	close(aw.changed)
+	aw.changed = make(chan struct{})
+}
+
+func (aw *amqpWorker) isClosed() bool {
+	select {
+	case <-aw.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (aw *amqpWorker) Close() error {
-	if aw.channel == nil {
+	s := aw.currentSession()
+	if s == nil {
 		return fmt.Errorf("worker not initialized")
 	}
-	if err := aw.channel.Close(); err != nil {
+	aw.closeOnce.Do(func() { close(aw.done) })
+
+	if err := s.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		s.conn.Close()
 		return fmt.Errorf("failed to close channel: %v", err)
 	}
+	if err := s.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("failed to close connection: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,206 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	qs "github.com/avalkov/SCS/internal/queueservice"
+)
+
+// maxPendingReplies bounds how many uncollected replies are kept per CorrelationId.
+// Once it is reached the oldest reply is dropped, so a subscription nobody awaits
+// can't grow without bound.
+const maxPendingReplies = 1024
+
+// InMemoryWorker is an in-process QueueService. Requests are submitted through
+// Submit or Call instead of a broker, and replies are kept per CorrelationId until
+// they are collected with Await. Only replies to CorrelationIds that went through
+// Submit are kept, until the caller releases them with Forget.
+type InMemoryWorker struct {
+	inbox     chan qs.Message
+	done      chan struct{}
+	closeOnce sync.Once
+	nextID    atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[string][]qs.Message
+	// awaited holds the CorrelationIds of submitted requests, replies to any other are dropped.
+	awaited map[string]struct{}
+	// delivered is closed and replaced whenever a reply arrives, waking up all waiters.
+	delivered chan struct{}
+}
+
+func NewInMemoryWorker() *InMemoryWorker {
+	return &InMemoryWorker{}
+}
+
+func (w *InMemoryWorker) Initialize() error {
+	w.inbox = make(chan qs.Message)
+	w.done = make(chan struct{})
+	w.pending = make(map[string][]qs.Message)
+	w.awaited = make(map[string]struct{})
+	w.delivered = make(chan struct{})
+	return nil
+}
+
+func (w *InMemoryWorker) Run(ctx context.Context, requests chan<- qs.Message, replies <-chan qs.Message) error {
+	if w.inbox == nil {
+		return fmt.Errorf("worker not initialized")
+	}
+	go w.runReceiver(ctx, requests)
+	go w.runSender(ctx, replies)
+	return nil
+}
+
+func (w *InMemoryWorker) runReceiver(ctx context.Context, requests chan<- qs.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		case msg := <-w.inbox:
+			select {
+			case requests <- msg:
+			case <-ctx.Done():
+				return
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *InMemoryWorker) runSender(ctx context.Context, replies <-chan qs.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		case msg, ok := <-replies:
+			if !ok {
+				return
+			}
+			w.deliver(msg)
+		}
+	}
+}
+
+func (w *InMemoryWorker) Close() error {
+	if w.done == nil {
+		return fmt.Errorf("worker not initialized")
+	}
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+// Submit hands the message to the server, blocking until it is accepted. Replies
+// with the message's CorrelationId are kept for Await until Forget is called.
+func (w *InMemoryWorker) Submit(ctx context.Context, msg qs.Message) error {
+	if w.inbox == nil {
+		return fmt.Errorf("worker not initialized")
+	}
+	w.mu.Lock()
+	w.awaited[msg.CorrelationId] = struct{}{}
+	w.mu.Unlock()
+
+	select {
+	case w.inbox <- msg:
+		return nil
+	case <-w.done:
+		return fmt.Errorf("worker closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Await blocks until a reply with the given CorrelationId arrives. Replies that arrive
+// before Await is called are buffered, and each call returns the next one in order.
+func (w *InMemoryWorker) Await(ctx context.Context, correlationID string) (qs.Message, error) {
+	if w.pending == nil {
+		return qs.Message{}, fmt.Errorf("worker not initialized")
+	}
+	for {
+		w.mu.Lock()
+		if messages := w.pending[correlationID]; len(messages) > 0 {
+			if len(messages) == 1 {
+				delete(w.pending, correlationID)
+			} else {
+				w.pending[correlationID] = messages[1:]
+			}
+			w.mu.Unlock()
+			return messages[0], nil
+		}
+		delivered := w.delivered
+		w.mu.Unlock()
+
+		select {
+		case <-delivered:
+		case <-w.done:
+			return qs.Message{}, fmt.Errorf("worker closed")
+		case <-ctx.Done():
+			return qs.Message{}, ctx.Err()
+		}
+	}
+}
+
+// Call submits body as a new request with a unique CorrelationId and waits for its reply.
+// A reply streamed in chunks is reassembled and returned as one message.
+func (w *InMemoryWorker) Call(ctx context.Context, body string) (qs.Message, error) {
+	correlationID := "inmemory-" + strconv.FormatUint(w.nextID.Add(1), 10)
+	defer w.Forget(correlationID)
+
+	if err := w.Submit(ctx, qs.Message{Body: body, CorrelationId: correlationID}); err != nil {
+		return qs.Message{}, err
+	}
+
+	assembler := protocol.NewAssembler()
+	for parts := 1; ; parts++ {
+		msg, err := w.Await(ctx, correlationID)
+		if err != nil {
+			return qs.Message{}, err
+		}
+		reply, complete, err := assembler.Add(msg)
+		if err != nil {
+			return qs.Message{}, err
+		}
+		if !complete {
+			continue
+		}
+		if parts == 1 {
+			return msg, nil
+		}
+		return protocol.NewMessage("", msg, reply), nil
+	}
+}
+
+// Forget stops keeping replies with the given CorrelationId and drops the ones not
+// collected yet, e.g. once a subscription is no longer awaited.
+func (w *InMemoryWorker) Forget(correlationID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.awaited, correlationID)
+	delete(w.pending, correlationID)
+}
+
+func (w *InMemoryWorker) deliver(msg qs.Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.awaited[msg.CorrelationId]; !ok {
+		return
+	}
+	messages := w.pending[msg.CorrelationId]
+	if len(messages) >= maxPendingReplies {
+		messages = messages[1:]
+	}
+	w.pending[msg.CorrelationId] = append(messages, msg)
+	close(w.delivered)
+	w.delivered = make(chan struct{})
+}
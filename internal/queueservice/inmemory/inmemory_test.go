@@ -0,0 +1,544 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/avalkov/SCS/internal/datastructures"
+	commandsParser "github.com/avalkov/SCS/internal/domain/commands_parser"
+	commandsProcessor "github.com/avalkov/SCS/internal/domain/commands_processor"
+	"github.com/avalkov/SCS/internal/domain/delivery"
+	"github.com/avalkov/SCS/internal/domain/keyspace"
+	"github.com/avalkov/SCS/internal/domain/protocol"
+	"github.com/avalkov/SCS/internal/domain/pubsub"
+	"github.com/avalkov/SCS/internal/multiworker"
+	qs "github.com/avalkov/SCS/internal/queueservice"
+)
+
+func startServer(t *testing.T) *InMemoryWorker {
+	t.Helper()
+	return startServerWithMaxReplySize(t, 0)
+}
+
+func startServerWithMaxReplySize(t *testing.T, maxReplySize int) *InMemoryWorker {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	worker := NewInMemoryWorker()
+	if err := worker.Initialize(); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	t.Cleanup(func() { worker.Close() })
+
+	requests := make(chan qs.Message)
+	replies := make(chan qs.Message)
+	if err := worker.Run(ctx, requests, replies); err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+
+	parser := commandsParser.NewCommandsParser()
+	partitioner := ds.NewPartitioner(3)
+	subscriptions := delivery.NewQueue()
+	notifier := keyspace.NewNotifier(subscriptions)
+	processor := commandsProcessor.NewCommandsProcessor(ds.NewShardedMap(partitioner), nil, notifier, partitioner)
+	broker := pubsub.NewBroker(subscriptions)
+	go subscriptions.Run(ctx, replies)
+	go multiworker.NewMultiWorker(partitioner, parser, processor, notifier, broker, maxReplySize).Run(ctx, requests, replies)
+
+	return worker
+}
+
+func call(t *testing.T, worker *InMemoryWorker, body string) protocol.Reply {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := worker.Call(ctx, body)
+	if err != nil {
+		t.Fatalf("call %q failed: %v", body, err)
+	}
+	reply, err := protocol.Decode(msg.Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply to %q: %v", body, err)
+	}
+	return reply
+}
+
+func TestInMemoryWorker_EndToEnd(t *testing.T) {
+	worker := startServer(t)
+
+	tests := []struct {
+		command       string
+		expectedReply protocol.Reply
+	}{
+		{"addItem('key1', 'val1')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "key1", Version: 1}},
+		{"addItem('key2', 'val2')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "key2", Version: 2}},
+		{"addItem('key1', 'val11')", protocol.Reply{Status: protocol.StatusOK, Command: "addItem", Key: "key1", Previous: "val1", Existed: true, Version: 3}},
+		{"getItem('key1')", protocol.Reply{Status: protocol.StatusOK, Command: "getItem", Key: "key1", Value: "val11", Existed: true, Version: 3}},
+		{"deleteItem('key2')", protocol.Reply{Status: protocol.StatusOK, Command: "deleteItem", Key: "key2", Previous: "val2", Existed: true}},
+		{"getItem('key2')", protocol.Reply{Status: protocol.StatusError, Command: "getItem", Key: "key2", ErrorCode: protocol.ErrKeyNotFound, Error: "key not found: key2"}},
+		{"getAllItems()", protocol.Reply{Status: protocol.StatusOK, Command: "getAllItems", Value: []interface{}{
+			map[string]interface{}{"Key": "key1", "Value": "val11"},
+		}}},
+		{"unknownCommand()", protocol.Reply{Status: protocol.StatusError, ErrorCode: protocol.ErrInvalidCommand, Error: "failed to parse command: column 1: expected command name, found unknown command unknownCommand"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if reply := call(t, worker, tt.command); !reflect.DeepEqual(reply, tt.expectedReply) {
+				t.Errorf("expected reply: %+v, got: %+v", tt.expectedReply, reply)
+			}
+		})
+	}
+}
+
+func TestInMemoryWorker_AwaitBuffersEarlyReplies(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, id := range []string{"1", "2"} {
+		if err := worker.Submit(ctx, qs.Message{Body: "addItem('key" + id + "', 'val')", CorrelationId: id}); err != nil {
+			t.Fatalf("failed to submit: %v", err)
+		}
+	}
+
+	for _, id := range []string{"2", "1"} {
+		msg, err := worker.Await(ctx, id)
+		if err != nil {
+			t.Fatalf("failed to await %s: %v", id, err)
+		}
+		if msg.CorrelationId != id {
+			t.Errorf("expected correlation ID: %s, got: %s", id, msg.CorrelationId)
+		}
+	}
+}
+
+func TestInMemoryWorker_DropsRepliesNobodyAwaits(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	call(t, worker, "addItem('key', 'val')")
+	if err := worker.Submit(ctx, qs.Message{Body: "getItem('key')", CorrelationId: "kept"}); err != nil {
+		t.Fatalf("failed to submit: %v", err)
+	}
+	await(t, ctx, worker, "kept")
+
+	worker.deliver(qs.Message{Body: "{}", CorrelationId: "unknown"})
+	for i := 0; i < maxPendingReplies+2; i++ {
+		worker.deliver(qs.Message{Body: strconv.Itoa(i), CorrelationId: "kept"})
+	}
+
+	worker.mu.Lock()
+	if _, ok := worker.pending["unknown"]; ok {
+		t.Errorf("expected the reply to an unknown correlation ID to be dropped")
+	}
+	if kept := worker.pending["kept"]; len(kept) != maxPendingReplies || kept[0].Body != "2" {
+		t.Errorf("expected the %d newest replies to be kept, got %d starting at %q", maxPendingReplies, len(kept), kept[0].Body)
+	}
+	worker.mu.Unlock()
+
+	worker.Forget("kept")
+	worker.deliver(qs.Message{Body: "{}", CorrelationId: "kept"})
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if len(worker.pending) != 0 || len(worker.awaited) != 0 {
+		t.Errorf("expected nothing kept after Forget, got pending: %d, awaited: %d", len(worker.pending), len(worker.awaited))
+	}
+}
+
+func TestInMemoryWorker_NotInitialized(t *testing.T) {
+	worker := NewInMemoryWorker()
+
+	if err := worker.Run(context.Background(), nil, nil); err == nil {
+		t.Errorf("expected error when running an uninitialized worker")
+	}
+	if err := worker.Submit(context.Background(), qs.Message{}); err == nil {
+		t.Errorf("expected error when submitting to an uninitialized worker")
+	}
+}
+
+func TestInMemoryWorker_TransactionKeepsPerKeyOrder(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Submitted back to back, so the router sees them in this order without waiting for replies.
+	bodies := []string{
+		"addItem('acct:1', 100)",
+		"transaction(decrItem('acct:1', 30), incrItem('acct:2', 30))",
+		"getItem('acct:1')",
+		"getItem('acct:2')",
+	}
+	for i, body := range bodies {
+		if err := worker.Submit(ctx, qs.Message{Body: body, CorrelationId: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("failed to submit: %v", err)
+		}
+	}
+
+	replies := make([]protocol.Reply, len(bodies))
+	for i := range bodies {
+		msg, err := worker.Await(ctx, strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("failed to await %d: %v", i, err)
+		}
+		if replies[i], err = protocol.Decode(msg.Body); err != nil {
+			t.Fatalf("failed to decode reply: %v", err)
+		}
+	}
+
+	if replies[1].Status != protocol.StatusOK {
+		t.Errorf("expected transaction to succeed, got: %+v", replies[1])
+	}
+	if replies[2].Value != "70" || replies[3].Value != "30" {
+		t.Errorf("expected reads after the transaction to see it, got: %v and %v", replies[2].Value, replies[3].Value)
+	}
+}
+
+func TestInMemoryWorker_ConcurrentTransactionsDoNotDeadlock(t *testing.T) {
+	worker := startServer(t)
+
+	const (
+		accounts  = 6
+		clients   = 8
+		transfers = 50
+		balance   = 1000
+	)
+	for i := 0; i < accounts; i++ {
+		call(t, worker, fmt.Sprintf("addItem('acct:%d', %d)", i, balance))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Transfers between overlapping pairs of accounts in both directions, mixed with
+	// single-key reads on the same workers.
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < transfers; i++ {
+				from, to := (c+i)%accounts, (c+2*i+1)%accounts
+				if from == to {
+					to = (to + 1) % accounts
+				}
+				body := fmt.Sprintf("transaction(decrItem('acct:%d', 1), incrItem('acct:%d', 1))", from, to)
+				if i%5 == 0 {
+					body = fmt.Sprintf("getItem('acct:%d')", from)
+				}
+				if _, err := worker.Call(ctx, body); err != nil {
+					errs <- fmt.Errorf("call %q failed: %v", body, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i := 0; i < accounts; i++ {
+		reply := call(t, worker, fmt.Sprintf("getItem('acct:%d')", i))
+		n, _ := strconv.Atoi(reply.Value.(string))
+		total += n
+	}
+	if total != accounts*balance {
+		t.Errorf("expected total balance: %d, got: %d", accounts*balance, total)
+	}
+}
+
+func TestInMemoryWorker_MultiKeyCommands(t *testing.T) {
+	worker := startServer(t)
+
+	reply := call(t, worker, "addItems('key1', 'val1', 'key2', 'val2', 'key3', 'val3')")
+	if reply.Status != protocol.StatusOK || len(reply.Value.([]interface{})) != 3 {
+		t.Fatalf("expected 3 keys to be added, got: %+v", reply)
+	}
+
+	reply = call(t, worker, "getItems('key3', 'missing', 'key1')")
+	// The keys are added by different workers, so the order of their versions is not known.
+	for _, result := range reply.Value.([]interface{}) {
+		fields := result.(map[string]interface{})
+		if fields["status"] == "OK" && fields["version"] == nil {
+			t.Errorf("expected a version for %v", fields["key"])
+		}
+		delete(fields, "version")
+	}
+	expected := protocol.Reply{Status: protocol.StatusOK, Command: "getItems", Value: []interface{}{
+		map[string]interface{}{"status": "OK", "command": "getItem", "key": "key3", "value": "val3", "existed": true},
+		map[string]interface{}{"status": "ERROR", "command": "getItem", "key": "missing", "errorCode": "KEY_NOT_FOUND", "error": "key not found: missing"},
+		map[string]interface{}{"status": "OK", "command": "getItem", "key": "key1", "value": "val1", "existed": true},
+	}}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected reply: %+v, got: %+v", expected, reply)
+	}
+}
+
+func TestInMemoryWorker_GetAllItemsIsConsistentCut(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Each round submits a write, getAllItems and another write back to back. The keys
+	// live on different workers, yet getAllItems must see exactly the first write.
+	for round := 0; round < 50; round++ {
+		bodies := []string{
+			fmt.Sprintf("addItem('before', %d)", round),
+			"getAllItems()",
+			fmt.Sprintf("addItem('after', %d)", round),
+		}
+		ids := make([]string, len(bodies))
+		for i, body := range bodies {
+			ids[i] = fmt.Sprintf("%d-%d", round, i)
+			if err := worker.Submit(ctx, qs.Message{Body: body, CorrelationId: ids[i]}); err != nil {
+				t.Fatalf("failed to submit: %v", err)
+			}
+		}
+		for _, id := range ids {
+			msg, err := worker.Await(ctx, id)
+			if err != nil {
+				t.Fatalf("failed to await %s: %v", id, err)
+			}
+			if id != ids[1] {
+				continue
+			}
+			reply, err := protocol.Decode(msg.Body)
+			if err != nil {
+				t.Fatalf("failed to decode reply: %v", err)
+			}
+			items := map[string]interface{}{}
+			for _, item := range reply.Value.([]interface{}) {
+				fields := item.(map[string]interface{})
+				items[fields["Key"].(string)] = fields["Value"]
+			}
+			if items["before"] != strconv.Itoa(round) {
+				t.Fatalf("round %d: expected the preceding write, got: %v", round, items["before"])
+			}
+			if round > 0 && items["after"] != strconv.Itoa(round-1) {
+				t.Fatalf("round %d: expected no later write, got: %v", round, items["after"])
+			}
+		}
+	}
+}
+
+func TestInMemoryWorker_Scan(t *testing.T) {
+	worker := startServer(t)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		call(t, worker, fmt.Sprintf("addItem('%s', 'v')", key))
+		call(t, worker, fmt.Sprintf("addItem('tmp:%d', 'v')", i))
+		expected = append(expected, key)
+	}
+
+	var keys []string
+	cursor := float64(0)
+	for {
+		reply := call(t, worker, fmt.Sprintf("scan(%d, 3, match='user:*')", int64(cursor)))
+		page := reply.Value.(map[string]interface{})
+		for _, item := range page["items"].([]interface{}) {
+			keys = append(keys, item.(map[string]interface{})["Key"].(string))
+		}
+		cursor = page["cursor"].(float64)
+		if cursor == 0 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys in insertion order: %v, got: %v", expected, keys)
+	}
+}
+
+func TestInMemoryWorker_StreamsLargeReplies(t *testing.T) {
+	worker := startServerWithMaxReplySize(t, 256)
+
+	var expected []interface{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		call(t, worker, fmt.Sprintf("addItem('%s', 'value%02d')", key, i))
+		expected = append(expected, map[string]interface{}{"Key": key, "Value": fmt.Sprintf("value%02d", i)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := worker.Submit(ctx, qs.Message{Body: "getAllItems()", CorrelationId: "all"}); err != nil {
+		t.Fatalf("failed to submit: %v", err)
+	}
+
+	assembler := protocol.NewAssembler()
+	for chunks := 1; ; chunks++ {
+		msg, err := worker.Await(ctx, "all")
+		if err != nil {
+			t.Fatalf("failed to await chunk %d: %v", chunks, err)
+		}
+		if len(msg.Body) > 256 {
+			t.Errorf("expected chunks of at most 256 bytes, got %d", len(msg.Body))
+		}
+		reply, complete, err := assembler.Add(msg)
+		if err != nil {
+			t.Fatalf("failed to add chunk %d: %v", chunks, err)
+		}
+		if !complete {
+			continue
+		}
+		if chunks < 2 {
+			t.Errorf("expected the reply to be streamed in several chunks, got %d", chunks)
+		}
+		if reply.Status != protocol.StatusOK || !reflect.DeepEqual(reply.Value, expected) {
+			t.Errorf("expected all items in order, got: %+v", reply)
+		}
+		break
+	}
+}
+
+func TestInMemoryWorker_CallReassemblesStreamedReplies(t *testing.T) {
+	worker := startServerWithMaxReplySize(t, 256)
+
+	var expected []interface{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		call(t, worker, fmt.Sprintf("addItem('%s', 'value%02d')", key, i))
+		expected = append(expected, map[string]interface{}{"Key": key, "Value": fmt.Sprintf("value%02d", i)})
+	}
+
+	reply := call(t, worker, "getAllItems()")
+	if reply.Status != protocol.StatusOK || reply.Chunk != nil || !reflect.DeepEqual(reply.Value, expected) {
+		t.Errorf("expected all items in one reply, got: %+v", reply)
+	}
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if len(worker.pending) != 0 || len(worker.awaited) != 0 {
+		t.Errorf("expected no replies kept after the call, got pending: %d, awaited: %d", len(worker.pending), len(worker.awaited))
+	}
+}
+
+func TestInMemoryWorker_KeyspaceNotifications(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Notifications are replies to the subscribe request and share its CorrelationId.
+	subscribe := func(body string, correlationID string) protocol.Reply {
+		t.Helper()
+		if err := worker.Submit(ctx, qs.Message{Body: body, ReplyTo: "client-1", CorrelationId: correlationID}); err != nil {
+			t.Fatalf("failed to submit %q: %v", body, err)
+		}
+		return await(t, ctx, worker, correlationID)
+	}
+
+	if reply := subscribe("subscribe('orders:*')", "orders"); reply.Status != protocol.StatusOK || reply.Value != float64(1) {
+		t.Fatalf("expected subscribe to succeed, got: %+v", reply)
+	}
+	if reply := call(t, worker, "subscribe('orders:*')"); reply.ErrorCode != protocol.ErrInvalidCommand {
+		t.Errorf("expected subscribe without a reply queue to fail, got: %+v", reply)
+	}
+
+	call(t, worker, "addItem('orders:1', 'new')")
+	call(t, worker, "addItem('users:1', 'alice')")
+	call(t, worker, "addItem('orders:1', 'paid')")
+	call(t, worker, "deleteItem('orders:1')")
+	call(t, worker, "addItem('orders:2', 'new', ttl='50ms')")
+
+	expected := []protocol.Reply{
+		{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:1", Value: "new", Version: 1, Event: "add"},
+		{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:1", Value: "paid", Version: 3, Event: "update"},
+		{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:1", Event: "delete"},
+		{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:2", Value: "new", Version: 5, Event: "add"},
+		{Status: protocol.StatusOK, Command: "subscribe", Key: "orders:2", Event: "expire"},
+	}
+	for _, e := range expected {
+		if reply := await(t, ctx, worker, "orders"); !reflect.DeepEqual(reply, e) {
+			t.Errorf("expected notification: %+v, got: %+v", e, reply)
+		}
+	}
+
+	if reply := subscribe("unsubscribe('orders:*')", "unsubscribe"); reply.Value != float64(1) {
+		t.Errorf("expected 1 subscription removed, got: %+v", reply)
+	}
+	call(t, worker, "addItem('orders:3', 'new')")
+
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if msg, err := worker.Await(short, "orders"); err == nil {
+		t.Errorf("expected no notification after unsubscribing, got: %s", msg.Body)
+	}
+}
+
+func await(t *testing.T, ctx context.Context, worker *InMemoryWorker, correlationID string) protocol.Reply {
+	t.Helper()
+	msg, err := worker.Await(ctx, correlationID)
+	if err != nil {
+		t.Fatalf("failed to await %s: %v", correlationID, err)
+	}
+	reply, err := protocol.Decode(msg.Body)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	return reply
+}
+
+func TestInMemoryWorker_PubSub(t *testing.T) {
+	worker := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subscribe := func(body string, replyTo string, correlationID string) protocol.Reply {
+		t.Helper()
+		if err := worker.Submit(ctx, qs.Message{Body: body, ReplyTo: replyTo, CorrelationId: correlationID}); err != nil {
+			t.Fatalf("failed to submit %q: %v", body, err)
+		}
+		return await(t, ctx, worker, correlationID)
+	}
+
+	subscribe("subscribe(channel='news')", "client-1", "news-1")
+	subscribe("subscribe(pattern='news.*')", "client-2", "news-2")
+	subscribe("subscribe('news.*')", "client-3", "keys-3")
+
+	if reply := call(t, worker, "publish('news', 'hello')"); reply.Value != float64(1) || reply.Channel != "news" {
+		t.Errorf("expected publish to reach 1 subscriber, got: %+v", reply)
+	}
+	if reply := call(t, worker, "publish('news.eu', 'hallo')"); reply.Value != float64(1) {
+		t.Errorf("expected publish to reach 1 subscriber, got: %+v", reply)
+	}
+
+	expected := protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Value: "hello", Channel: "news"}
+	if reply := await(t, ctx, worker, "news-1"); !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected message: %+v, got: %+v", expected, reply)
+	}
+	expected = protocol.Reply{Status: protocol.StatusOK, Command: "subscribe", Value: "hallo", Channel: "news.eu"}
+	if reply := await(t, ctx, worker, "news-2"); !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected message: %+v, got: %+v", expected, reply)
+	}
+
+	// unsubscribe() removes the key and channel subscriptions of the reply queue.
+	subscribe("subscribe('orders:*')", "client-1", "keys-1")
+	if reply := subscribe("unsubscribe()", "client-1", "unsubscribe"); reply.Value != float64(2) {
+		t.Errorf("expected 2 subscriptions removed, got: %+v", reply)
+	}
+	if reply := call(t, worker, "publish('news', 'bye')"); reply.Value != float64(0) {
+		t.Errorf("expected publish to reach no subscribers, got: %+v", reply)
+	}
+}
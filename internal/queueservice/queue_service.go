@@ -12,4 +12,21 @@ type Message struct {
 	Body          string
 	ReplyTo       string
 	CorrelationId string
+	// Delivery is an opaque transport handle of a received request. Replies carry
+	// the handle of the request they answer, so the transport can acknowledge the
+	// request once its reply has been sent. It is nil for messages not tied to a request.
+	Delivery interface{}
+	// Failed marks a reply to a request that could not be processed because of a
+	// server-side error, allowing the transport to redeliver the request.
+	Failed bool
+	// DeadLetter, when set on a reply, asks the transport to move the request it
+	// answers to the dead-letter queue once retries, if any, are exhausted.
+	DeadLetter *DeadLetter
+}
+
+type DeadLetter struct {
+	Reason    string
+	ErrorCode string
+	// Worker identifies who rejected the request: a worker index or "router".
+	Worker string
 }